@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"flag"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
 	"github.com/ssfilatov/ts/pkg/server"
 	"github.com/ssfilatov/ts/pkg/storage"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"syscall"
 	"time"
 )
@@ -16,7 +19,15 @@ import (
 const (
 	defaultPartitionSize = 4096
 	defaultDir = "/app/test-files"
-	partitionDir = "partitions"
+	defaultWatchInterval = 5 * time.Second
+	defaultFollowInterval = 1 * time.Second
+	defaultMaxConcurrentFiles = 4
+	defaultScrubInterval = time.Hour
+	defaultCompactInterval = 10 * time.Minute
+	defaultCacheSize = 0
+	defaultFilterFPR = 0
+	// ingestionStopTimeout limits time spent on cleaning up partitions of interrupted files on shutdown
+	ingestionStopTimeout = 10 * time.Second
 )
 
 func main() {
@@ -24,13 +35,89 @@ func main() {
 	partitionSize := flag.Int("partition-size",
 		defaultPartitionSize, "sets number of records per partition")
 	dir := flag.String("dir", defaultDir, "dir containing data files")
+	watchInterval := flag.Duration("watch-interval",
+		defaultWatchInterval, "sets how often dir is checked for new files, 0 disables watching")
+	follow := flag.Bool("follow", false, "keeps reading files as they grow, like tail -F")
+	followInterval := flag.Duration("follow-interval",
+		defaultFollowInterval, "sets how often followed files are checked for new records")
+	allowLateData := flag.Bool("allow-late-data", false,
+		"accepts appended records older than the data already stored in a dataset")
+	order := flag.String("order", string(processor.OrderSort),
+		"sets how unsorted data files are handled: reject, sort or window")
+	orderWindow := flag.Duration("order-window", time.Minute,
+		"sets how late records could be reordered in window order mode")
+	sortRunSize := flag.Int("sort-run-size", 0,
+		"limits number of records kept in memory while sorting unsorted files")
+	maxErrorRate := flag.Float64("max-error-rate", 0,
+		"fails ingestion of a file when share of malformed lines exceeds it, 0 disables the check")
+	workers := flag.Int("workers", runtime.NumCPU(),
+		"sets number of workers parsing and writing partitions of a single file")
+	maxConcurrentFiles := flag.Int("max-concurrent-files", defaultMaxConcurrentFiles,
+		"limits number of files ingested at once, 0 disables the limit")
+	dedupWindow := flag.Duration("dedup-window", 0,
+		"drops exact duplicate records delivered within the window of the latest record, 0 disables dedup")
+	scrubInterval := flag.Duration("scrub-interval", defaultScrubInterval,
+		"sets how often checksums of partitions are verified, 0 disables scrubbing")
+	compactInterval := flag.Duration("compact-interval", defaultCompactInterval,
+		"sets how often adjacent small partitions are merged, 0 disables compaction")
+	format := flag.String("partition-format", partition.FormatRows.String(),
+		"sets layout of new partition files: columnar or rows")
+	compression := flag.String("compression", string(partition.CodecNone),
+		"sets codec compressing blocks of new partition files: none, snappy or zstd")
+	compressionLevel := flag.Int("compression-level", 0,
+		"sets compression level, 0 stands for the default level of codec")
+	cacheSize := flag.Int64("cache-size", defaultCacheSize,
+		"sets memory budget in bytes of decoded partitions cached for queries, the cache is disabled by default")
+	filterFPR := flag.Float64("filter-fpr", defaultFilterFPR,
+		"sets false positive rate of partition filters over emails and session ids, filters are disabled by default")
+	index := flag.Bool("index", false,
+		"writes index files of new partitions to look up records by email and session id")
 	flag.Parse()
 
+	orderMode, err := processor.ParseOrderMode(*order)
+	if err != nil {
+		log.Fatal(err)
+	}
+	partitionFormat, err := partition.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *filterFPR < 0 || *filterFPR >= 1 {
+		log.Fatal("filter false positive rate should be from 0 to 1")
+	}
+	partitionCompression := partition.Compression{
+		Codec: partition.Codec(*compression),
+		Level: *compressionLevel,
+	}
+	if err := partitionCompression.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
 	ctx := context.Background()
-	partitionStorage, err := storage.NewStorage(ctx, *partitionSize, *dir)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	partitionStorage, err := storage.NewStorage(ctx, storage.Config{
+		PartitionSize: *partitionSize,
+		Dir: *dir,
+		Follow: *follow,
+		FollowInterval: *followInterval,
+		AllowLateData: *allowLateData,
+		Order: orderMode,
+		OrderWindow: *orderWindow,
+		SortRunSize: *sortRunSize,
+		MaxErrorRate: *maxErrorRate,
+		Workers: *workers,
+		MaxConcurrentFiles: *maxConcurrentFiles,
+		DedupWindow: *dedupWindow,
+		Format: partitionFormat,
+		Compression: partitionCompression,
+		CacheSize: *cacheSize,
+		FilterFPR: *filterFPR,
+		Index: *index,
+	})
 	if err != nil {
 		log.Fatalf("error building storage: %v", err)
 	}
@@ -43,18 +130,59 @@ func main() {
 	}()
 	log.Print("server started")
 
-	<-done
-	log.Print("server stopped")
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
-	defer func() {
-		if err := os.RemoveAll(partitionDir); err != nil {
-			log.Printf("error removing partition data: %v", err)
+	ingested := make(chan struct{})
+	go func() {
+		defer close(ingested)
+		if err := partitionStorage.Ingest(ctx); err != nil {
+			log.Printf("error ingesting files: %v", err)
 		}
-		cancel()
+		log.Print("ingestion finished")
 	}()
+	if *scrubInterval > 0 {
+		go partitionStorage.Scrub(ctx, *scrubInterval)
+	}
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		if *watchInterval > 0 {
+			partitionStorage.Watch(ctx, *watchInterval)
+		}
+	}()
+	compacted := make(chan struct{})
+	go func() {
+		defer close(compacted)
+		if *compactInterval > 0 {
+			partitionStorage.Compact(ctx, *compactInterval)
+		}
+	}()
+
+	<-done
+	log.Print("server stopped")
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer shutdownCancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("server shutdown failed: %v", err)
 	}
+
+	stopped := make(chan struct{})
+	go func() {
+		// files are only handed to background goroutines by Ingest and Watch
+		<-ingested
+		<-watched
+		// compaction removes partitions it has written if it is interrupted
+		<-compacted
+		partitionStorage.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Print("ingestion stopped")
+		// partitions are unmapped once ingestion no longer writes or removes them
+		partitionStorage.Close()
+	case <-time.After(ingestionStopTimeout):
+		log.Print("ingestion did not stop in time")
+	}
 	log.Print("server exited properly")
 }
\ No newline at end of file
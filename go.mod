@@ -1,8 +1,11 @@
 module github.com/ssfilatov/ts
 
-go 1.17
+go 1.22
 
 require (
+	github.com/klauspost/compress v1.18.0
+	github.com/mailru/easyjson v0.7.7
+	github.com/ugorji/go/codec v1.2.7
 	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
@@ -13,10 +16,8 @@ require (
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
-	github.com/mailru/easyjson v0.7.7 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.7.1 // indirect
-	github.com/ugorji/go/codec v1.2.7 // indirect
 	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
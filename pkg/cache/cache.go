@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/ssfilatov/ts/pkg/record"
+	"sync"
+)
+
+// recordOverhead approximates memory taken by a decoded record besides its strings and attrs,
+// which is the struct itself and a pointer to it
+const recordOverhead = 64
+
+// Stats counts cache lookups and tells memory taken by cached records
+type Stats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	Budget        int64 `json:"budget"`
+}
+
+type entry struct {
+	key     string
+	records []*record.InternalRecord
+	size    int64
+}
+
+// Cache keeps decoded records of partitions within a byte budget, least recently used partitions are evicted first
+//
+// Records are shared by readers and must not be modified.
+type Cache struct {
+	mu      sync.Mutex
+	budget  int64
+	size    int64
+	entries map[string]*list.Element
+	// lru keeps the most recently used entry at the front
+	lru *list.List
+	// oversized keeps keys of records which do not fit the budget, so that they are not decoded as a whole again
+	oversized map[string]struct{}
+	// generation is a number of invalidations so far, see Add
+	generation int64
+	stats      Stats
+}
+
+func NewCache(budget int64) *Cache {
+	return &Cache{
+		budget:    budget,
+		entries:   map[string]*list.Element{},
+		lru:       list.New(),
+		oversized: map[string]struct{}{},
+	}
+}
+
+// Get returns records cached by key and marks them as recently used
+func (c *Cache) Get(key string) ([]*record.InternalRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry).records, true
+}
+
+// Fits reports whether count records cached by key could fit the budget, it is false for keys
+// which records were found oversized by Add until they are invalidated
+func (c *Cache) Fits(key string, count int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(count)*recordOverhead > c.budget {
+		return false
+	}
+	_, oversized := c.oversized[key]
+	return !oversized
+}
+
+// Generation returns a number of invalidations so far, it is taken before records are decoded to be added
+func (c *Cache) Generation() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Add caches records by key evicting least recently used entries to fit the budget,
+// records which do not fit the budget alone are not cached and their key is remembered as oversized
+//
+// Records are not cached if any key was invalidated since generation was taken, as they could be decoded
+// from a partition which is removed by now and would hold the budget until evicted.
+func (c *Cache) Add(key string, records []*record.InternalRecord, generation int64) {
+	size := Size(records)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if size > c.budget {
+		c.oversized[key] = struct{}{}
+		return
+	}
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	for c.size+size > c.budget {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&entry{
+		key:     key,
+		records: records,
+		size:    size,
+	})
+	c.size += size
+}
+
+// Invalidate drops records cached by key, it is called once a partition is removed or replaced
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.oversized, key)
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+		c.stats.Invalidations++
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.size
+	stats.Budget = c.budget
+	return stats
+}
+
+// Size approximates memory taken by decoded records
+//
+// Emails and session ids are interned by partition readers, so that each distinct value is counted once.
+func Size(records []*record.InternalRecord) int64 {
+	var size int64
+	interned := make(map[string]struct{})
+	intern := func(s string) {
+		if _, found := interned[s]; !found {
+			interned[s] = struct{}{}
+			size += int64(len(s))
+		}
+	}
+	for _, r := range records {
+		size += recordOverhead
+		intern(r.Email)
+		intern(r.SessionID)
+		for name, v := range r.Attrs {
+			// map entry holds the name and an interface value
+			size += int64(len(name)) + 32
+			if s, ok := v.(string); ok {
+				size += int64(len(s))
+			}
+		}
+	}
+	return size
+}
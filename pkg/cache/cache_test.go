@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	records := func(n int) []*record.InternalRecord {
+		rs := make([]*record.InternalRecord, n)
+		for i := range rs {
+			rs[i] = &record.InternalRecord{Timestamp: int64(i), Email: "a@x.com", SessionID: "s1"}
+		}
+		return rs
+	}
+	size := Size(records(1))
+	c := NewCache(3 * size)
+
+	_, found := c.Get("a")
+	require.False(t, found)
+	c.Add("a", records(1), c.Generation())
+	c.Add("b", records(1), c.Generation())
+	c.Add("c", records(1), c.Generation())
+	cached, found := c.Get("a")
+	require.True(t, found)
+	require.Len(t, cached, 1)
+
+	// b is the least recently used one
+	c.Add("d", records(1), c.Generation())
+	_, found = c.Get("b")
+	require.False(t, found)
+	_, found = c.Get("c")
+	require.True(t, found)
+
+	// records which do not fit the budget are not cached
+	c.Add("e", records(4), c.Generation())
+	_, found = c.Get("e")
+	require.False(t, found)
+	// keys found oversized do not fit regardless of the count, others are told by the count alone
+	require.False(t, c.Fits("e", 1))
+	require.True(t, c.Fits("f", 2))
+	require.False(t, c.Fits("f", 1000))
+
+	// f evicts two of a, c and d leaving c which is used last
+	c.Add("f", records(2), c.Generation())
+	c.Invalidate("f")
+	_, found = c.Get("f")
+	require.False(t, found)
+
+	// invalidated keys are no longer known to be oversized as partition files are replaced
+	c.Invalidate("e")
+	require.True(t, c.Fits("e", 1))
+
+	require.Equal(t, Stats{
+		Hits: 2,
+		Misses: 4,
+		Evictions: 3,
+		Invalidations: 1,
+		Entries: 1,
+		Bytes: size,
+		Budget: 3 * size,
+	}, c.Stats())
+}
+
+func TestAddAfterInvalidate(t *testing.T) {
+	records := []*record.InternalRecord{{Timestamp: 1, Email: "a@x.com", SessionID: "s1"}}
+	c := NewCache(Size(records))
+
+	// records decoded before a partition is removed are not cached once it is invalidated
+	generation := c.Generation()
+	c.Invalidate("a")
+	c.Add("a", records, generation)
+	_, found := c.Get("a")
+	require.False(t, found)
+
+	c.Add("a", records, c.Generation())
+	_, found = c.Get("a")
+	require.True(t, found)
+}
+
+func TestSize(t *testing.T) {
+	// emails and session ids repeated in a partition are interned by readers and counted once
+	records := []*record.InternalRecord{
+		{Timestamp: 1, Email: "a@x.com", SessionID: "s1"},
+		{Timestamp: 2, Email: "a@x.com", SessionID: "s1"},
+		{Timestamp: 3, Email: "b@x.com", SessionID: "s1", Attrs: map[string]interface{}{"k": "v"}},
+	}
+	require.Equal(t, int64(3 * recordOverhead + 7 + 7 + 2 + 1 + 32 + 1), Size(records))
+}
@@ -0,0 +1,186 @@
+package catalog
+
+import (
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const version = 1
+
+var (
+	msgpackHandler codec.MsgpackHandle
+)
+
+// PartitionFiles points to data, meta and index files of a single partition
+type PartitionFiles struct {
+	DataPath string
+	MetaPath string
+	// IndexPath is empty for partitions written without index
+	IndexPath string
+}
+
+// Entry describes a source file and partitions built from it
+type Entry struct {
+	Size       int64
+	ModTime    int64
+	Hash       string
+	// Generation is incremented every time the file is ingested again,
+	// it is a part of partition file names so that generations do not overwrite each other
+	Generation int
+	Partitions []PartitionFiles
+	// Accepted, Rejected and Duplicates count lines of the file, in follow mode only lines before Offset are counted
+	Accepted   int64
+	Rejected   int64
+	Duplicates int64
+
+	// Followed is set for files read in follow mode, Inode and Offset point
+	// right after the last record of the last sealed partition
+	Followed bool
+	Inode    uint64
+	Offset   int64
+	// Line is a number of lines before Offset
+	Line     int64
+
+	// Members lists dataset names of archive members, each member has an entry of its own
+	Members []string
+
+	// Appended is set for datasets which are written through the API and have no source file,
+	// NextIndex is an index of the next partition to write, compaction sets it for files as well
+	Appended  bool
+	NextIndex int
+
+	// Postings lists postings files of the dataset which map emails and session ids to records of many partitions,
+	// NextPostings is an index of the next postings file to write
+	Postings     []string
+	NextPostings int
+}
+
+// Copy returns a copy of the entry which does not share partitions, members and postings with it
+func (e *Entry) Copy() *Entry {
+	entryCopy := *e
+	entryCopy.Partitions = append([]PartitionFiles(nil), e.Partitions...)
+	entryCopy.Members = append([]string(nil), e.Members...)
+	entryCopy.Postings = append([]string(nil), e.Postings...)
+	return &entryCopy
+}
+
+type manifest struct {
+	Version int
+	Entries map[string]*Entry
+}
+
+// Catalog is a durable manifest of ingested files, stored next to partition files
+//
+// It allows storage to reopen existing partitions on boot instead of re-ingesting
+// source files that did not change since the previous run.
+type Catalog struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*Entry
+}
+
+// Load reads catalog from path, missing file results in an empty catalog
+func Load(path string) (*Catalog, error) {
+	c := &Catalog{
+		path:    path,
+		entries: map[string]*Entry{},
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog: %w", err)
+	}
+	defer f.Close()
+
+	m := manifest{}
+	if err := codec.NewDecoder(f, &msgpackHandler).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode catalog: %w", err)
+	}
+	if m.Version != version {
+		return nil, fmt.Errorf("unsupported catalog version %d", m.Version)
+	}
+	if m.Entries != nil {
+		c.entries = m.Entries
+	}
+	return c, nil
+}
+
+// Get returns a copy of the entry, so that it can be modified while the catalog is being saved,
+// changes are stored with Set
+func (c *Catalog) Get(name string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[name]
+	if !found {
+		return nil, false
+	}
+	return entry.Copy(), true
+}
+
+func (c *Catalog) Set(name string, entry *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = entry
+}
+
+func (c *Catalog) Delete(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+}
+
+// Names returns names of all files known to catalog
+func (c *Catalog) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Save writes catalog to a temporary file and renames it over the previous version
+func (c *Catalog) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmpPath := c.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create catalog: %w", err)
+	}
+	defer f.Close()
+	m := manifest{
+		Version: version,
+		Entries: c.entries,
+	}
+	if err := codec.NewEncoder(f, &msgpackHandler).Encode(&m); err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync catalog: %w", err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return fmt.Errorf("failed to rename catalog: %w", err)
+	}
+	return syncDir(filepath.Dir(c.path))
+}
+
+// syncDir makes renames and new files in dir durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open dir: %w", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dir: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package catalog
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "catalog")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "catalog")
+
+	c, err := Load(path)
+	require.NoError(t, err)
+	require.Empty(t, c.Names())
+
+	entry := &Entry{
+		Size: 10,
+		ModTime: 20,
+		Hash: "abc",
+		Partitions: []PartitionFiles{{DataPath: "data-0", MetaPath: "meta-0"}},
+		Postings: []string{"postings-0"},
+	}
+	c.Set("sample1.txt", entry)
+	c.Set("sample2.txt", &Entry{})
+	c.Delete("sample2.txt")
+	require.NoError(t, c.Save())
+
+	c, err = Load(path)
+	require.NoError(t, err)
+	loaded, found := c.Get("sample1.txt")
+	require.True(t, found)
+	require.Equal(t, entry, loaded)
+	// entries are copied, so that they are not changed behind the catalog lock
+	loaded.ModTime = 30
+	loaded.Partitions[0].DataPath = "data-1"
+	loaded.Postings[0] = "postings-1"
+	loaded, _ = c.Get("sample1.txt")
+	require.Equal(t, entry, loaded)
+	_, found = c.Get("sample2.txt")
+	require.False(t, found)
+}
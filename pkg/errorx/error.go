@@ -1,9 +1,14 @@
 package errorx
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
 
 type genericError struct {
 	msg string
+	code int
 }
 
 func (e genericError) Error() string {
@@ -11,7 +16,33 @@ func (e genericError) Error() string {
 }
 
 func BadRequest(err error) error {
-	return WrapWithMessage(err, "error decoding request body")
+	return genericError{
+		msg: fmt.Sprintf("error decoding request body, %s", err),
+		code: http.StatusBadRequest,
+	}
+}
+
+func NotFound(msg string) error {
+	return genericError{
+		msg: msg,
+		code: http.StatusNotFound,
+	}
+}
+
+// NotReady is returned for requests to data which is still being ingested
+func NotReady(msg string) error {
+	return genericError{
+		msg: msg,
+		code: http.StatusServiceUnavailable,
+	}
+}
+
+// Conflict is returned for requests which contradict the data already stored
+func Conflict(msg string) error {
+	return genericError{
+		msg: msg,
+		code: http.StatusConflict,
+	}
 }
 
 func WrapWithMessage(e error, msg string) error {
@@ -25,3 +56,12 @@ func New(msg string) error {
 		msg: msg,
 	}
 }
+
+// Code returns http status code matching the error, defaults to internal server error
+func Code(err error) int {
+	var e genericError
+	if errors.As(err, &e) && e.code != 0 {
+		return e.code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,85 @@
+package partition
+
+import (
+	"github.com/ssfilatov/ts/pkg/record"
+	"hash/fnv"
+	"math"
+)
+
+// Filter selects records by field values, empty values match any record
+type Filter struct {
+	Email string
+	SessionID string
+}
+
+func (f Filter) Empty() bool {
+	return f.Email == "" && f.SessionID == ""
+}
+
+func (f Filter) Match(r *record.InternalRecord) bool {
+	return (f.Email == "" || r.Email == f.Email) && (f.SessionID == "" || r.SessionID == f.SessionID)
+}
+
+// Bloom is a Bloom filter over string values, it is stored in meta
+type Bloom struct {
+	Bits []byte
+	// Hashes is a number of bits set per value
+	Hashes int
+}
+
+// NewBloom returns filter over values sized for false positive rate fpr
+func NewBloom(values []string, fpr float64) *Bloom {
+	distinct := map[string]struct{}{}
+	for _, v := range values {
+		distinct[v] = struct{}{}
+	}
+	n := float64(len(distinct))
+	if n == 0 {
+		n = 1
+	}
+	bits := math.Ceil(-n * math.Log(fpr) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(bits / n * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	b := &Bloom{
+		Bits: make([]byte, (int(bits) + 7) / 8),
+		Hashes: hashes,
+	}
+	for v := range distinct {
+		b.add(v)
+	}
+	return b
+}
+
+// locations derives positions of value bits from two halves of a 64 bit hash
+func (b *Bloom) locations(v string, fn func(bit uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	sum := h.Sum64()
+	h1, h2 := sum & math.MaxUint32, sum >> 32
+	m := uint64(len(b.Bits)) * 8
+	for i := 0; i < b.Hashes; i++ {
+		if !fn((h1 + uint64(i) * h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bloom) add(v string) {
+	b.locations(v, func(bit uint64) bool {
+		b.Bits[bit / 8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// MayContain reports false if v is definitely not among filter values, nil filter may contain any value
+func (b *Bloom) MayContain(v string) bool {
+	if b == nil || len(b.Bits) == 0 {
+		return true
+	}
+	return b.locations(v, func(bit uint64) bool {
+		return b.Bits[bit / 8] & (1 << (bit % 8)) != 0
+	})
+}
@@ -0,0 +1,262 @@
+package partition
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/ugorji/go/codec"
+	"sort"
+)
+
+// Format is a layout of partition data file, it is stored in meta
+type Format int
+
+const (
+	// FormatRows is a msgpack array of records, partitions written before formats were introduced
+	// have no format in meta and use it as well
+	FormatRows Format = 1
+	// FormatColumnar keeps timestamps, emails, session ids and attrs in columns of their own, see encodeColumnar
+	FormatColumnar Format = 2
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "rows":
+		return FormatRows, nil
+	case "columnar":
+		return FormatColumnar, nil
+	}
+	return 0, fmt.Errorf("unknown partition format %s", s)
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatRows:
+		return "rows"
+	case FormatColumnar:
+		return "columnar"
+	}
+	return fmt.Sprintf("format %d", int(f))
+}
+
+var errTruncated = errors.New("column is truncated")
+
+// EncodeRecords encodes records sorted by timestamp into partition data of the format
+func EncodeRecords(format Format, records []*record.InternalRecord) ([]byte, error) {
+	switch format {
+	case FormatRows:
+		data, _, err := encodeRows(records)
+		return data, err
+	case FormatColumnar:
+		return encodeColumnar(records)
+	}
+	return nil, fmt.Errorf("unknown partition format %d", format)
+}
+
+// encodeColumnar writes columns one after another, each prefixed with its length as uvarint,
+// so that columns which are not needed are skipped:
+//   - timestamps: number of records, the first timestamp and deltas between consecutive timestamps as varints
+//   - emails and session ids: dictionary of distinct values, each prefixed with its length,
+//     followed by dictionary index of each record as uvarint
+//   - attrs: msgpack encoded attrs of each record prefixed with their length, zero length stands for no attrs
+func encodeColumnar(records []*record.InternalRecord) ([]byte, error) {
+	timestamps := binary.AppendUvarint(nil, uint64(len(records)))
+	var prev int64
+	for _, r := range records {
+		timestamps = binary.AppendVarint(timestamps, r.Timestamp - prev)
+		prev = r.Timestamp
+	}
+	emails := encodeDictionary(records, func(r *record.InternalRecord) string {
+		return r.Email
+	})
+	sessions := encodeDictionary(records, func(r *record.InternalRecord) string {
+		return r.SessionID
+	})
+	attrs := make([]byte, 0)
+	for _, r := range records {
+		if len(r.Attrs) == 0 {
+			attrs = binary.AppendUvarint(attrs, 0)
+			continue
+		}
+		var encoded []byte
+		if err := codec.NewEncoderBytes(&encoded, &msgpackHandler).Encode(r.Attrs); err != nil {
+			return nil, err
+		}
+		attrs = binary.AppendUvarint(attrs, uint64(len(encoded)))
+		attrs = append(attrs, encoded...)
+	}
+
+	data := make([]byte, 0, len(timestamps) + len(emails) + len(sessions) + len(attrs) + 4 * binary.MaxVarintLen64)
+	for _, column := range [][]byte{timestamps, emails, sessions, attrs} {
+		data = binary.AppendUvarint(data, uint64(len(column)))
+		data = append(data, column...)
+	}
+	return data, nil
+}
+
+func encodeDictionary(records []*record.InternalRecord, value func(*record.InternalRecord) string) []byte {
+	indexes := map[string]uint64{}
+	values := make([]string, 0)
+	for _, r := range records {
+		if _, found := indexes[value(r)]; !found {
+			indexes[value(r)] = uint64(len(values))
+			values = append(values, value(r))
+		}
+	}
+	column := binary.AppendUvarint(nil, uint64(len(values)))
+	for _, v := range values {
+		column = binary.AppendUvarint(column, uint64(len(v)))
+		column = append(column, v...)
+	}
+	for _, r := range records {
+		column = binary.AppendUvarint(column, indexes[value(r)])
+	}
+	return column
+}
+
+// columnReader reads varints and length prefixed values of a column, reading stops at the first error
+type columnReader struct {
+	data []byte
+	err error
+}
+
+func (r *columnReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *columnReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// bytes returns a length prefixed value, it points into the column
+func (r *columnReader) bytes() []byte {
+	size := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if size > uint64(len(r.data)) {
+		r.err = errTruncated
+		return nil
+	}
+	v := r.data[:size]
+	r.data = r.data[size:]
+	return v
+}
+
+// count reads a number of values which is checked against the rest of the column, each value takes a byte at least
+func (r *columnReader) count() int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = errTruncated
+	}
+	return int(n)
+}
+
+// selectColumnar decodes records of columnar data which are >= start and <= end
+//
+// Only timestamps column is decoded to look for the range, the rest of columns are decoded for records in the range.
+// Timestamps are multiplied by scale when they are compared to the range, records keep them as they are stored.
+func selectColumnar(data []byte, start, end, scale int64) ([]*record.InternalRecord, error) {
+	file := &columnReader{data: data}
+	timestampsColumn := file.bytes()
+	emailsColumn := file.bytes()
+	sessionsColumn := file.bytes()
+	attrsColumn := file.bytes()
+	if file.err != nil {
+		return nil, file.err
+	}
+
+	column := &columnReader{data: timestampsColumn}
+	timestamps := make([]int64, column.count())
+	var prev int64
+	for i := range timestamps {
+		prev += column.varint()
+		timestamps[i] = prev
+	}
+	if column.err != nil {
+		return nil, fmt.Errorf("error decoding timestamps: %v", column.err)
+	}
+	from := sort.Search(len(timestamps), func(i int) bool {
+		return timestamps[i] * scale >= start
+	})
+	to := sort.Search(len(timestamps), func(i int) bool {
+		return timestamps[i] * scale > end
+	})
+	records := make([]*record.InternalRecord, 0, to - from)
+	if from >= to {
+		return records, nil
+	}
+
+	emails, err := decodeDictionary(emailsColumn, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding emails: %v", err)
+	}
+	sessions, err := decodeDictionary(sessionsColumn, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding session ids: %v", err)
+	}
+	column = &columnReader{data: attrsColumn}
+	for i := 0; i < to; i++ {
+		encoded := column.bytes()
+		if column.err != nil {
+			return nil, fmt.Errorf("error decoding attrs: %v", column.err)
+		}
+		if i < from {
+			continue
+		}
+		r := &record.InternalRecord{
+			Timestamp: timestamps[i],
+			Email: emails[i - from],
+			SessionID: sessions[i - from],
+		}
+		if len(encoded) > 0 {
+			if err := codec.NewDecoderBytes(encoded, &msgpackHandler).Decode(&r.Attrs); err != nil {
+				return nil, fmt.Errorf("error decoding attrs: %v", err)
+			}
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// decodeDictionary returns values of records from index from up to index to of a dictionary column
+func decodeDictionary(data []byte, from, to int) ([]string, error) {
+	column := &columnReader{data: data}
+	dictionary := make([]string, column.count())
+	for i := range dictionary {
+		dictionary[i] = string(column.bytes())
+	}
+	values := make([]string, 0, to - from)
+	for i := 0; i < to; i++ {
+		index := column.uvarint()
+		if column.err != nil {
+			return nil, column.err
+		}
+		if index >= uint64(len(dictionary)) {
+			return nil, fmt.Errorf("dictionary index %d is out of range", index)
+		}
+		if i >= from {
+			values = append(values, dictionary[index])
+		}
+	}
+	return values, nil
+}
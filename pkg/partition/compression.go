@@ -0,0 +1,200 @@
+package partition
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ssfilatov/ts/pkg/record"
+	"sort"
+	"sync"
+)
+
+// Codec compresses blocks of partition data
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecSnappy Codec = "snappy"
+	CodecZstd Codec = "zstd"
+)
+
+// defaultBlockRecords is a number of records per block unless compression sets it
+const defaultBlockRecords = 1024
+
+// Compression sets how partition data is compressed, data is not compressed when codec is empty or none
+type Compression struct {
+	Codec Codec `json:"codec"`
+	// Level is a zstd level from 1 to 22 or snappy level from 1 to 3, zero stands for the default level of codec
+	Level int `json:"level"`
+	// BlockRecords is a number of records per block, blocks are compressed and decompressed as a whole
+	BlockRecords int `json:"blockRecords"`
+}
+
+// Block points to a compressed run of partition records
+type Block struct {
+	// FirstTimestamp is a timestamp of the first record of block
+	FirstTimestamp int64
+	// Offset is a position of block in the data file, block ends where the next one starts
+	Offset int64
+}
+
+func (c Compression) enabled() bool {
+	return c.Codec != "" && c.Codec != CodecNone
+}
+
+// Validate checks that codec is known and level is within its range
+func (c Compression) Validate() error {
+	if c.BlockRecords < 0 {
+		return fmt.Errorf("number of records per block should be positive")
+	}
+	switch c.Codec {
+	case "", CodecNone:
+		return nil
+	case CodecSnappy:
+		if c.Level < 0 || c.Level > 3 {
+			return fmt.Errorf("snappy level should be from 1 to 3")
+		}
+		return nil
+	case CodecZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("zstd level should be from 1 to 22")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compression codec %s", c.Codec)
+}
+
+var (
+	zstdDecoder *zstd.Decoder
+	// zstdEncoders keeps an encoder per level, encoders are safe for concurrent use with EncodeAll
+	zstdEncoders = map[int]*zstd.Encoder{}
+	zstdEncodersMu sync.Mutex
+)
+
+func init() {
+	var err error
+	// nil reader makes decoder usable with DecodeAll only
+	zstdDecoder, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdEncodersMu.Lock()
+	defer zstdEncodersMu.Unlock()
+	if encoder, found := zstdEncoders[level]; found {
+		return encoder, nil
+	}
+	opts := make([]zstd.EOption, 0)
+	if level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders[level] = encoder
+	return encoder, nil
+}
+
+func compress(c Compression, data []byte) ([]byte, error) {
+	switch c.Codec {
+	case CodecSnappy:
+		switch c.Level {
+		case 2:
+			return s2.EncodeSnappyBetter(nil, data), nil
+		case 3:
+			return s2.EncodeSnappyBest(nil, data), nil
+		}
+		return s2.EncodeSnappy(nil, data), nil
+	case CodecZstd:
+		encoder, err := zstdEncoder(c.Level)
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %s", c.Codec)
+}
+
+func decompress(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecSnappy:
+		return s2.Decode(nil, data)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression codec %s", codec)
+}
+
+// EncodeData encodes records sorted by timestamp into partition data of meta format and records indexes,
+// compression and checksum of the data in meta
+//
+// With compression enabled records are split into blocks which are encoded and compressed one by one,
+// uncompressed rows data gets an offset index instead.
+func EncodeData(m *Meta, c Compression, records []*record.InternalRecord) ([]byte, error) {
+	format := m.Format
+	if format == 0 {
+		format = FormatRows
+	}
+	m.Blocks, m.BlockRecords, m.Offsets, m.Compression, m.CompressionLevel = nil, 0, nil, "", 0
+	if !c.enabled() {
+		var data []byte
+		var err error
+		if format == FormatRows {
+			data, m.Offsets, err = encodeRows(records)
+		} else {
+			data, err = EncodeRecords(format, records)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Checksum = Checksum(data)
+		return data, nil
+	}
+	blockRecords := c.BlockRecords
+	if blockRecords == 0 {
+		blockRecords = defaultBlockRecords
+	}
+	data := make([]byte, 0)
+	blocks := make([]Block, 0, (len(records) + blockRecords - 1) / blockRecords)
+	for start := 0; start < len(records); start += blockRecords {
+		end := start + blockRecords
+		if end > len(records) {
+			end = len(records)
+		}
+		encoded, err := EncodeRecords(format, records[start:end])
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := compress(c, encoded)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, Block{
+			FirstTimestamp: records[start].Timestamp,
+			Offset: int64(len(data)),
+		})
+		data = append(data, compressed...)
+	}
+	m.Compression = c.Codec
+	m.CompressionLevel = c.Level
+	m.Blocks = blocks
+	m.BlockRecords = blockRecords
+	m.Checksum = Checksum(data)
+	return data, nil
+}
+
+// overlappingBlocks returns indexes of the first block and the block after the last one which may hold records
+// within the range, a block holds records from its first timestamp up to the first timestamp of the next block
+// inclusive as records with equal timestamps could be split between blocks
+func overlappingBlocks(blocks []Block, start, end int64) (int, int) {
+	from := sort.Search(len(blocks), func(i int) bool {
+		return i == len(blocks) - 1 || blocks[i + 1].FirstTimestamp >= start
+	})
+	to := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].FirstTimestamp > end
+	})
+	return from, to
+}
@@ -1,37 +1,141 @@
 package partition
 
 import (
-	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/ssfilatov/ts/pkg/record"
 	"github.com/ugorji/go/codec"
+	"hash/crc32"
+	"log"
+	"math"
 	"os"
 	"sort"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
 	DataFileName = "data"
 	MetaFileName = "meta"
+	// TempSuffix is appended to names of files being written, they are renamed once they are durable
+	TempSuffix = ".tmp"
+)
+
+// Strategy tells how records of a dataset are split into partitions
+type Strategy string
+
+const (
+	// StrategyCount cuts partitions by number of records
+	StrategyCount Strategy = "count"
+	// StrategyTime cuts partitions at boundaries of fixed time windows aligned to UTC
+	StrategyTime Strategy = "time"
+	// StrategySize cuts partitions once their data reaches target size in bytes
+	StrategySize Strategy = "size"
 )
 
 var (
 	msgpackHandler codec.MsgpackHandle
+	// checksumTable is CRC32C which partition data and meta are checksummed with
+	checksumTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
+// ErrCorrupt is wrapped by errors of partitions which fail checksum verification or decoding
+var ErrCorrupt = errors.New("partition is corrupt")
+
+// ErrClosed is returned by partitions which are read after they are closed
+var ErrClosed = errors.New("partition is closed")
+
+// checksumSize is a size of the checksum which follows encoded meta
+const checksumSize = 4
+
+// Checksum returns checksum of partition data which is stored in meta
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, checksumTable)
+}
+
+// EncodeMeta encodes meta followed by the checksum of the encoding
+func EncodeMeta(m *Meta) ([]byte, error) {
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, &msgpackHandler).Encode(m); err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, checksumTable)), nil
+}
+
+// decodeMeta decodes meta and verifies its checksum, meta written before checksums has none
+func decodeMeta(data []byte) (Meta, error) {
+	m := Meta{}
+	decoder := codec.NewDecoderBytes(data, &msgpackHandler)
+	if err := decoder.Decode(&m); err != nil {
+		return m, fmt.Errorf("failed to decode metadata: %w: %v", ErrCorrupt, err)
+	}
+	encoded := data[:decoder.NumBytesRead()]
+	trailer := data[len(encoded):]
+	if len(trailer) == 0 {
+		return m, nil
+	}
+	if len(trailer) != checksumSize || binary.LittleEndian.Uint32(trailer) != crc32.Checksum(encoded, checksumTable) {
+		return m, fmt.Errorf("metadata checksum mismatch: %w", ErrCorrupt)
+	}
+	return m, nil
+}
+
+func init() {
+	// schema attrs are decoded into interfaces, strings should not turn into byte slices
+	msgpackHandler.RawToString = true
+}
+
 type Partition interface {
 	MinTimestamp() int64
 	MaxTimestamp() int64
+	// Size returns number of partition records
+	Size() int
 	SelectRecords(start, end int64) ([]*record.InternalRecord, error)
 	Setup() error
+	DataPath() string
+	MetaPath() string
+	// Window returns time range covered by partition, start is inclusive and end is exclusive,
+	// partitions cut by time windows cover the whole window
+	Window() (int64, int64)
+	// Schema returns schema of partition records, nil for the default schema
+	Schema() *record.Schema
+	// Verify checks partition data against its checksum, failure marks partition as corrupt
+	Verify() error
+	// Corrupt returns error which partition is marked corrupt with, nil for healthy partitions
+	Corrupt() error
+	// MayContain reports false if partition definitely has no records matching filter
+	MayContain(f Filter) bool
+	// IndexPath returns path of the index file, it is empty for partitions without index
+	IndexPath() string
+	// Lookup returns positions of records matching filter among all records of partition,
+	// ErrNoIndex is returned by partitions without index
+	Lookup(f Filter) ([]int, error)
+	// RecordsAt returns records at ascending positions among all records of partition, such as ones found by Lookup
+	RecordsAt(positions []int) ([]*record.InternalRecord, error)
+	// Acquire keeps partition mapped until Release is called, it returns false once partition is closed
+	Acquire() bool
+	Release()
+	// Close unmaps partition once all readers which acquired it release it, closed partition returns ErrClosed
+	// instead of records. Records returned before do not refer to mapped data and stay valid.
+	Close() error
 }
 
 type partition struct {
 	meta Meta
 	mappedFile []byte
 
+	mu sync.Mutex
+	corrupt error
+	// refs counts readers which acquired partition, mapped file is unmapped once partition is closed
+	// and there are no readers left
+	refs int
+	closed bool
+
 	metaPath string
 	dataPath string
+	indexPath string
 }
 
 func mmap(fd, length int) ([]byte, error) {
@@ -48,6 +152,79 @@ type Meta struct {
 	MinTimestamp  int64
 	MaxTimestamp  int64
 	Size int
+	// Schema is nil for partitions of datasets without schema and for ones written before schemas were introduced
+	Schema *record.Schema `codec:",omitempty"`
+	// Precision is a timestamp unit of partition records, it is zero for partitions written with second precision
+	Precision time.Duration `codec:",omitempty"`
+	// Strategy is empty for partitions written before strategies were introduced, they are cut by count
+	Strategy Strategy `codec:",omitempty"`
+	// WindowStart and WindowEnd are bounds of the time window of partitions cut by time, end is exclusive
+	WindowStart int64 `codec:",omitempty"`
+	WindowEnd int64 `codec:",omitempty"`
+	// Checksum is CRC32C of the data file, it is zero for partitions written before checksums were introduced
+	Checksum uint32 `codec:",omitempty"`
+	// Format is a layout of the data file, it is zero for partitions written in rows before formats were introduced
+	Format Format `codec:",omitempty"`
+	// Compression and CompressionLevel are set for partitions which data is split into compressed blocks
+	Compression Codec `codec:",omitempty"`
+	CompressionLevel int `codec:",omitempty"`
+	// Blocks is an index of compressed blocks, each block is encoded in Format on its own
+	Blocks []Block `codec:",omitempty"`
+	// BlockRecords is a number of records of each block but the last one, it is zero for partitions
+	// written before it was stored, which blocks are not read by position
+	BlockRecords int `codec:",omitempty"`
+	// Offsets is a sparse index of uncompressed rows data pointing to every 64th record,
+	// partitions written before the index was introduced are read from the beginning
+	Offsets []Block `codec:",omitempty"`
+	// EmailFilter and SessionFilter are Bloom filters over emails and session ids of partition records,
+	// they are nil for partitions written without filters
+	EmailFilter *Bloom `codec:",omitempty"`
+	SessionFilter *Bloom `codec:",omitempty"`
+}
+
+// window returns bounds of the time window or the range of partition records if it is not cut by time
+func (m *Meta) window() (int64, int64) {
+	if m.Strategy == StrategyTime {
+		return m.WindowStart, m.WindowEnd
+	}
+	return m.MinTimestamp, m.MaxTimestamp + 1
+}
+
+// decode returns records of data encoded in partition format which are within the range,
+// offsets point into rows data
+func (m *Meta) decode(data []byte, offsets []Block, start, end int64) ([]*record.InternalRecord, error) {
+	if m.Format == FormatColumnar {
+		return selectColumnar(data, start, end, m.scale())
+	}
+	return selectRows(data, offsets, start, end, m.scale())
+}
+
+// scale returns number of nanoseconds in timestamp unit of partition
+func (m *Meta) scale() int64 {
+	if m.Precision == 0 {
+		return int64(time.Second)
+	}
+	return int64(m.Precision)
+}
+
+// toNanos converts timestamps of records decoded from partition with coarser precision
+func (m *Meta) toNanos(records []*record.InternalRecord) {
+	scale := m.scale()
+	if scale == 1 {
+		return
+	}
+	schema := m.Schema
+	if schema == nil {
+		schema = record.DefaultSchema
+	}
+	for _, r := range records {
+		r.Timestamp *= scale
+		for _, field := range schema.Fields {
+			if v, ok := r.Attrs[field.Name].(int64); ok && field.Type == record.TypeTimestamp {
+				r.Attrs[field.Name] = v * scale
+			}
+		}
+	}
 }
 
 func (p *partition) MinTimestamp() int64 {
@@ -58,6 +235,120 @@ func (p *partition) MaxTimestamp() int64 {
 	return p.meta.MaxTimestamp
 }
 
+func (p *partition) Size() int {
+	return p.meta.Size
+}
+
+func (p *partition) DataPath() string {
+	return p.dataPath
+}
+
+func (p *partition) MetaPath() string {
+	return p.metaPath
+}
+
+func (p *partition) Window() (int64, int64) {
+	return p.meta.window()
+}
+
+func (p *partition) Schema() *record.Schema {
+	return p.meta.Schema
+}
+
+func (p *partition) MayContain(f Filter) bool {
+	return (f.Email == "" || p.meta.EmailFilter.MayContain(f.Email)) &&
+		(f.SessionID == "" || p.meta.SessionFilter.MayContain(f.SessionID))
+}
+
+func (p *partition) Verify() error {
+	if err := p.Corrupt(); err != nil {
+		return err
+	}
+	if !p.pin() {
+		return ErrClosed
+	}
+	defer p.Release()
+	if p.meta.Checksum != 0 && crc32.Checksum(p.mappedFile, checksumTable) != p.meta.Checksum {
+		return p.markCorrupt(fmt.Errorf("data checksum mismatch: %w", ErrCorrupt))
+	}
+	return nil
+}
+
+func (p *partition) Corrupt() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.corrupt
+}
+
+// markCorrupt makes partition report err instead of records, err should wrap ErrCorrupt
+func (p *partition) markCorrupt(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.corrupt == nil {
+		p.corrupt = fmt.Errorf("%s: %w", p.dataPath, err)
+	}
+	return p.corrupt
+}
+
+func (p *partition) Acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.refs++
+	return true
+}
+
+// pin keeps partition mapped while it is read, unlike Acquire it succeeds for closed partitions
+// which are still mapped for readers which acquired them
+func (p *partition) pin() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed && p.refs == 0 {
+		return false
+	}
+	p.refs++
+	return true
+}
+
+func (p *partition) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refs--
+	if p.refs == 0 && p.closed {
+		if err := p.unmap(); err != nil {
+			log.Printf("error unmapping partition %s: %v", p.dataPath, err)
+		}
+	}
+}
+
+func (p *partition) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.refs > 0 {
+		return nil
+	}
+	return p.unmap()
+}
+
+// unmap releases mapped file, it is called with mu held
+func (p *partition) unmap() error {
+	if p.mappedFile == nil {
+		return nil
+	}
+	mapped := p.mappedFile
+	p.mappedFile = nil
+	if err := syscall.Munmap(mapped); err != nil {
+		return fmt.Errorf("failed to perform munmap: %w", err)
+	}
+	return nil
+}
+
 func selectBinary(start, end int64, records []*record.InternalRecord) []*record.InternalRecord {
 	startIdx := sort.Search(len(records), func(i int) bool {
 		return records[i].Timestamp >= start
@@ -68,31 +359,287 @@ func selectBinary(start, end int64, records []*record.InternalRecord) []*record.
 	return records[startIdx:endIdx]
 }
 
+// SelectRange returns slice of records sorted by timestamp that are >= start and <= end
+func SelectRange(start, end int64, records []*record.InternalRecord) []*record.InternalRecord {
+	return selectBinary(start, end, records)
+}
+
 // SelectRecords returns slice of records that are >= start and <= end sorted by timestamp
 func (p *partition) SelectRecords(start, end int64) ([]*record.InternalRecord, error) {
 	if end < p.meta.MinTimestamp || start > p.meta.MaxTimestamp {
 		return []*record.InternalRecord{}, nil
 	}
+	if err := p.Corrupt(); err != nil {
+		return nil, err
+	}
+	if !p.pin() {
+		return nil, ErrClosed
+	}
+	defer p.Release()
 
-	partitionRecords := make([]*record.InternalRecord, 0)
-	decoder := codec.NewDecoder(bytes.NewReader(p.mappedFile), &msgpackHandler)
-	if err := decoder.Decode(&partitionRecords); err != nil {
-		return nil, fmt.Errorf("failed to decode data: %w", err)
+	var partitionRecords []*record.InternalRecord
+	var err error
+	if len(p.meta.Blocks) > 0 {
+		partitionRecords, err = p.selectBlocks(start, end)
+	} else {
+		partitionRecords, err = p.meta.decode(p.mappedFile, p.meta.Offsets, start, end)
+	}
+	if err != nil {
+		return nil, p.markCorrupt(fmt.Errorf("failed to decode data: %w: %v", ErrCorrupt, err))
 	}
+	p.meta.toNanos(partitionRecords)
 
 	return selectBinary(start, end, partitionRecords), nil
 }
 
+// selectBlocks decompresses and decodes blocks which may hold records within the range
+func (p *partition) selectBlocks(start, end int64) ([]*record.InternalRecord, error) {
+	from, to := overlappingBlocks(p.meta.Blocks, start, end)
+	records := make([]*record.InternalRecord, 0)
+	for i := from; i < to; i++ {
+		blockRecords, err := p.decodeBlock(i, start, end)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, blockRecords...)
+	}
+	return records, nil
+}
+
+// decodeBlock decompresses i-th block and decodes its records within the range
+func (p *partition) decodeBlock(i int, start, end int64) ([]*record.InternalRecord, error) {
+	blocks := p.meta.Blocks
+	blockEnd := int64(len(p.mappedFile))
+	if i + 1 < len(blocks) {
+		blockEnd = blocks[i + 1].Offset
+	}
+	if blocks[i].Offset < 0 || blocks[i].Offset > blockEnd || blockEnd > int64(len(p.mappedFile)) {
+		return nil, fmt.Errorf("block %d is out of data file", i)
+	}
+	data, err := decompress(p.meta.Compression, p.mappedFile[blocks[i].Offset:blockEnd])
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing block %d: %v", i, err)
+	}
+	return p.meta.decode(data, nil, start, end)
+}
+
+// RecordsAt returns records at ascending positions among records of partition sorted by timestamp
+//
+// Uncompressed rows data is read from the offset index entry preceding each position and compressed partitions
+// decompress only blocks holding the positions. Columnar partitions and ones written without offsets
+// or numbers of block records are decoded as a whole.
+func (p *partition) RecordsAt(positions []int) ([]*record.InternalRecord, error) {
+	if len(positions) == 0 {
+		return []*record.InternalRecord{}, nil
+	}
+	if err := p.Corrupt(); err != nil {
+		return nil, err
+	}
+	for i, pos := range positions {
+		if pos < 0 || pos >= p.meta.Size || i > 0 && pos <= positions[i - 1] {
+			return nil, fmt.Errorf("%s: positions are out of partition or order", p.dataPath)
+		}
+	}
+	if !p.pin() {
+		return nil, ErrClosed
+	}
+	defer p.Release()
+
+	var records []*record.InternalRecord
+	var err error
+	switch {
+	case len(p.meta.Blocks) > 0 && p.meta.BlockRecords > 0:
+		records, err = p.blockRecordsAt(positions)
+	case len(p.meta.Blocks) == 0 && p.meta.Format != FormatColumnar && len(p.meta.Offsets) > 0:
+		records, err = rowsAt(p.mappedFile, p.meta.Offsets, positions)
+	default:
+		records, err = p.decodedRecordsAt(positions)
+	}
+	if err != nil {
+		return nil, p.markCorrupt(fmt.Errorf("failed to decode data: %w: %v", ErrCorrupt, err))
+	}
+	p.meta.toNanos(records)
+	return records, nil
+}
+
+// blockRecordsAt decodes blocks holding the positions one by one
+func (p *partition) blockRecordsAt(positions []int) ([]*record.InternalRecord, error) {
+	records := make([]*record.InternalRecord, 0, len(positions))
+	var blockRecords []*record.InternalRecord
+	block := -1
+	for _, pos := range positions {
+		if i := pos / p.meta.BlockRecords; i != block {
+			if i >= len(p.meta.Blocks) {
+				return nil, fmt.Errorf("position %d is out of blocks", pos)
+			}
+			var err error
+			if blockRecords, err = p.decodeBlock(i, math.MinInt64, math.MaxInt64); err != nil {
+				return nil, err
+			}
+			block = i
+		}
+		offset := pos - block * p.meta.BlockRecords
+		if offset >= len(blockRecords) {
+			return nil, fmt.Errorf("position %d is out of block %d", pos, block)
+		}
+		records = append(records, blockRecords[offset])
+	}
+	return records, nil
+}
+
+// decodedRecordsAt decodes all records of partition and picks the positions
+func (p *partition) decodedRecordsAt(positions []int) ([]*record.InternalRecord, error) {
+	var all []*record.InternalRecord
+	var err error
+	if len(p.meta.Blocks) > 0 {
+		all, err = p.selectBlocks(math.MinInt64, math.MaxInt64)
+	} else {
+		all, err = p.meta.decode(p.mappedFile, nil, math.MinInt64, math.MaxInt64)
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*record.InternalRecord, 0, len(positions))
+	for _, pos := range positions {
+		if pos >= len(all) {
+			return nil, fmt.Errorf("position %d is out of data", pos)
+		}
+		records = append(records, all[pos])
+	}
+	return records, nil
+}
+
+// memPartition keeps records in memory, it is used for the partition which is still being filled
+type memPartition struct {
+	records []*record.InternalRecord
+	schema *record.Schema
+}
+
+// NewMemPartition returns partition over non-empty records sorted by timestamp,
+// records must not be modified afterwards
+func NewMemPartition(records []*record.InternalRecord, schema *record.Schema) Partition {
+	return &memPartition{
+		records: records,
+		schema: schema,
+	}
+}
+
+func (p *memPartition) MinTimestamp() int64 {
+	return p.records[0].Timestamp
+}
+
+func (p *memPartition) MaxTimestamp() int64 {
+	return p.records[len(p.records) - 1].Timestamp
+}
+
+func (p *memPartition) Size() int {
+	return len(p.records)
+}
+
+func (p *memPartition) SelectRecords(start, end int64) ([]*record.InternalRecord, error) {
+	return selectBinary(start, end, p.records), nil
+}
+
+func (p *memPartition) RecordsAt(positions []int) ([]*record.InternalRecord, error) {
+	records := make([]*record.InternalRecord, 0, len(positions))
+	for _, pos := range positions {
+		if pos < 0 || pos >= len(p.records) {
+			return nil, fmt.Errorf("position %d is out of partition", pos)
+		}
+		records = append(records, p.records[pos])
+	}
+	return records, nil
+}
+
+func (p *memPartition) Setup() error {
+	return nil
+}
+
+func (p *memPartition) DataPath() string {
+	return ""
+}
+
+func (p *memPartition) MetaPath() string {
+	return ""
+}
+
+func (p *memPartition) Window() (int64, int64) {
+	return p.MinTimestamp(), p.MaxTimestamp() + 1
+}
+
+func (p *memPartition) Schema() *record.Schema {
+	return p.schema
+}
+
+func (p *memPartition) MayContain(Filter) bool {
+	return true
+}
+
+func (p *memPartition) Acquire() bool {
+	return true
+}
+
+func (p *memPartition) Release() {
+}
+
+func (p *memPartition) Close() error {
+	return nil
+}
+
+func (p *memPartition) Verify() error {
+	return nil
+}
+
+func (p *memPartition) Corrupt() error {
+	return nil
+}
+
 func NewPartition(dataPath, metaPath string) *partition {
+	return NewIndexedPartition(dataPath, metaPath, "")
+}
+
+// NewIndexedPartition returns partition which records are looked up by index file, empty indexPath stands for no index
+func NewIndexedPartition(dataPath, metaPath, indexPath string) *partition {
 	return &partition{
 		metaPath: metaPath,
 		dataPath: dataPath,
+		indexPath: indexPath,
 		meta: Meta{},
 	}
 }
 
-// Setup sets up meta object and mmaps the data file
+// Setup sets up meta object, mmaps the data file and verifies its checksum, the data file is unmapped by Close
+//
+// Errors of partitions which fail verification wrap ErrCorrupt. If meta is intact, such partition is
+// still set up and marked as corrupt, so that it keeps its place among partitions and reports the error.
 func (p *partition) Setup() error {
+	metaData, err := os.ReadFile(p.metaPath)
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+	m, err := decodeMeta(metaData)
+	if err != nil {
+		return err
+	}
+	if m.Format > FormatColumnar {
+		return fmt.Errorf("unsupported partition format %d", m.Format)
+	}
+	if len(m.Blocks) > 0 && m.Compression != CodecSnappy && m.Compression != CodecZstd {
+		return fmt.Errorf("unsupported compression codec %s", m.Compression)
+	}
+	// older partitions are kept as is and converted to nanoseconds on read
+	m.MinTimestamp *= m.scale()
+	m.MaxTimestamp *= m.scale()
+	m.WindowStart *= m.scale()
+	m.WindowEnd *= m.scale()
+	for i := range m.Blocks {
+		m.Blocks[i].FirstTimestamp *= m.scale()
+	}
+	for i := range m.Offsets {
+		m.Offsets[i].FirstTimestamp *= m.scale()
+	}
+	p.meta = m
+
 	f, err := os.Open(p.dataPath)
 	if err != nil {
 		return fmt.Errorf("failed to read data file: %w", err)
@@ -103,24 +650,12 @@ func (p *partition) Setup() error {
 		return fmt.Errorf("failed to fetch file info: %w", err)
 	}
 	if info.Size() == 0 {
-		return fmt.Errorf("empty partition file")
+		return p.markCorrupt(fmt.Errorf("empty partition file: %w", ErrCorrupt))
 	}
 	mapped, err := mmap(int(f.Fd()), int(info.Size()))
 	if err != nil {
 		return fmt.Errorf("failed to perform mmap: %w", err)
 	}
-
-	m := Meta{}
-	mf, err := os.Open(p.metaPath)
-	if err != nil {
-		return fmt.Errorf("failed to read metadata: %w", err)
-	}
-	defer mf.Close()
-	decoder := codec.NewDecoder(mf, &msgpackHandler)
-	if err := decoder.Decode(&m); err != nil {
-		return fmt.Errorf("failed to decode metadata: %w", err)
-	}
 	p.mappedFile = mapped
-	p.meta = m
-	return nil
+	return p.Verify()
 }
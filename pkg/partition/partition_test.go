@@ -1,9 +1,17 @@
 package partition
 
 import (
+	"fmt"
 	"github.com/ssfilatov/ts/pkg/record"
 	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestSelectBinary(t *testing.T) {
@@ -34,3 +42,458 @@ func TestSelectBinary(t *testing.T) {
 	require.Len(t, selectBinary(50, 70, records), 1)
 	require.Len(t, selectBinary(60, 70, records), 0)
 }
+
+func TestLegacyPrecision(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	encode := func(path string, v interface{}) {
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, codec.NewEncoder(f, &msgpackHandler).Encode(v))
+	}
+	dataPath, metaPath := filepath.Join(tmpdir, "data"), filepath.Join(tmpdir, "meta")
+	encode(dataPath, []*record.InternalRecord{{Timestamp: 10}, {Timestamp: 20}})
+	encode(metaPath, struct {
+		MinTimestamp int64
+		MaxTimestamp int64
+		Size int
+	}{10, 20, 2})
+
+	p := NewPartition(dataPath, metaPath)
+	require.NoError(t, p.Setup())
+	require.Equal(t, 10 * int64(time.Second), p.MinTimestamp())
+	require.Equal(t, 20 * int64(time.Second), p.MaxTimestamp())
+	records, err := p.SelectRecords(15 * int64(time.Second), 25 * int64(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, []*record.InternalRecord{{Timestamp: 20 * int64(time.Second)}}, records)
+}
+
+func TestChecksum(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	var data []byte
+	require.NoError(t, codec.NewEncoderBytes(&data, &msgpackHandler).Encode(
+		[]*record.InternalRecord{{Timestamp: 10}, {Timestamp: 20}}))
+	meta, err := EncodeMeta(&Meta{
+		MinTimestamp: 10,
+		MaxTimestamp: 20,
+		Size: 2,
+		Precision: time.Nanosecond,
+		Checksum: crc32.Checksum(data, checksumTable),
+	})
+	require.NoError(t, err)
+	dataPath, metaPath := filepath.Join(tmpdir, "data"), filepath.Join(tmpdir, "meta")
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+	require.NoError(t, os.WriteFile(metaPath, meta, 0644))
+
+	p := NewPartition(dataPath, metaPath)
+	require.NoError(t, p.Setup())
+	require.NoError(t, p.Corrupt())
+
+	data[len(data) - 1] ^= 0xff
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+	p = NewPartition(dataPath, metaPath)
+	require.ErrorIs(t, p.Setup(), ErrCorrupt)
+	require.ErrorIs(t, p.Corrupt(), ErrCorrupt)
+	require.Equal(t, int64(10), p.MinTimestamp())
+	_, err = p.SelectRecords(0, 30)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	meta[0] ^= 0xff
+	require.NoError(t, os.WriteFile(metaPath, meta, 0644))
+	require.ErrorIs(t, NewPartition(dataPath, metaPath).Setup(), ErrCorrupt)
+}
+
+// sampleRecords returns n records with repeated emails and session ids, two records share each timestamp
+func sampleRecords(n int) []*record.InternalRecord {
+	records := make([]*record.InternalRecord, 0, n)
+	for i := 0; i < n; i++ {
+		r := &record.InternalRecord{
+			Timestamp: 1e18 + int64(i / 2) * int64(time.Millisecond),
+			Email: fmt.Sprintf("user%d@example.com", i % 3),
+			SessionID: fmt.Sprintf("session-%d", i % 7),
+		}
+		if i % 10 == 0 {
+			r.Attrs = map[string]interface{}{"country": "nl", "status": int64(i)}
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func writePartition(t *testing.T, dir, name string, format Format, c Compression,
+	records []*record.InternalRecord) Partition {
+
+	m := &Meta{
+		MinTimestamp: records[0].Timestamp,
+		MaxTimestamp: records[len(records) - 1].Timestamp,
+		Size: len(records),
+		Precision: time.Nanosecond,
+		Format: format,
+	}
+	data, err := EncodeData(m, c, records)
+	require.NoError(t, err)
+	meta, err := EncodeMeta(m)
+	require.NoError(t, err)
+	dataPath := filepath.Join(dir, name + "-data")
+	metaPath := filepath.Join(dir, name + "-meta")
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+	require.NoError(t, os.WriteFile(metaPath, meta, 0644))
+	p := NewPartition(dataPath, metaPath)
+	require.NoError(t, p.Setup())
+	return p
+}
+
+func TestColumnar(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(100)
+	rows := writePartition(t, tmpdir, "rows", FormatRows, Compression{}, records)
+	columnar := writePartition(t, tmpdir, "columnar", FormatColumnar, Compression{}, records)
+	rowsInfo, err := os.Stat(rows.DataPath())
+	require.NoError(t, err)
+	columnarInfo, err := os.Stat(columnar.DataPath())
+	require.NoError(t, err)
+	require.Less(t, columnarInfo.Size() * 2, rowsInfo.Size())
+
+	ms := int64(time.Millisecond)
+	for _, bounds := range [][2]int64{{0, 2e18}, {1e18 + 10 * ms, 1e18 + 20 * ms}, {1e18 + 49 * ms, 2e18}, {0, 1e18 - 1}} {
+		expected, err := rows.SelectRecords(bounds[0], bounds[1])
+		require.NoError(t, err)
+		selected, err := columnar.SelectRecords(bounds[0], bounds[1])
+		require.NoError(t, err)
+		require.Equal(t, expected, selected)
+	}
+	selected, err := columnar.SelectRecords(1e18 + 10 * ms, 1e18 + 10 * ms)
+	require.NoError(t, err)
+	require.Len(t, selected, 2)
+	require.Equal(t, "user2@example.com", selected[0].Email)
+	require.Equal(t, int64(20), selected[0].Attrs["status"])
+
+	data, err := EncodeRecords(FormatColumnar, records)
+	require.NoError(t, err)
+	_, err = selectColumnar(data[:len(data) - 10], 0, 2e18, 1)
+	require.Error(t, err)
+}
+
+func TestCompression(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(100)
+	plain := writePartition(t, tmpdir, "plain", FormatRows, Compression{}, records)
+	ms := int64(time.Millisecond)
+	for _, format := range []Format{FormatRows, FormatColumnar} {
+		for _, codec := range []Codec{CodecSnappy, CodecZstd} {
+			// odd number of records per block splits records with equal timestamps between blocks
+			c := Compression{Codec: codec, BlockRecords: 7}
+			p := writePartition(t, tmpdir, format.String() + "-" + string(codec), format, c, records)
+			for _, bounds := range [][2]int64{{0, 2e18}, {1e18 + 3 * ms, 1e18 + 3 * ms}, {1e18 + 10 * ms, 1e18 + 20 * ms},
+				{1e18 + 49 * ms, 2e18}, {0, 1e18 - 1}} {
+
+				expected, err := plain.SelectRecords(bounds[0], bounds[1])
+				require.NoError(t, err)
+				selected, err := p.SelectRecords(bounds[0], bounds[1])
+				require.NoError(t, err)
+				require.Equal(t, expected, selected, "%s %s %v", format, codec, bounds)
+			}
+		}
+	}
+
+	blocks := []Block{{FirstTimestamp: 10}, {FirstTimestamp: 20}, {FirstTimestamp: 20}, {FirstTimestamp: 30}}
+	from, to := overlappingBlocks(blocks, 20, 20)
+	require.Equal(t, [2]int{0, 3}, [2]int{from, to})
+	from, to = overlappingBlocks(blocks, 21, 29)
+	require.Equal(t, [2]int{2, 3}, [2]int{from, to})
+	from, to = overlappingBlocks(blocks, 31, 40)
+	require.Equal(t, [2]int{3, 4}, [2]int{from, to})
+	from, to = overlappingBlocks(blocks, 0, 9)
+	require.Equal(t, [2]int{0, 0}, [2]int{from, to})
+}
+
+func TestRows(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(1000)
+	rows := writePartition(t, tmpdir, "rows", FormatRows, Compression{}, records)
+	require.Len(t, rows.(*partition).meta.Offsets, 16)
+
+	ms := int64(time.Millisecond)
+	for _, bounds := range [][2]int64{{0, 2e18}, {1e18, 1e18}, {1e18 + 31 * ms, 1e18 + 32 * ms}, {1e18 + 100 * ms, 1e18 + 300 * ms},
+		{1e18 + 499 * ms, 2e18}, {1e18 + 500 * ms, 2e18}, {0, 1e18 - 1}} {
+
+		selected, err := rows.SelectRecords(bounds[0], bounds[1])
+		require.NoError(t, err)
+		require.Equal(t, selectBinary(bounds[0], bounds[1], records), selected, "%v", bounds)
+	}
+
+	// a narrow range is read starting from the index entry preceding it and records are not allocated one by one
+	allocs := testing.AllocsPerRun(10, func() {
+		selected, err := rows.SelectRecords(1e18 + 401 * ms, 1e18 + 401 * ms)
+		require.NoError(t, err)
+		require.Len(t, selected, 2)
+	})
+	require.Less(t, allocs, 16.0)
+
+	// records written by the reflection based encoder are read as well
+	var data []byte
+	require.NoError(t, codec.NewEncoderBytes(&data, &msgpackHandler).Encode(records))
+	selected, err := selectRows(data, nil, 1e18 + 10 * ms, 1e18 + 20 * ms, 1)
+	require.NoError(t, err)
+	require.Equal(t, selectBinary(1e18 + 10 * ms, 1e18 + 20 * ms, records), selected)
+}
+
+func TestBloom(t *testing.T) {
+	values := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		values = append(values, fmt.Sprintf("user%d@example.com", i))
+	}
+	b := NewBloom(values, 0.01)
+	for _, v := range values {
+		require.True(t, b.MayContain(v))
+	}
+	var positives int
+	for i := 0; i < 10000; i++ {
+		if b.MayContain(fmt.Sprintf("other%d@example.com", i)) {
+			positives++
+		}
+	}
+	require.Less(t, positives, 300)
+
+	var missing *Bloom
+	require.True(t, missing.MayContain("a@x.com"))
+
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	records := sampleRecords(100)
+	m := &Meta{
+		MinTimestamp: records[0].Timestamp,
+		MaxTimestamp: records[len(records) - 1].Timestamp,
+		Size: len(records),
+		Precision: time.Nanosecond,
+		Format: FormatColumnar,
+		EmailFilter: NewBloom([]string{"user0@example.com", "user1@example.com", "user2@example.com"}, 0.001),
+	}
+	data, err := EncodeData(m, Compression{}, records)
+	require.NoError(t, err)
+	meta, err := EncodeMeta(m)
+	require.NoError(t, err)
+	dataPath, metaPath := filepath.Join(tmpdir, "data"), filepath.Join(tmpdir, "meta")
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+	require.NoError(t, os.WriteFile(metaPath, meta, 0644))
+	p := NewPartition(dataPath, metaPath)
+	require.NoError(t, p.Setup())
+	require.True(t, p.MayContain(Filter{Email: "user1@example.com", SessionID: "session-1"}))
+	require.False(t, p.MayContain(Filter{Email: "user9@example.com"}))
+}
+
+func TestLookup(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(100)
+	unindexed := writePartition(t, tmpdir, "p", FormatColumnar, Compression{}, records)
+	_, err = unindexed.Lookup(Filter{Email: "user1@example.com"})
+	require.ErrorIs(t, err, ErrNoIndex)
+
+	index, err := EncodeIndex(unindexed.DataPath(), records)
+	require.NoError(t, err)
+	indexPath := filepath.Join(tmpdir, "p-index")
+	require.NoError(t, os.WriteFile(indexPath, index, 0644))
+	p := NewIndexedPartition(unindexed.DataPath(), unindexed.MetaPath(), indexPath)
+	require.NoError(t, p.Setup())
+	opened, err := OpenIndex(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{unindexed.DataPath()}, opened.Partitions())
+	require.NoError(t, opened.Close())
+
+	for _, f := range []Filter{
+		{Email: "user1@example.com"},
+		{SessionID: "session-3"},
+		{Email: "user1@example.com", SessionID: "session-3"},
+		{Email: "user9@example.com"},
+		{Email: "user2@example.com", SessionID: "session-9"},
+	} {
+		expected := make([]int, 0)
+		for i, r := range records {
+			if f.Match(r) {
+				expected = append(expected, i)
+			}
+		}
+		positions, err := p.Lookup(f)
+		require.NoError(t, err)
+		require.Equal(t, expected, positions, f)
+	}
+
+	// footer pointing out of file makes lookups fail
+	for i := len(index) - indexFooterSize; i < len(index) - checksumSize; i++ {
+		index[i] = 0xff
+	}
+	require.NoError(t, os.WriteFile(indexPath, index, 0644))
+	corrupt := NewIndexedPartition(unindexed.DataPath(), unindexed.MetaPath(), indexPath)
+	require.NoError(t, corrupt.Setup())
+	_, err = corrupt.Lookup(Filter{Email: "user1@example.com"})
+	require.Error(t, err)
+	_, err = OpenIndex(indexPath)
+	require.Error(t, err)
+}
+
+func TestMergeIndexes(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(300)
+	parts := [][]*record.InternalRecord{records[:100], records[100:200], records[200:]}
+	sources := make([]string, 0)
+	for i, partRecords := range parts {
+		index, err := EncodeIndex(fmt.Sprintf("data-%d", i), partRecords)
+		require.NoError(t, err)
+		path := filepath.Join(tmpdir, fmt.Sprintf("index-%d", i))
+		require.NoError(t, os.WriteFile(path, index, 0644))
+		sources = append(sources, path)
+	}
+	merge := func(path string, sources []string, keep func(string) bool) {
+		out, err := os.Create(path)
+		require.NoError(t, err)
+		defer out.Close()
+		_, err = MergeIndexes(out, sources, keep)
+		require.NoError(t, err)
+	}
+	all := func(string) bool { return true }
+	first := filepath.Join(tmpdir, "postings-0")
+	merge(first, sources[:2], all)
+	// postings files are merged with each other the same way, postings of partitions which are not kept are dropped
+	merged := filepath.Join(tmpdir, "postings-1")
+	merge(merged, []string{first, sources[2]}, func(dataPath string) bool {
+		return dataPath != "data-1"
+	})
+	index, err := OpenIndex(merged)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"data-0", "data-2"}, index.Partitions())
+
+	for _, f := range []Filter{
+		{Email: "user1@example.com"},
+		{SessionID: "session-3"},
+		{Email: "user1@example.com", SessionID: "session-3"},
+		{Email: "user9@example.com"},
+	} {
+		expected := map[string][]uint32{}
+		for i, partRecords := range parts {
+			if i == 1 {
+				continue
+			}
+			for pos, r := range partRecords {
+				if f.Match(r) {
+					dataPath := fmt.Sprintf("data-%d", i)
+					expected[dataPath] = append(expected[dataPath], uint32(pos))
+				}
+			}
+		}
+		refs, err := LookupIndex(merged, f)
+		require.NoError(t, err)
+		found := map[string][]uint32{}
+		for _, ref := range refs {
+			found[ref.Partition] = ref.Positions
+		}
+		require.Equal(t, expected, found, f)
+		// mapped index finds the same refs
+		refs, err = index.Lookup(f)
+		require.NoError(t, err)
+		found = map[string][]uint32{}
+		for _, ref := range refs {
+			found[ref.Partition] = ref.Positions
+		}
+		require.Equal(t, expected, found, f)
+	}
+	// readers which acquired index before it is closed keep searching it
+	require.True(t, index.Acquire())
+	require.NoError(t, index.Close())
+	require.False(t, index.Acquire())
+	_, err = index.Lookup(Filter{Email: "user1@example.com"})
+	require.NoError(t, err)
+	index.Release()
+	_, err = index.Lookup(Filter{Email: "user1@example.com"})
+	require.ErrorIs(t, err, ErrClosed)
+
+	data, err := os.ReadFile(sources[0])
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, os.WriteFile(sources[0], data, 0644))
+	_, err = MergeIndexes(io.Discard, sources, all)
+	require.Error(t, err)
+}
+
+func TestRecordsAt(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(300)
+	plain := writePartition(t, tmpdir, "plain", FormatRows, Compression{}, records)
+	all, err := plain.SelectRecords(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	positions := []int{0, 1, 63, 64, 65, 130, 131, 299}
+	expected := make([]*record.InternalRecord, 0, len(positions))
+	for _, pos := range positions {
+		expected = append(expected, all[pos])
+	}
+	for name, p := range map[string]Partition{
+		"rows": plain,
+		"columnar": writePartition(t, tmpdir, "columnar", FormatColumnar, Compression{}, records),
+		"compressed": writePartition(t, tmpdir, "compressed", FormatRows, Compression{Codec: CodecZstd, BlockRecords: 7}, records),
+	} {
+		found, err := p.RecordsAt(positions)
+		require.NoError(t, err, name)
+		require.Equal(t, expected, found, name)
+		found, err = p.RecordsAt(nil)
+		require.NoError(t, err, name)
+		require.Empty(t, found, name)
+		_, err = p.RecordsAt([]int{300})
+		require.Error(t, err, name)
+		_, err = p.RecordsAt([]int{5, 4})
+		require.Error(t, err, name)
+	}
+}
+
+func TestClose(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	records := sampleRecords(10)
+	p := writePartition(t, tmpdir, "acquired", FormatColumnar, Compression{}, records).(*partition)
+	require.True(t, p.Acquire())
+	require.NoError(t, p.Close())
+	// readers which acquired partition before it is closed keep reading it
+	selected, err := p.SelectRecords(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	require.Len(t, selected, len(records))
+	require.NoError(t, p.Verify())
+	require.False(t, p.Acquire())
+	require.NotNil(t, p.mappedFile)
+	p.Release()
+	require.Nil(t, p.mappedFile)
+	_, err = p.SelectRecords(math.MinInt64, math.MaxInt64)
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, p.Verify(), ErrClosed)
+	require.NoError(t, p.Close())
+	// records do not refer to unmapped data
+	require.Equal(t, records[9].Email, selected[9].Email)
+
+	p = writePartition(t, tmpdir, "idle", FormatRows, Compression{}, records).(*partition)
+	require.NoError(t, p.Close())
+	require.Nil(t, p.mappedFile)
+}
@@ -0,0 +1,816 @@
+package partition
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/record"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+const (
+	IndexFileName = "index"
+	// PostingsFileName is a name of index files of datasets, each of them covers many partitions of a dataset
+	PostingsFileName = "postings"
+)
+
+// ErrNoIndex is returned by Lookup of partitions written without an index file
+var ErrNoIndex = errors.New("partition has no index")
+
+// Index files map emails and session ids to positions of records in partitions. Index file of a partition covers
+// the partition alone, postings files merge index files of many partitions of a dataset. Keys are sorted, so that
+// a key is found by binary search which reads a few entries of the file. Index files of partitions are searched
+// on disk, postings files are mapped by Index as they are searched by every lookup of a dataset.
+//
+// The file holds entries sorted by key, data paths of covered partitions, offsets of entries and offsets
+// of data paths, both as little endian uint64, and the footer. An entry is a kind byte, uvarint length and bytes
+// of the value and uvarint number of refs, a ref is uvarint number of partition in the file, uvarint number
+// of positions and uvarint deltas of ascending positions. The footer holds numbers of entries and partitions
+// and offset of data paths as little endian uint64 followed by CRC32C of the rest of the file.
+
+const indexFooterSize = 3*8 + checksumSize
+
+// maxIndexValue limits length of values read from index files, so that a corrupt length is not allocated
+const maxIndexValue = 1 << 16
+
+const (
+	emailKey   byte = 'e'
+	sessionKey byte = 's'
+)
+
+type indexKey struct {
+	kind  byte
+	value string
+}
+
+func (k indexKey) less(other indexKey) bool {
+	if k.kind != other.kind {
+		return k.kind < other.kind
+	}
+	return k.value < other.value
+}
+
+// IndexRef points to records of a partition by their positions among records of partition sorted by timestamp
+type IndexRef struct {
+	// Partition is a data path of partition
+	Partition string
+	Positions []uint32
+}
+
+// ref is IndexRef pointing to partition by its number in index file
+type ref struct {
+	partition int
+	positions []uint32
+}
+
+// indexWriter writes entries which are added in key order followed by the tables and the footer
+type indexWriter struct {
+	out      io.Writer
+	w        *bufio.Writer
+	checksum hash.Hash32
+	offset   int64
+	entries  []int64
+	// paths are data paths of partitions in order of their numbers
+	paths   []string
+	numbers map[string]int
+	buf     []byte
+}
+
+func newIndexWriter(out io.Writer) *indexWriter {
+	checksum := crc32.New(checksumTable)
+	return &indexWriter{
+		out:      out,
+		w:        bufio.NewWriter(io.MultiWriter(out, checksum)),
+		checksum: checksum,
+		numbers:  map[string]int{},
+	}
+}
+
+func (w *indexWriter) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+// add writes entry of key, refs should not be empty
+func (w *indexWriter) add(key indexKey, refs []IndexRef) error {
+	w.entries = append(w.entries, w.offset)
+	b := append(w.buf[:0], key.kind)
+	b = binary.AppendUvarint(b, uint64(len(key.value)))
+	b = append(b, key.value...)
+	b = binary.AppendUvarint(b, uint64(len(refs)))
+	for _, r := range refs {
+		number, found := w.numbers[r.Partition]
+		if !found {
+			number = len(w.paths)
+			w.numbers[r.Partition] = number
+			w.paths = append(w.paths, r.Partition)
+		}
+		b = binary.AppendUvarint(b, uint64(number))
+		b = binary.AppendUvarint(b, uint64(len(r.Positions)))
+		var prev uint32
+		for _, pos := range r.Positions {
+			b = binary.AppendUvarint(b, uint64(pos-prev))
+			prev = pos
+		}
+	}
+	w.buf = b
+	return w.write(b)
+}
+
+// finish writes data paths of partitions referred by entries, the tables and the footer
+func (w *indexWriter) finish() error {
+	namesAt := w.offset
+	names := make([]int64, 0, len(w.paths))
+	for _, path := range w.paths {
+		names = append(names, w.offset)
+		if err := w.write([]byte(path)); err != nil {
+			return err
+		}
+	}
+	b := w.buf[:0]
+	for _, offset := range append(w.entries, names...) {
+		b = binary.LittleEndian.AppendUint64(b, uint64(offset))
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(w.entries)))
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(w.paths)))
+	b = binary.LittleEndian.AppendUint64(b, uint64(namesAt))
+	if err := w.write(b); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	_, err := w.out.Write(binary.LittleEndian.AppendUint32(nil, w.checksum.Sum32()))
+	return err
+}
+
+// EncodeIndex returns index file of partition records sorted by timestamp as they are written to partition
+func EncodeIndex(dataPath string, records []*record.InternalRecord) ([]byte, error) {
+	positions := map[indexKey][]uint32{}
+	for i, r := range records {
+		for _, key := range []indexKey{{emailKey, r.Email}, {sessionKey, r.SessionID}} {
+			positions[key] = append(positions[key], uint32(i))
+		}
+	}
+	keys := make([]indexKey, 0, len(positions))
+	for key := range positions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+	var buf bytes.Buffer
+	w := newIndexWriter(&buf)
+	for _, key := range keys {
+		if err := w.add(key, []IndexRef{{Partition: dataPath, Positions: positions[key]}}); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type entryReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readEntry reads the next entry, io.EOF is returned if there are no entries left
+func readEntry(r entryReader) (indexKey, []ref, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return indexKey{}, nil, err
+	}
+	key, err := readValue(r, kind)
+	if err != nil {
+		return indexKey{}, nil, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return indexKey{}, nil, unexpectedEOF(err)
+	}
+	refs := make([]ref, 0)
+	for i := uint64(0); i < count; i++ {
+		number, err := binary.ReadUvarint(r)
+		if err != nil {
+			return indexKey{}, nil, unexpectedEOF(err)
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return indexKey{}, nil, unexpectedEOF(err)
+		}
+		positions := make([]uint32, 0)
+		var pos uint64
+		for j := uint64(0); j < n; j++ {
+			delta, err := binary.ReadUvarint(r)
+			if err != nil {
+				return indexKey{}, nil, unexpectedEOF(err)
+			}
+			pos += delta
+			if pos > math.MaxUint32 {
+				return indexKey{}, nil, fmt.Errorf("position is out of range")
+			}
+			positions = append(positions, uint32(pos))
+		}
+		refs = append(refs, ref{
+			partition: int(number),
+			positions: positions,
+		})
+	}
+	return key, refs, nil
+}
+
+// readValue reads value of a key which kind byte is read already
+func readValue(r entryReader, kind byte) (indexKey, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return indexKey{}, unexpectedEOF(err)
+	}
+	if n > maxIndexValue {
+		return indexKey{}, fmt.Errorf("value is too long")
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return indexKey{}, unexpectedEOF(err)
+	}
+	return indexKey{kind: kind, value: string(value)}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// indexReader reads entries and data paths of index file on demand
+type indexReader struct {
+	data io.ReaderAt
+	// file is nil for index files mapped by Index
+	file       *os.File
+	size       int64
+	entries    int
+	partitions int
+	namesAt    int64
+	// tablesAt is an offset of entry offsets, they are followed by offsets of data paths
+	tablesAt int64
+}
+
+func openIndex(path string) (*indexReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r, err := newIndexReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	r.file = file
+	return r, nil
+}
+
+func newIndexReader(data io.ReaderAt, size int64) (*indexReader, error) {
+	if size < indexFooterSize {
+		return nil, fmt.Errorf("index is truncated")
+	}
+	footer := make([]byte, indexFooterSize)
+	if _, err := data.ReadAt(footer, size-indexFooterSize); err != nil {
+		return nil, err
+	}
+	entries := binary.LittleEndian.Uint64(footer)
+	partitions := binary.LittleEndian.Uint64(footer[8:])
+	namesAt := binary.LittleEndian.Uint64(footer[16:])
+	if entries > uint64(size)/8 || partitions > uint64(size)/8 {
+		return nil, fmt.Errorf("index footer is out of file")
+	}
+	tablesAt := size - indexFooterSize - 8*int64(entries+partitions)
+	if tablesAt < 0 || namesAt > uint64(tablesAt) {
+		return nil, fmt.Errorf("index footer is out of file")
+	}
+	return &indexReader{
+		data:       data,
+		size:       size,
+		entries:    int(entries),
+		partitions: int(partitions),
+		namesAt:    int64(namesAt),
+		tablesAt:   tablesAt,
+	}, nil
+}
+
+func (r *indexReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// verify checks the file against its checksum
+func (r *indexReader) verify() error {
+	checksum := crc32.New(checksumTable)
+	if _, err := io.Copy(checksum, io.NewSectionReader(r.data, 0, r.size-checksumSize)); err != nil {
+		return err
+	}
+	stored := make([]byte, checksumSize)
+	if _, err := r.data.ReadAt(stored, r.size-checksumSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(stored) != checksum.Sum32() {
+		return fmt.Errorf("index checksum mismatch")
+	}
+	return nil
+}
+
+// span returns bounds of i-th of n elements which offsets are stored in a table at offset table,
+// the last element ends at end
+func (r *indexReader) span(table int64, n, i int, end int64) (int64, int64, error) {
+	b := make([]byte, 16)
+	if i+1 == n {
+		b = b[:8]
+	}
+	if _, err := r.data.ReadAt(b, table+8*int64(i)); err != nil {
+		return 0, 0, err
+	}
+	start := int64(binary.LittleEndian.Uint64(b))
+	if i+1 < n {
+		end = int64(binary.LittleEndian.Uint64(b[8:]))
+	}
+	if start < 0 || start > end || end > r.size {
+		return 0, 0, fmt.Errorf("index offsets are out of order")
+	}
+	return start, end, nil
+}
+
+func (r *indexReader) section(start, end int64) *bufio.Reader {
+	return bufio.NewReader(io.NewSectionReader(r.data, start, end-start))
+}
+
+// key reads key of i-th entry skipping its refs
+func (r *indexReader) key(i int) (indexKey, error) {
+	start, end, err := r.span(r.tablesAt, r.entries, i, r.namesAt)
+	if err != nil {
+		return indexKey{}, err
+	}
+	section := r.section(start, end)
+	kind, err := section.ReadByte()
+	if err != nil {
+		return indexKey{}, unexpectedEOF(err)
+	}
+	return readValue(section, kind)
+}
+
+func (r *indexReader) entry(i int) (indexKey, []ref, error) {
+	start, end, err := r.span(r.tablesAt, r.entries, i, r.namesAt)
+	if err != nil {
+		return indexKey{}, nil, err
+	}
+	key, refs, err := readEntry(r.section(start, end))
+	return key, refs, unexpectedEOF(err)
+}
+
+// find returns refs of key, there are none if the key is not found
+func (r *indexReader) find(key indexKey) ([]ref, error) {
+	var err error
+	i := sort.Search(r.entries, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var k indexKey
+		k, err = r.key(i)
+		return !k.less(key)
+	})
+	if err != nil || i == r.entries {
+		return nil, err
+	}
+	found, refs, err := r.entry(i)
+	if err != nil || found != key {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// name returns data path of partition with the number
+func (r *indexReader) name(number int) (string, error) {
+	if number < 0 || number >= r.partitions {
+		return "", fmt.Errorf("partition %d is out of index", number)
+	}
+	start, end, err := r.span(r.tablesAt+8*int64(r.entries), r.partitions, number, r.tablesAt)
+	if err != nil {
+		return "", err
+	}
+	if start < r.namesAt {
+		return "", fmt.Errorf("index offsets are out of order")
+	}
+	name := make([]byte, end-start)
+	if _, err := r.data.ReadAt(name, start); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+func (r *indexReader) names() ([]string, error) {
+	names := make([]string, 0, r.partitions)
+	for i := 0; i < r.partitions; i++ {
+		name, err := r.name(i)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// LookupIndex returns refs of records matching non-empty filter found in index file at path,
+// both values of filter should match if they are set
+func LookupIndex(path string, f Filter) ([]IndexRef, error) {
+	r, err := openIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	refs, err := r.lookup(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return refs, nil
+}
+
+func (r *indexReader) lookup(f Filter) ([]IndexRef, error) {
+	var refs []ref
+	var err error
+	switch {
+	case f.Email == "":
+		refs, err = r.find(indexKey{sessionKey, f.SessionID})
+	case f.SessionID == "":
+		refs, err = r.find(indexKey{emailKey, f.Email})
+	default:
+		refs, err = r.findBoth(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	found := make([]IndexRef, 0, len(refs))
+	for _, ref := range refs {
+		name, err := r.name(ref.partition)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, IndexRef{
+			Partition: name,
+			Positions: ref.positions,
+		})
+	}
+	return found, nil
+}
+
+// findBoth returns refs of records having both email and session id of filter
+func (r *indexReader) findBoth(f Filter) ([]ref, error) {
+	emails, err := r.find(indexKey{emailKey, f.Email})
+	if err != nil || len(emails) == 0 {
+		return nil, err
+	}
+	sessions, err := r.find(indexKey{sessionKey, f.SessionID})
+	if err != nil {
+		return nil, err
+	}
+	sessionPositions := make(map[int][]uint32, len(sessions))
+	for _, ref := range sessions {
+		sessionPositions[ref.partition] = ref.positions
+	}
+	both := make([]ref, 0)
+	for _, emailRef := range emails {
+		positions := intersect(emailRef.positions, sessionPositions[emailRef.partition])
+		if len(positions) > 0 {
+			both = append(both, ref{
+				partition: emailRef.partition,
+				positions: positions,
+			})
+		}
+	}
+	return both, nil
+}
+
+// intersect returns positions found in both ascending lists
+func intersect(a, b []uint32) []uint32 {
+	both := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+// Index is an index file mapped to memory, such as a postings file of a dataset, so that it is searched
+// without reading the file. It is unmapped once it is closed and all readers which acquired it release it.
+type Index struct {
+	path   string
+	mapped []byte
+	reader *indexReader
+	// partitions are data paths of partitions covered by the file
+	partitions []string
+
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+// OpenIndex maps index file at path and verifies it against its checksum
+func OpenIndex(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < indexFooterSize {
+		return nil, fmt.Errorf("%s: index is truncated", path)
+	}
+	mapped, err := mmap(int(file.Fd()), int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform mmap: %w", err)
+	}
+	index := &Index{
+		path:   path,
+		mapped: mapped,
+	}
+	if err := index.setup(); err != nil {
+		syscall.Munmap(mapped)
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return index, nil
+}
+
+func (x *Index) setup() error {
+	r, err := newIndexReader(bytes.NewReader(x.mapped), int64(len(x.mapped)))
+	if err != nil {
+		return err
+	}
+	if err := r.verify(); err != nil {
+		return err
+	}
+	if x.partitions, err = r.names(); err != nil {
+		return err
+	}
+	x.reader = r
+	return nil
+}
+
+func (x *Index) Path() string {
+	return x.path
+}
+
+// Partitions returns data paths of partitions covered by the index
+func (x *Index) Partitions() []string {
+	return x.partitions
+}
+
+// Lookup returns refs of records matching non-empty filter, both values of filter should match if they are set,
+// index should be acquired by the caller
+func (x *Index) Lookup(f Filter) ([]IndexRef, error) {
+	x.mu.Lock()
+	mapped := x.mapped != nil
+	x.mu.Unlock()
+	if !mapped {
+		return nil, ErrClosed
+	}
+	refs, err := x.reader.lookup(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", x.path, err)
+	}
+	return refs, nil
+}
+
+// Acquire keeps index mapped until Release is called, it returns false once index is closed
+func (x *Index) Acquire() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return false
+	}
+	x.refs++
+	return true
+}
+
+func (x *Index) Release() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.refs--
+	if x.refs == 0 && x.closed {
+		if err := x.unmap(); err != nil {
+			log.Printf("error unmapping index %s: %v", x.path, err)
+		}
+	}
+}
+
+// Close unmaps index once all readers which acquired it release it
+func (x *Index) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	if x.refs > 0 {
+		return nil
+	}
+	return x.unmap()
+}
+
+// unmap releases mapped file, it is called with mu held
+func (x *Index) unmap() error {
+	if x.mapped == nil {
+		return nil
+	}
+	mapped := x.mapped
+	x.mapped = nil
+	if err := syscall.Munmap(mapped); err != nil {
+		return fmt.Errorf("failed to perform munmap: %w", err)
+	}
+	return nil
+}
+
+// indexScan reads entries of index file one by one
+type indexScan struct {
+	reader  *indexReader
+	entries *bufio.Reader
+	names   []string
+	// key and refs are of the current entry, done is set once entries are over
+	key  indexKey
+	refs []ref
+	done bool
+}
+
+func newIndexScan(path string) (*indexScan, error) {
+	r, err := openIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	scan := &indexScan{
+		reader:  r,
+		entries: r.section(0, r.namesAt),
+	}
+	if err := r.verify(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if scan.names, err = r.names(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := scan.next(); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return scan, nil
+}
+
+func (s *indexScan) next() error {
+	key, refs, err := readEntry(s.entries)
+	if err == io.EOF {
+		s.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref.partition < 0 || ref.partition >= len(s.names) {
+			return fmt.Errorf("partition %d is out of index", ref.partition)
+		}
+	}
+	s.key, s.refs = key, refs
+	return nil
+}
+
+// MergeIndexes writes index of partitions covered by source index files which keep reports true for to w
+// and returns their data paths, sources are verified against their checksums as they are read
+func MergeIndexes(w io.Writer, sources []string, keep func(dataPath string) bool) ([]string, error) {
+	scans := make([]*indexScan, 0, len(sources))
+	defer func() {
+		for _, scan := range scans {
+			scan.reader.Close()
+		}
+	}()
+	for _, path := range sources {
+		scan, err := newIndexScan(path)
+		if err != nil {
+			return nil, err
+		}
+		scans = append(scans, scan)
+	}
+	writer := newIndexWriter(w)
+	for {
+		var min *indexKey
+		for _, scan := range scans {
+			if !scan.done && (min == nil || scan.key.less(*min)) {
+				key := scan.key
+				min = &key
+			}
+		}
+		if min == nil {
+			break
+		}
+		refs := make([]IndexRef, 0)
+		for i, scan := range scans {
+			if scan.done || scan.key != *min {
+				continue
+			}
+			for _, ref := range scan.refs {
+				if name := scan.names[ref.partition]; keep(name) {
+					refs = append(refs, IndexRef{
+						Partition: name,
+						Positions: ref.positions,
+					})
+				}
+			}
+			if err := scan.next(); err != nil {
+				return nil, fmt.Errorf("%s: %v", sources[i], err)
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+		if err := writer.add(*min, refs); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.finish(); err != nil {
+		return nil, err
+	}
+	return writer.paths, nil
+}
+
+func (p *partition) IndexPath() string {
+	return p.indexPath
+}
+
+// Lookup returns positions of records matching non-empty filter among records of partition sorted by timestamp
+//
+// Partitions which Bloom filters rule the values out are not looked up further. Index file is searched on disk
+// by every lookup, so that nothing of it takes memory between lookups.
+func (p *partition) Lookup(f Filter) ([]int, error) {
+	if p.indexPath == "" {
+		return nil, ErrNoIndex
+	}
+	if !p.MayContain(f) {
+		return nil, nil
+	}
+	refs, err := LookupIndex(p.indexPath, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up index: %w", err)
+	}
+	positions := make([]int, 0)
+	for _, ref := range refs {
+		for _, pos := range ref.Positions {
+			if int(pos) >= p.meta.Size {
+				return nil, fmt.Errorf("%s: position %d is out of partition", p.indexPath, pos)
+			}
+			positions = append(positions, int(pos))
+		}
+	}
+	return positions, nil
+}
+
+func (p *memPartition) IndexPath() string {
+	return ""
+}
+
+// Lookup scans records in memory as partitions which are still being filled have no index
+func (p *memPartition) Lookup(f Filter) ([]int, error) {
+	positions := make([]int, 0)
+	for i, r := range p.records {
+		if f.Match(r) {
+			positions = append(positions, i)
+		}
+	}
+	return positions, nil
+}
@@ -0,0 +1,416 @@
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/ugorji/go/codec"
+	"math"
+)
+
+// offsetInterval is a number of records between entries of the offset index of rows data
+const offsetInterval = 64
+
+// encodeRows encodes records as a msgpack array and returns offsets of every offsetInterval-th record
+func encodeRows(records []*record.InternalRecord) ([]byte, []Block, error) {
+	data := appendArrayHeader(nil, len(records))
+	offsets := make([]Block, 0, len(records) / offsetInterval + 1)
+	var encoded []byte
+	encoder := codec.NewEncoderBytes(&encoded, &msgpackHandler)
+	for i, r := range records {
+		if i % offsetInterval == 0 {
+			offsets = append(offsets, Block{
+				FirstTimestamp: r.Timestamp,
+				Offset: int64(len(data)),
+			})
+		}
+		encoder.ResetBytes(&encoded)
+		if err := encoder.Encode(r); err != nil {
+			return nil, nil, err
+		}
+		data = append(data, encoded...)
+	}
+	return data, offsets, nil
+}
+
+func appendArrayHeader(data []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(data, 0x90 | byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(data, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(data, 0xdd), uint32(n))
+}
+
+// rawRecord points to encoded fields of a record, it is decoded into a record only if it is within the range
+type rawRecord struct {
+	email []byte
+	sessionID []byte
+	timestamp int64
+	attrs []byte
+}
+
+// rowReader decodes msgpack encoded records without reflection, records out of the range are skipped
+// without allocations
+type rowReader struct {
+	data []byte
+	pos int
+	// strings interns emails and session ids, so that a value repeated in partition is allocated once per read
+	strings map[string]string
+	// slab backs records which are returned, so that they are allocated in batches
+	slab []record.InternalRecord
+}
+
+func newRowReader(data []byte) *rowReader {
+	return &rowReader{
+		data: data,
+		strings: map[string]string{},
+	}
+}
+
+func (r *rowReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data) - r.pos {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos:r.pos + n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *rowReader) byte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// length reads big endian length of size bytes
+func (r *rowReader) length(size int) (int, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// container reads a header of array or map and returns number of its elements
+func (r *rowReader) container(fix, fixMask, header16, header32 byte) (int, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b & fixMask == fix:
+		return int(b &^ fixMask), nil
+	case b == header16:
+		return r.length(2)
+	case b == header32:
+		return r.length(4)
+	}
+	return 0, fmt.Errorf("unexpected msgpack type 0x%x", b)
+}
+
+func (r *rowReader) arrayLen() (int, error) {
+	return r.container(0x90, 0xf0, 0xdc, 0xdd)
+}
+
+func (r *rowReader) mapLen() (int, error) {
+	return r.container(0x80, 0xf0, 0xde, 0xdf)
+}
+
+// bytes reads str or bin value
+func (r *rowReader) bytes() ([]byte, error) {
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch {
+	case b & 0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xd9 || b == 0xc4:
+		n, err = r.length(1)
+	case b == 0xda || b == 0xc5:
+		n, err = r.length(2)
+	case b == 0xdb || b == 0xc6:
+		n, err = r.length(4)
+	case b == 0xc0:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected msgpack type 0x%x for string", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.next(n)
+}
+
+func (r *rowReader) int() (int64, error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	if b <= 0x7f || b >= 0xe0 {
+		return int64(int8(b)), nil
+	}
+	var v []byte
+	switch b {
+	case 0xcc, 0xd0:
+		v, err = r.next(1)
+	case 0xcd, 0xd1:
+		v, err = r.next(2)
+	case 0xce, 0xd2:
+		v, err = r.next(4)
+	case 0xcf, 0xd3:
+		v, err = r.next(8)
+	default:
+		return 0, fmt.Errorf("unexpected msgpack type 0x%x for integer", b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case 0xcc:
+		return int64(v[0]), nil
+	case 0xcd:
+		return int64(binary.BigEndian.Uint16(v)), nil
+	case 0xce:
+		return int64(binary.BigEndian.Uint32(v)), nil
+	case 0xcf:
+		return int64(binary.BigEndian.Uint64(v)), nil
+	case 0xd0:
+		return int64(int8(v[0])), nil
+	case 0xd1:
+		return int64(int16(binary.BigEndian.Uint16(v))), nil
+	case 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(v))), nil
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
+
+// skip reads over a value of any type
+func (r *rowReader) skip() error {
+	b, err := r.byte()
+	if err != nil {
+		return err
+	}
+	var n int
+	switch {
+	case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+		return nil
+	case b & 0xf0 == 0x80:
+		return r.skipValues(2 * int(b & 0x0f))
+	case b & 0xf0 == 0x90:
+		return r.skipValues(int(b & 0x0f))
+	case b & 0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xcc || b == 0xd0:
+		n = 1
+	case b == 0xcd || b == 0xd1:
+		n = 2
+	case b == 0xca || b == 0xce || b == 0xd2:
+		n = 4
+	case b == 0xcb || b == 0xcf || b == 0xd3:
+		n = 8
+	case b >= 0xd4 && b <= 0xd8:
+		// fixext of type byte and 1, 2, 4, 8 or 16 bytes
+		n = 1 + 1 << (b - 0xd4)
+	case b == 0xc4 || b == 0xd9:
+		n, err = r.length(1)
+	case b == 0xc5 || b == 0xda:
+		n, err = r.length(2)
+	case b == 0xc6 || b == 0xdb:
+		n, err = r.length(4)
+	case b == 0xc7:
+		n, err = r.length(1)
+		n++
+	case b == 0xc8:
+		n, err = r.length(2)
+		n++
+	case b == 0xc9:
+		n, err = r.length(4)
+		n++
+	case b == 0xdc || b == 0xdd || b == 0xde || b == 0xdf:
+		size := 2
+		if b == 0xdd || b == 0xdf {
+			size = 4
+		}
+		n, err = r.length(size)
+		if err != nil {
+			return err
+		}
+		if b >= 0xde {
+			n *= 2
+		}
+		return r.skipValues(n)
+	default:
+		return fmt.Errorf("unexpected msgpack type 0x%x", b)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.next(n)
+	return err
+}
+
+func (r *rowReader) skipValues(n int) error {
+	for i := 0; i < n; i++ {
+		if err := r.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// raw reads fields of the next record
+func (r *rowReader) raw(raw *rawRecord) error {
+	*raw = rawRecord{}
+	fields, err := r.mapLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < fields; i++ {
+		name, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch string(name) {
+		case "Email":
+			raw.email, err = r.bytes()
+		case "SessionID":
+			raw.sessionID, err = r.bytes()
+		case "Timestamp":
+			raw.timestamp, err = r.int()
+		case "Attrs":
+			start := r.pos
+			err = r.skip()
+			raw.attrs = r.data[start:r.pos]
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding field %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// intern returns string of b, lookup by string(b) does not allocate
+func (r *rowReader) intern(b []byte) string {
+	if s, found := r.strings[string(b)]; found {
+		return s
+	}
+	s := string(b)
+	r.strings[s] = s
+	return s
+}
+
+// decode turns raw fields into a record, records are allocated in batches
+func (r *rowReader) decode(raw *rawRecord) (*record.InternalRecord, error) {
+	if len(r.slab) == 0 {
+		r.slab = make([]record.InternalRecord, offsetInterval)
+	}
+	rec := &r.slab[0]
+	r.slab = r.slab[1:]
+	rec.Email = r.intern(raw.email)
+	rec.SessionID = r.intern(raw.sessionID)
+	rec.Timestamp = raw.timestamp
+	// nil attrs are encoded as msgpack nil
+	if len(raw.attrs) > 0 && raw.attrs[0] != 0xc0 {
+		if err := codec.NewDecoderBytes(raw.attrs, &msgpackHandler).Decode(&rec.Attrs); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// selectRows decodes records of rows data which are >= start and <= end, timestamps are multiplied by scale
+// when they are compared to the range
+//
+// Records are read starting from the offset of the last index entry preceding the range,
+// data without offsets is read from the beginning. Reading stops at the first record after the range.
+func selectRows(data []byte, offsets []Block, start, end, scale int64) ([]*record.InternalRecord, error) {
+	r := newRowReader(data)
+	n, err := r.arrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if len(offsets) > 0 {
+		from, _ := overlappingBlocks(offsets, start, end)
+		r.pos = int(offsets[from].Offset)
+		n -= from * offsetInterval
+		if r.pos < 0 || r.pos > len(data) || n < 0 {
+			return nil, fmt.Errorf("offset index is out of data")
+		}
+	}
+	records := make([]*record.InternalRecord, 0)
+	var raw rawRecord
+	for i := 0; i < n; i++ {
+		if err := r.raw(&raw); err != nil {
+			return nil, err
+		}
+		ts := raw.timestamp * scale
+		if ts > end {
+			break
+		}
+		if ts < start {
+			continue
+		}
+		rec, err := r.decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// rowsAt decodes records of rows data at ascending positions, reading starts from the offset index entry
+// preceding a position unless the previous position is within the same interval
+func rowsAt(data []byte, offsets []Block, positions []int) ([]*record.InternalRecord, error) {
+	r := newRowReader(data)
+	n, err := r.arrayLen()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*record.InternalRecord, 0, len(positions))
+	var raw rawRecord
+	// next is a position of the record r is at
+	next := -1
+	for _, pos := range positions {
+		if pos >= n {
+			return nil, fmt.Errorf("position %d is out of data", pos)
+		}
+		if next < 0 || pos / offsetInterval != next / offsetInterval {
+			entry := pos / offsetInterval
+			if entry >= len(offsets) || offsets[entry].Offset < 0 || offsets[entry].Offset > int64(len(data)) {
+				return nil, fmt.Errorf("offset index is out of data")
+			}
+			r.pos = int(offsets[entry].Offset)
+			next = entry * offsetInterval
+		}
+		for ; next < pos; next++ {
+			if err := r.raw(&raw); err != nil {
+				return nil, err
+			}
+		}
+		if err := r.raw(&raw); err != nil {
+			return nil, err
+		}
+		next++
+		rec, err := r.decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
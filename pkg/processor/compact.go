@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"context"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"math"
+	"os"
+	"reflect"
+)
+
+// CompactionGroups returns index ranges [from, to) of runs of adjacent partitions which could be merged
+// into fewer partitions according to the partitioning strategy
+//
+// Count strategy merges partitions which records fit into a single partition, time strategy merges partitions
+// of the same window and size strategy merges partitions which data files fit into the target size.
+// Partitions in memory and corrupt ones are never merged.
+func (p *Processor) CompactionGroups(partitions []partition.Partition) [][2]int {
+	groups := make([][2]int, 0)
+	for from := 0; from < len(partitions); {
+		to := from + 1
+		if mergeable(partitions[from]) {
+			size := p.partitioning.compactionSize(partitions[from])
+			for to < len(partitions) && mergeable(partitions[to]) {
+				if p.partitioning.strategy == partition.StrategyTime {
+					fromStart, fromEnd := partitions[from].Window()
+					toStart, toEnd := partitions[to].Window()
+					if fromStart != toStart || fromEnd != toEnd {
+						break
+					}
+				} else {
+					size += p.partitioning.compactionSize(partitions[to])
+					if size > p.partitioning.compactionLimit() {
+						break
+					}
+				}
+				to++
+			}
+		}
+		if to - from > 1 {
+			groups = append(groups, [2]int{from, to})
+		}
+		from = to
+	}
+	return groups
+}
+
+func mergeable(part partition.Partition) bool {
+	return part.DataPath() != "" && part.Corrupt() == nil
+}
+
+// compactionSize is a number of records of partition for count strategy and size of its data file for size strategy
+func (p partitioning) compactionSize(part partition.Partition) int64 {
+	if p.strategy != partition.StrategySize {
+		return int64(part.Size())
+	}
+	info, err := os.Stat(part.DataPath())
+	if err != nil {
+		// partition which size is unknown is not merged
+		return math.MaxInt64 / 2
+	}
+	return info.Size()
+}
+
+func (p partitioning) compactionLimit() int64 {
+	if p.strategy == partition.StrategySize {
+		return p.size
+	}
+	return int64(p.records)
+}
+
+// Compact merges records of adjacent partitions and writes them as new partitions starting with startIndex
+//
+// Nothing is written and nil is returned if merged records do not make fewer partitions or partitions have
+// a schema other than the processor one. Source partitions are left as they are.
+func (p *Processor) Compact(ctx context.Context, partitions []partition.Partition, prefix string,
+	startIndex int) ([]partition.Partition, error) {
+
+	records := make([]*record.InternalRecord, 0)
+	for _, part := range partitions {
+		if !reflect.DeepEqual(part.Schema(), p.schema) {
+			return nil, nil
+		}
+		partitionRecords, err := part.SelectRecords(math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, partitionRecords...)
+	}
+	if len(records) == 0 || len(p.partitioning.split(records)) >= len(partitions) {
+		return nil, nil
+	}
+	return p.WriteRecords(ctx, records, prefix, startIndex)
+}
@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DirConfigFileName is a name of the optional config in data dir
+const DirConfigFileName = ".datasets.json"
+
+// DatasetConfig sets how files matching Match pattern are processed
+type DatasetConfig struct {
+	// Match is a shell file name pattern, see path.Match
+	Match string `json:"match"`
+	// Format is one of space, csv, json, logfmt or regex
+	Format string `json:"format"`
+	// Pattern is a regular expression with named groups for regex format
+	Pattern string `json:"pattern"`
+	// Delimiter is a csv field delimiter, comma by default
+	Delimiter string `json:"delimiter"`
+	// Fields maps source field names onto record fields
+	Fields FieldMapping `json:"fields"`
+	// Schema lists record fields besides timestamp, email and sessionId are required when it is not set
+	Schema *record.Schema `json:"schema"`
+	// Partitioning sets how records are split into partitions, partitions are cut by count by default
+	Partitioning *PartitioningConfig `json:"partitioning"`
+	// Compression overrides compression of partition data set by processor options
+	Compression *partition.Compression `json:"compression"`
+}
+
+// DirConfig holds dataset configs of data dir, the first matching dataset config is applied to a file
+type DirConfig struct {
+	Datasets []DatasetConfig `json:"datasets"`
+}
+
+// LoadDirConfig reads config from data dir, missing config results in an empty one
+func LoadDirConfig(dir string) (*DirConfig, error) {
+	cfg := &DirConfig{}
+	data, err := os.ReadFile(filepath.Join(dir, DirConfigFileName))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", DirConfigFileName, err)
+	}
+	for _, dataset := range cfg.Datasets {
+		if _, err := path.Match(dataset.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", dataset.Match, err)
+		}
+		if _, err := newParserFactory(dataset); err != nil {
+			return nil, fmt.Errorf("invalid dataset %s: %v", dataset.Match, err)
+		}
+		if _, err := newPartitioning(dataset.Partitioning, 0); err != nil {
+			return nil, fmt.Errorf("invalid partitioning of dataset %s: %v", dataset.Match, err)
+		}
+		if dataset.Compression != nil {
+			if err := dataset.Compression.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid compression of dataset %s: %v", dataset.Match, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Lookup returns config of the first dataset matching filename,
+// files matching no dataset get format by their extension
+func (c *DirConfig) Lookup(filename string) DatasetConfig {
+	for _, dataset := range c.Datasets {
+		if matched, _ := path.Match(dataset.Match, filename); matched {
+			return dataset
+		}
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return DatasetConfig{Format: FormatCSV}
+	case ".json", ".jsonl", ".ndjson":
+		return DatasetConfig{Format: FormatJSON}
+	case ".logfmt":
+		return DatasetConfig{Format: FormatLogfmt}
+	}
+	return DatasetConfig{Format: FormatSpace}
+}
+
+// ForDataset returns a copy of processor which processes files according to dataset config
+func (p *Processor) ForDataset(cfg DatasetConfig) (*Processor, error) {
+	newParser, err := newParserFactory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	partitioning, err := newPartitioning(cfg.Partitioning, p.partitionSize)
+	if err != nil {
+		return nil, err
+	}
+	datasetProcessor := *p
+	datasetProcessor.newParser = newParser
+	datasetProcessor.partitioning = partitioning
+	datasetProcessor.schema = cfg.Schema
+	if cfg.Compression != nil {
+		datasetProcessor.compression = *cfg.Compression
+	}
+	return &datasetProcessor, nil
+}
@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/record"
+	"sort"
+	"strings"
+)
+
+// dedupKey identifies a record, attrs are encoded in a canonical form
+type dedupKey struct {
+	timestamp int64
+	email string
+	sessionID string
+	attrs string
+}
+
+func keyOf(r *record.InternalRecord) dedupKey {
+	key := dedupKey{
+		timestamp: r.Timestamp,
+		email: r.Email,
+		sessionID: r.SessionID,
+	}
+	if len(r.Attrs) == 0 {
+		return key
+	}
+	names := make([]string, 0, len(r.Attrs))
+	for name := range r.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		// %#v tells values of different types apart, so that 1 and "1" are different attrs
+		fmt.Fprintf(&b, "%s=%#v;", name, r.Attrs[name])
+	}
+	key.attrs = b.String()
+	return key
+}
+
+// deduper remembers records within dedup window of the latest one and drops exact duplicates of them
+//
+// Records older than the window are not checked. Keys are evicted in the order they are added,
+// which is timestamp order as records are sorted by then.
+type deduper struct {
+	window int64
+	seen map[dedupKey]struct{}
+	keys []dedupKey
+	latest int64
+	dropped int64
+}
+
+// newDeduper returns nil when dedup is disabled, seed records are remembered as if they were read before
+func (p *Processor) newDeduper() *deduper {
+	if p.dedupWindow <= 0 {
+		return nil
+	}
+	d := &deduper{
+		window: p.dedupWindow,
+		seen: map[dedupKey]struct{}{},
+	}
+	for _, r := range p.dedupSeed {
+		d.duplicate(r)
+	}
+	d.dropped = 0
+	return d
+}
+
+// duplicate reports whether r equals one of the records seen within the window, r is remembered otherwise
+func (d *deduper) duplicate(r *record.InternalRecord) bool {
+	key := keyOf(r)
+	if d.contains(key) {
+		return true
+	}
+	d.add(key)
+	return false
+}
+
+// contains reports whether a record with the key is seen within the window, such a record is counted as dropped
+func (d *deduper) contains(key dedupKey) bool {
+	if _, found := d.seen[key]; found {
+		d.dropped++
+		return true
+	}
+	return false
+}
+
+// add remembers a record with the key and forgets the ones which are out of the window
+func (d *deduper) add(key dedupKey) {
+	if len(d.keys) == 0 || key.timestamp > d.latest {
+		d.latest = key.timestamp
+	}
+	var evicted int
+	for evicted < len(d.keys) && d.keys[evicted].timestamp < d.latest - d.window {
+		delete(d.seen, d.keys[evicted])
+		evicted++
+	}
+	d.keys = append(d.keys[evicted:], key)
+	d.seen[key] = struct{}{}
+}
+
+// dedupReader skips duplicate records of a sorted reader
+type dedupReader struct {
+	reader recordReader
+	dedup *deduper
+}
+
+func (r *dedupReader) Read() (*record.InternalRecord, error) {
+	for {
+		rec, err := r.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		if !r.dedup.duplicate(rec) {
+			return rec, nil
+		}
+	}
+}
+
+// WithDedupSeed returns a copy of processor which treats records equal to seed ones as duplicates,
+// seed is used to catch records stored before, such as the tail of a dataset which is appended to
+func (p *Processor) WithDedupSeed(seed []*record.InternalRecord) *Processor {
+	seeded := *p
+	seeded.dedupSeed = seed
+	return &seeded
+}
+
+// DropDuplicates removes records which duplicate each other or seed records if dedup is enabled,
+// records should be sorted by timestamp, number of dropped records is returned
+func (p *Processor) DropDuplicates(records []*record.InternalRecord) ([]*record.InternalRecord, int64) {
+	dedup := p.newDeduper()
+	if dedup == nil {
+		return records, 0
+	}
+	kept := make([]*record.InternalRecord, 0, len(records))
+	for _, r := range records {
+		if !dedup.duplicate(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept, dedup.dropped
+}
@@ -0,0 +1,249 @@
+package processor
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/record"
+	"io"
+	"log"
+)
+
+// recordReader returns records one by one, io.EOF is returned after the last record
+type recordReader interface {
+	Read() (*record.InternalRecord, error)
+}
+
+// ctxCheckLines is a number of lines read between checks of context cancellation
+const ctxCheckLines = 1024
+
+// lineReader parses records from lines, malformed lines are handed to reject and skipped
+type lineReader struct {
+	// ctx stops reading once it is done
+	ctx context.Context
+	scanner *bufio.Scanner
+	parser Parser
+	newParser func() Parser
+	// line is a number of the line of the last record read
+	line int64
+	reject RejectFunc
+	stats LineStats
+	// checkErrorRate is called once all lines are read
+	checkErrorRate func(LineStats) error
+
+	// lines are parsed by workers when there are more than one of them, see startParsing
+	workers int
+	ordered <-chan *lineBatch
+	stop chan struct{}
+	// stopped is closed once lines are no longer read
+	stopped chan struct{}
+	parsed []parsedLine
+}
+
+func (p *Processor) newLineReader(ctx context.Context, r io.Reader, reject RejectFunc) *lineReader {
+	return &lineReader{
+		ctx: ctx,
+		scanner: bufio.NewScanner(r),
+		parser: p.newParser(),
+		newParser: p.newParser,
+		reject: reject,
+		checkErrorRate: p.checkErrorRate,
+		workers: p.workers,
+	}
+}
+
+func (r *lineReader) Read() (*record.InternalRecord, error) {
+	if r.workers > 1 {
+		if r.ordered == nil {
+			r.startParsing(r.workers)
+		}
+		rec, found, err := r.readParsed()
+		if err != nil || found {
+			return rec, err
+		}
+		if err := r.checkErrorRate(r.stats); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	for r.scanner.Scan() {
+		r.line++
+		if r.line % ctxCheckLines == 0 {
+			if err := r.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if hp, ok := r.parser.(headerParser); ok && r.line == 1 {
+			if err := hp.ParseHeader(r.scanner.Text()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if r.scanner.Text() == "" {
+			continue
+		}
+		rec, err := r.parser.Parse(r.scanner.Text())
+		if err != nil {
+			if err := r.rejectLine(r.scanner.Text(), err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		r.stats.Accepted++
+		return rec, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := r.checkErrorRate(r.stats); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *lineReader) rejectLine(text string, parseErr error) error {
+	r.stats.Rejected++
+	log.Print(parseErr.Error())
+	if r.reject == nil {
+		return nil
+	}
+	return r.reject(Reject{
+		Line: r.line,
+		Text: text,
+		Error: parseErr.Error(),
+	})
+}
+
+// orderChecker fails on the first record older than the previous one, or stops reading at it if stop is set,
+// so that records read so far could be sorted along with the rest of lines
+type orderChecker struct {
+	reader *lineReader
+	prev int64
+	started bool
+	stop bool
+	// late is the first out of order record once reading is stopped at it
+	late *record.InternalRecord
+}
+
+func (r *orderChecker) Read() (*record.InternalRecord, error) {
+	if r.late != nil {
+		return nil, io.EOF
+	}
+	rec, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if r.started && rec.Timestamp < r.prev {
+		if r.stop {
+			r.late = rec
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("record on line %d is out of order", r.reader.line)
+	}
+	r.started = true
+	r.prev = rec.Timestamp
+	return rec, nil
+}
+
+type windowItem struct {
+	rec *record.InternalRecord
+	seq int
+}
+
+// recordHeap orders records by timestamp and then by arrival so that equal timestamps keep input order
+type recordHeap []windowItem
+
+func (h recordHeap) Len() int {
+	return len(h)
+}
+
+func (h recordHeap) Less(i, j int) bool {
+	if h[i].rec.Timestamp != h[j].rec.Timestamp {
+		return h[i].rec.Timestamp < h[j].rec.Timestamp
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h recordHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *recordHeap) Push(x interface{}) {
+	*h = append(*h, x.(windowItem))
+}
+
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old) - 1]
+	*h = old[:len(old) - 1]
+	return item
+}
+
+// windowReader holds records back until no record within window could precede them,
+// records which are late by more than window fail reading
+type windowReader struct {
+	reader *lineReader
+	window int64
+	pending recordHeap
+	seq int
+	maxSeen int64
+	lastEmitted int64
+	emitted bool
+	eof bool
+}
+
+func (r *windowReader) Read() (*record.InternalRecord, error) {
+	for !r.eof {
+		if len(r.pending) > 0 && r.pending[0].rec.Timestamp <= r.maxSeen - r.window {
+			break
+		}
+		rec, err := r.reader.Read()
+		if err == io.EOF {
+			r.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.emitted && rec.Timestamp < r.lastEmitted {
+			return nil, fmt.Errorf("record on line %d is out of order by more than order window", r.reader.line)
+		}
+		if r.seq == 0 || rec.Timestamp > r.maxSeen {
+			r.maxSeen = rec.Timestamp
+		}
+		heap.Push(&r.pending, windowItem{rec: rec, seq: r.seq})
+		r.seq++
+	}
+	if len(r.pending) == 0 {
+		return nil, io.EOF
+	}
+	item := heap.Pop(&r.pending).(windowItem)
+	r.emitted = true
+	r.lastEmitted = item.rec.Timestamp
+	return item.rec, nil
+}
+
+// orderedRecords returns reader of records from lines sorted by timestamp according to the order mode
+//
+// In sort mode records are read as they are while they are sorted, reading stops at the first out of order record,
+// see sortRest.
+func (p *Processor) orderedRecords(lines *lineReader) (recordReader, error) {
+	switch p.order {
+	case OrderSort:
+		return &orderChecker{
+			reader: lines,
+			stop: true,
+		}, nil
+	case OrderWindow:
+		return &windowReader{
+			reader: lines,
+			window: p.orderWindow,
+		}, nil
+	case OrderReject:
+		return &orderChecker{
+			reader: lines,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown order mode %s", p.order)
+}
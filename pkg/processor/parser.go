@@ -0,0 +1,400 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/record"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatSpace = "space"
+	FormatCSV = "csv"
+	FormatJSON = "json"
+	FormatLogfmt = "logfmt"
+	FormatRegex = "regex"
+)
+
+// Parser turns a line of a data file into a record
+type Parser interface {
+	Parse(line string) (*record.InternalRecord, error)
+}
+
+// headerParser is implemented by parsers which take field names from the first line of a file
+type headerParser interface {
+	Parser
+	ParseHeader(line string) error
+}
+
+// FieldMapping sets names of source fields which are mapped onto record fields
+type FieldMapping struct {
+	Timestamp string `json:"timestamp"`
+	Email     string `json:"email"`
+	SessionID string `json:"sessionId"`
+}
+
+var defaultFieldMapping = FieldMapping{
+	Timestamp: "timestamp",
+	Email:     "email",
+	SessionID: "sessionId",
+}
+
+func (m FieldMapping) withDefaults() FieldMapping {
+	if m.Timestamp == "" {
+		m.Timestamp = defaultFieldMapping.Timestamp
+	}
+	if m.Email == "" {
+		m.Email = defaultFieldMapping.Email
+	}
+	if m.SessionID == "" {
+		m.SessionID = defaultFieldMapping.SessionID
+	}
+	return m
+}
+
+// parseTimestamp accepts RFC3339 time or unix seconds with optional fraction and returns unix nanoseconds
+func parseTimestamp(s string) (int64, error) {
+	ts, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return ts.UnixNano(), nil
+	}
+	if nanos, ok := parseUnixSeconds(s); ok {
+		return nanos, nil
+	}
+	return 0, err
+}
+
+// parseUnixSeconds parses decimal unix seconds without going through float, so that nanoseconds are kept exactly
+func parseUnixSeconds(s string) (int64, bool) {
+	whole, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, fraction = s[:i], s[i + 1:]
+	}
+	if len(fraction) > 9 {
+		fraction = fraction[:9]
+	}
+	seconds, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var nanos int64
+	for i := 0; i < 9; i++ {
+		nanos *= 10
+		if i < len(fraction) {
+			if fraction[i] < '0' || fraction[i] > '9' {
+				return 0, false
+			}
+			nanos += int64(fraction[i] - '0')
+		}
+	}
+	if strings.HasPrefix(whole, "-") {
+		nanos = -nanos
+	}
+	return seconds * int64(time.Second) + nanos, true
+}
+
+// recordMapper builds records from named source fields according to schema
+type recordMapper struct {
+	fields FieldMapping
+	schema *record.Schema
+}
+
+// sourceName returns name of source field which is mapped onto schema field
+func (m recordMapper) sourceName(field string) string {
+	switch field {
+	case record.FieldEmail:
+		return m.fields.Email
+	case record.FieldSessionID:
+		return m.fields.SessionID
+	}
+	return field
+}
+
+// parseValue converts source value to the type of schema field
+func parseValue(t record.FieldType, s string) (interface{}, error) {
+	switch t {
+	case record.TypeInt:
+		return strconv.ParseInt(s, 10, 64)
+	case record.TypeFloat:
+		return strconv.ParseFloat(s, 64)
+	case record.TypeBool:
+		return strconv.ParseBool(s)
+	case record.TypeTimestamp:
+		return parseTimestamp(s)
+	}
+	return s, nil
+}
+
+// mapFields builds a record from named source fields
+func (m recordMapper) mapFields(get func(name string) (string, bool)) (*record.InternalRecord, error) {
+	tsValue, found := get(m.fields.Timestamp)
+	if !found {
+		return nil, fmt.Errorf("field %s is missing", m.fields.Timestamp)
+	}
+	ts, err := parseTimestamp(tsValue)
+	if err != nil {
+		return nil, err
+	}
+	r := &record.InternalRecord{
+		Timestamp: ts,
+	}
+	for _, field := range m.schema.Fields {
+		name := m.sourceName(field.Name)
+		v, found := get(name)
+		if !found {
+			if field.Required {
+				return nil, fmt.Errorf("field %s is missing", name)
+			}
+			continue
+		}
+		switch field.Name {
+		case record.FieldEmail:
+			r.Email = v
+		case record.FieldSessionID:
+			r.SessionID = v
+		default:
+			value, err := parseValue(field.Type, v)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", name, err)
+			}
+			if r.Attrs == nil {
+				r.Attrs = make(map[string]interface{}, len(m.schema.Fields))
+			}
+			r.Attrs[field.Name] = value
+		}
+	}
+	return r, nil
+}
+
+// spaceParser parses the default "RFC3339 email sessionId" format
+type spaceParser struct{}
+
+func (spaceParser) Parse(line string) (*record.InternalRecord, error) {
+	return recordFromString(line)
+}
+
+type csvParser struct {
+	mapper recordMapper
+	delimiter rune
+	columns map[string]int
+}
+
+func (p *csvParser) split(line string) ([]string, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = p.delimiter
+	reader.FieldsPerRecord = -1
+	return reader.Read()
+}
+
+func (p *csvParser) ParseHeader(line string) error {
+	names, err := p.split(line)
+	if err != nil {
+		return fmt.Errorf("error parsing csv header: %v", err)
+	}
+	p.columns = make(map[string]int, len(names))
+	for i, name := range names {
+		p.columns[strings.TrimSpace(name)] = i
+	}
+	return nil
+}
+
+func (p *csvParser) Parse(line string) (*record.InternalRecord, error) {
+	values, err := p.split(line)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	r, err := p.mapper.mapFields(func(name string) (string, bool) {
+		i, found := p.columns[name]
+		if !found || i >= len(values) {
+			return "", false
+		}
+		return values[i], true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	return r, nil
+}
+
+type jsonParser struct {
+	mapper recordMapper
+}
+
+func (p *jsonParser) Parse(line string) (*record.InternalRecord, error) {
+	values := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	r, err := p.mapper.mapFields(func(name string) (string, bool) {
+		switch v := values[name].(type) {
+		case string:
+			return v, true
+		case json.Number:
+			return v.String(), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+		return "", false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	return r, nil
+}
+
+type logfmtParser struct {
+	mapper recordMapper
+}
+
+// splitLogfmt parses key=value pairs, values could be double quoted, bare keys get empty values
+func splitLogfmt(line string) (map[string]string, error) {
+	values := map[string]string{}
+	i := 0
+	for i < len(line) {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' {
+			i++
+		}
+		key := line[start:i]
+		if i >= len(line) || line[i] == ' ' {
+			if key != "" {
+				values[key] = ""
+			}
+			continue
+		}
+		i++
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted value of %s", key)
+			}
+			value, err := strconv.Unquote(line[i:end + 1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value of %s: %v", key, err)
+			}
+			values[key] = value
+			i = end + 1
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] != ' ' {
+			i++
+		}
+		values[key] = line[start:i]
+	}
+	return values, nil
+}
+
+func (p *logfmtParser) Parse(line string) (*record.InternalRecord, error) {
+	values, err := splitLogfmt(line)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	r, err := p.mapper.mapFields(func(name string) (string, bool) {
+		v, found := values[name]
+		return v, found
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	return r, nil
+}
+
+// regexParser maps named groups of a regular expression onto record fields
+type regexParser struct {
+	mapper recordMapper
+	re *regexp.Regexp
+}
+
+func (p *regexParser) Parse(line string) (*record.InternalRecord, error) {
+	match := p.re.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("error parsing record %s: pattern does not match", line)
+	}
+	r, err := p.mapper.mapFields(func(name string) (string, bool) {
+		i := p.re.SubexpIndex(name)
+		if i < 0 {
+			return "", false
+		}
+		return match[i], true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record %s: %v", line, err)
+	}
+	return r, nil
+}
+
+// newParserFactory validates dataset format and returns a function creating parsers for it,
+// a new parser is needed for every file as parsers could keep state such as csv header
+func newParserFactory(cfg DatasetConfig) (func() Parser, error) {
+	mapper := recordMapper{
+		fields: cfg.Fields.withDefaults(),
+		schema: record.DefaultSchema,
+	}
+	if cfg.Schema != nil {
+		if err := cfg.Schema.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid schema: %v", err)
+		}
+		mapper.schema = cfg.Schema
+	}
+	switch cfg.Format {
+	case "", FormatSpace:
+		if cfg.Schema != nil {
+			return nil, fmt.Errorf("schema is not supported by %s format", FormatSpace)
+		}
+		return func() Parser {
+			return spaceParser{}
+		}, nil
+	case FormatCSV:
+		delimiter := ','
+		if cfg.Delimiter != "" {
+			runes := []rune(cfg.Delimiter)
+			if len(runes) != 1 {
+				return nil, fmt.Errorf("csv delimiter should be a single character")
+			}
+			delimiter = runes[0]
+		}
+		return func() Parser {
+			return &csvParser{
+				mapper: mapper,
+				delimiter: delimiter,
+			}
+		}, nil
+	case FormatJSON:
+		return func() Parser {
+			return &jsonParser{mapper: mapper}
+		}, nil
+	case FormatLogfmt:
+		return func() Parser {
+			return &logfmtParser{mapper: mapper}
+		}, nil
+	case FormatRegex:
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling pattern: %v", err)
+		}
+		return func() Parser {
+			return &regexParser{
+				mapper: mapper,
+				re: re,
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %s", cfg.Format)
+}
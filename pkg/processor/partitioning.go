@@ -0,0 +1,261 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"io"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// recordOverhead approximates msgpack encoding of record field names and timestamp
+const recordOverhead = 48
+
+// PartitioningConfig sets how records of a dataset are split into partitions
+type PartitioningConfig struct {
+	// Strategy is one of count, time or size, count is used by default
+	Strategy partition.Strategy `json:"strategy"`
+	// Records is a number of records per partition for count strategy, processor partition size by default
+	Records int `json:"records"`
+	// Window is a duration of time windows such as 1h or 24h for time strategy,
+	// it should divide a day or be a multiple of a day so that windows are aligned to UTC boundaries
+	Window string `json:"window"`
+	// Size is a target size of partition data in bytes for size strategy
+	Size int64 `json:"size"`
+}
+
+// partitioning tells where partitions of a dataset end
+type partitioning struct {
+	strategy partition.Strategy
+	records int
+	// window is measured in nanoseconds as timestamps are
+	window int64
+	size int64
+}
+
+func newPartitioning(cfg *PartitioningConfig, partitionSize int) (partitioning, error) {
+	p := partitioning{
+		strategy: partition.StrategyCount,
+		records: partitionSize,
+	}
+	if cfg == nil {
+		return p, nil
+	}
+	switch cfg.Strategy {
+	case "", partition.StrategyCount:
+		if cfg.Records < 0 {
+			return p, fmt.Errorf("number of records should be positive")
+		}
+		if cfg.Records > 0 {
+			p.records = cfg.Records
+		}
+	case partition.StrategyTime:
+		window, err := time.ParseDuration(cfg.Window)
+		if err != nil {
+			return p, fmt.Errorf("error parsing window: %v", err)
+		}
+		if window <= 0 || (day % window != 0 && window % day != 0) {
+			return p, fmt.Errorf("window %s should divide a day or be a multiple of a day", cfg.Window)
+		}
+		p.strategy = partition.StrategyTime
+		p.window = int64(window)
+	case partition.StrategySize:
+		if cfg.Size <= 0 {
+			return p, fmt.Errorf("target size should be positive")
+		}
+		p.strategy = partition.StrategySize
+		p.size = cfg.Size
+	default:
+		return p, fmt.Errorf("unknown partitioning strategy %s", cfg.Strategy)
+	}
+	return p, nil
+}
+
+// windowStart returns start of the time window containing timestamp ts
+func (p partitioning) windowStart(ts int64) int64 {
+	start := ts - ts % p.window
+	if ts % p.window < 0 {
+		start -= p.window
+	}
+	return start
+}
+
+// setMeta records strategy and window bounds of partition records in meta
+func (p partitioning) setMeta(meta *partition.Meta) {
+	meta.Strategy = p.strategy
+	if p.strategy == partition.StrategyTime {
+		meta.WindowStart = p.windowStart(meta.MinTimestamp)
+		meta.WindowEnd = meta.WindowStart + p.window
+	}
+}
+
+// capacity is a number of records partition is expected to hold, it is only a hint
+func (p partitioning) capacity() int {
+	if p.strategy == partition.StrategyCount {
+		return p.records
+	}
+	return 0
+}
+
+// cutter is fed records of a dataset in timestamp order and tells where partitions end
+type cutter interface {
+	// add reports whether r does not belong to the partition being built, the next partition starts with r then
+	add(r *record.InternalRecord) bool
+	// full reports whether the partition being built could not take any more records
+	full() bool
+	// reset starts the next partition once the full one is cut
+	reset()
+}
+
+func (p partitioning) newCutter() cutter {
+	switch p.strategy {
+	case partition.StrategyTime:
+		return &timeCutter{p: p}
+	case partition.StrategySize:
+		return &sizeCutter{target: p.size}
+	}
+	return &countCutter{limit: p.records}
+}
+
+type countCutter struct {
+	limit int
+	count int
+}
+
+func (c *countCutter) add(*record.InternalRecord) bool {
+	c.count++
+	return false
+}
+
+func (c *countCutter) full() bool {
+	return c.count >= c.limit
+}
+
+func (c *countCutter) reset() {
+	c.count = 0
+}
+
+type timeCutter struct {
+	p partitioning
+	window int64
+	started bool
+}
+
+func (c *timeCutter) add(r *record.InternalRecord) bool {
+	window := c.p.windowStart(r.Timestamp)
+	cut := c.started && window != c.window
+	c.window = window
+	c.started = true
+	return cut
+}
+
+func (c *timeCutter) full() bool {
+	return false
+}
+
+func (c *timeCutter) reset() {
+	c.started = false
+}
+
+type sizeCutter struct {
+	target int64
+	size int64
+}
+
+func (c *sizeCutter) add(r *record.InternalRecord) bool {
+	size := estimateSize(r)
+	if c.size > 0 && c.size + size > c.target {
+		c.size = size
+		return true
+	}
+	c.size += size
+	return false
+}
+
+func (c *sizeCutter) full() bool {
+	return c.size >= c.target
+}
+
+func (c *sizeCutter) reset() {
+	c.size = 0
+}
+
+// estimateSize approximates size of encoded record without encoding it
+func estimateSize(r *record.InternalRecord) int64 {
+	size := int64(recordOverhead + len(r.Email) + len(r.SessionID))
+	for name, v := range r.Attrs {
+		size += int64(len(name)) + 2
+		if s, ok := v.(string); ok {
+			size += int64(len(s)) + 2
+		} else {
+			size += 9
+		}
+	}
+	return size
+}
+
+// chunker reads records and cuts them into chunks making partitions
+type chunker struct {
+	reader recordReader
+	cut cutter
+	capacity int
+	// next is a record read ahead which starts the next chunk
+	next *record.InternalRecord
+}
+
+func (p *Processor) newChunker(reader recordReader) *chunker {
+	return &chunker{
+		reader: reader,
+		cut: p.partitioning.newCutter(),
+		capacity: p.partitioning.capacity(),
+	}
+}
+
+// scan returns records of the next partition, empty slice is returned once reader is exhausted
+func (c *chunker) scan() ([]*record.InternalRecord, error) {
+	records := make([]*record.InternalRecord, 0, c.capacity)
+	if c.next != nil {
+		records = append(records, c.next)
+		c.next = nil
+	}
+	for !c.cut.full() {
+		r, err := c.reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c.cut.add(r) {
+			c.next = r
+			return records, nil
+		}
+		records = append(records, r)
+	}
+	c.cut.reset()
+	return records, nil
+}
+
+// split cuts records sorted by timestamp into partitions
+func (p partitioning) split(records []*record.InternalRecord) [][]*record.InternalRecord {
+	chunks := make([][]*record.InternalRecord, 0)
+	cut := p.newCutter()
+	start := 0
+	for i, r := range records {
+		if cut.add(r) {
+			chunks = append(chunks, records[start:i])
+			start = i
+		}
+		if cut.full() {
+			chunks = append(chunks, records[start:i + 1])
+			start = i + 1
+			cut.reset()
+		}
+	}
+	if start < len(records) {
+		chunks = append(chunks, records[start:])
+	}
+	return chunks
+}
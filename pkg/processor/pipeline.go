@@ -0,0 +1,301 @@
+package processor
+
+import (
+	"context"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"golang.org/x/sync/errgroup"
+	"log"
+	"os"
+	"sync"
+)
+
+// parseBatchSize is a number of lines handed to a parser worker at once
+const parseBatchSize = 1024
+
+type parsedLine struct {
+	record *record.InternalRecord
+	err error
+	line int64
+	text string
+}
+
+// lineBatch is a run of consecutive lines, parsed lines are delivered to parsed once a worker is done with them
+type lineBatch struct {
+	first int64
+	lines []string
+	parsed chan []parsedLine
+	err error
+}
+
+// startParsing makes lineReader parse lines with workers, batches are queued in input order so that
+// records are returned in the same order as they are when parsed serially
+//
+// Lines are read by a goroutine of its own until close stops it, so that the input is not read after close returns.
+func (r *lineReader) startParsing(workers int) {
+	batches := make(chan *lineBatch, workers)
+	ordered := make(chan *lineBatch, workers)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	r.ordered = ordered
+	r.stop = stop
+	r.stopped = stopped
+
+	send := func(batch *lineBatch) bool {
+		select {
+		case ordered <- batch:
+		case <-stop:
+			return false
+		}
+		if batch.err != nil {
+			return true
+		}
+		select {
+		case batches <- batch:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	go func() {
+		defer close(stopped)
+		defer close(ordered)
+		defer close(batches)
+		var header string
+		_, needHeader := r.parser.(headerParser)
+		var line int64
+		if needHeader && r.scanner.Scan() {
+			line++
+			header = r.scanner.Text()
+			if err := r.parser.(headerParser).ParseHeader(header); err != nil {
+				send(&lineBatch{err: err})
+				return
+			}
+		}
+		for i := 0; i < workers; i++ {
+			go func() {
+				parser := r.newParser()
+				if needHeader {
+					// header is valid as it is parsed successfully above
+					_ = parser.(headerParser).ParseHeader(header)
+				}
+				for batch := range batches {
+					batch.parsed <- parseBatch(parser, batch)
+				}
+			}()
+		}
+
+		batch := &lineBatch{first: line + 1}
+		for r.scanner.Scan() {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			line++
+			batch.lines = append(batch.lines, r.scanner.Text())
+			if len(batch.lines) == parseBatchSize {
+				batch.parsed = make(chan []parsedLine, 1)
+				if !send(batch) {
+					return
+				}
+				batch = &lineBatch{first: line + 1}
+			}
+		}
+		if len(batch.lines) > 0 {
+			batch.parsed = make(chan []parsedLine, 1)
+			if !send(batch) {
+				return
+			}
+		}
+		if err := r.scanner.Err(); err != nil {
+			send(&lineBatch{err: err})
+		}
+	}()
+}
+
+func parseBatch(parser Parser, batch *lineBatch) []parsedLine {
+	parsed := make([]parsedLine, 0, len(batch.lines))
+	for i, text := range batch.lines {
+		if text == "" {
+			continue
+		}
+		rec, err := parser.Parse(text)
+		parsed = append(parsed, parsedLine{
+			record: rec,
+			err: err,
+			line: batch.first + int64(i),
+			text: text,
+		})
+	}
+	return parsed
+}
+
+// readParsed returns the next record parsed by workers
+func (r *lineReader) readParsed() (*record.InternalRecord, bool, error) {
+	for {
+		if len(r.parsed) > 0 {
+			pl := r.parsed[0]
+			r.parsed = r.parsed[1:]
+			r.line = pl.line
+			if pl.err != nil {
+				if err := r.rejectLine(pl.text, pl.err); err != nil {
+					return nil, false, err
+				}
+				continue
+			}
+			r.stats.Accepted++
+			return pl.record, true, nil
+		}
+		var batch *lineBatch
+		var ok bool
+		select {
+		case batch, ok = <-r.ordered:
+		case <-r.ctx.Done():
+			return nil, false, r.ctx.Err()
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		if batch.err != nil {
+			return nil, false, batch.err
+		}
+		select {
+		case r.parsed = <-batch.parsed:
+		case <-r.ctx.Done():
+			return nil, false, r.ctx.Err()
+		}
+	}
+}
+
+// close stops parser workers and waits until lines are no longer read from the input,
+// it is safe to call on readers which parse lines serially
+func (r *lineReader) close() {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.stopped
+		r.stop = nil
+	}
+}
+
+// chunk is a run of records which makes a partition with the index
+type chunk struct {
+	index int
+	records []*record.InternalRecord
+	partition partition.Partition
+}
+
+// removeWritten closes partition and removes its files
+func removeWritten(part partition.Partition) {
+	part.Close()
+	removeFiles(part.DataPath(), part.MetaPath(), part.IndexPath())
+}
+
+// removeFiles removes partition files, empty paths stand for files which are not written
+func removeFiles(paths ...string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing partition file %s: %v", path, err)
+		}
+	}
+}
+
+// buildPartitions splits records into chunks according to the partitioning strategy which are written and set up by workers,
+// partitions are published in order of their indexes
+//
+// At most twice as many chunks as there are workers are in flight, so that a slow chunk does not make
+// the following ones pile up in memory. Partitions written but not published are removed on failure.
+func (p *Processor) buildPartitions(ctx context.Context, reader recordReader, prefix string,
+	publish func(partition.Partition)) error {
+
+	g, ctx := errgroup.WithContext(ctx)
+	jobs := make(chan chunk, p.workers)
+	written := make(chan chunk, p.workers)
+	inFlight := make(chan struct{}, 2 * p.workers)
+	chunks := p.newChunker(reader)
+
+	g.Go(func() error {
+		defer close(jobs)
+		for index := 0; ; index++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			records, err := chunks.scan()
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				return nil
+			}
+			select {
+			case jobs <- chunk{index: index, records: records}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	var writers sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		writers.Add(1)
+		g.Go(func() error {
+			defer writers.Done()
+			for job := range jobs {
+				part, err := p.writePartition(ctx, p.partitionDirPath, prefix, job.index, job.records)
+				if err != nil {
+					return err
+				}
+				if err := part.Setup(); err != nil {
+					removeWritten(part)
+					return err
+				}
+				job.partition = part
+				written <- job
+			}
+			return nil
+		})
+	}
+	go func() {
+		writers.Wait()
+		close(written)
+	}()
+
+	pending := map[int]partition.Partition{}
+	var next int
+	for job := range written {
+		pending[job.index] = job.partition
+		if ctx.Err() != nil {
+			continue
+		}
+		for {
+			ready, found := pending[next]
+			if !found {
+				break
+			}
+			delete(pending, next)
+			publish(ready)
+			next++
+			<-inFlight
+		}
+	}
+	err := g.Wait()
+	if err == nil && len(pending) > 0 {
+		// publishing stopped as ctx is done
+		err = ctx.Err()
+	}
+	if err != nil {
+		for _, part := range pending {
+			removeWritten(part)
+		}
+	}
+	return err
+}
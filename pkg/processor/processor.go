@@ -2,13 +2,14 @@ package processor
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/ssfilatov/ts/pkg/partition"
 	"github.com/ssfilatov/ts/pkg/record"
 	"github.com/ugorji/go/codec"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -18,18 +19,128 @@ var (
 	msgpackHandler codec.MsgpackHandle
 )
 
+func init() {
+	// sorted runs keep schema attrs which are decoded into interfaces
+	msgpackHandler.RawToString = true
+}
+
+// OrderMode sets how records which are out of timestamp order are handled
+type OrderMode string
+
+const (
+	// OrderReject fails processing on the first out of order record
+	OrderReject OrderMode = "reject"
+	// OrderSort sorts unsorted input with external merge sort
+	OrderSort OrderMode = "sort"
+	// OrderWindow reorders records which are late by no more than order window and fails on the rest
+	OrderWindow OrderMode = "window"
+)
+
+const defaultSortRunSize = 1 << 18
+
+func ParseOrderMode(s string) (OrderMode, error) {
+	switch mode := OrderMode(s); mode {
+	case OrderReject, OrderSort, OrderWindow:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown order mode %s", s)
+}
+
+// Options configure processor, only partition size and dir are required
+type Options struct {
+	PartitionSize int
+	PartitionDirPath string
+	// Order defaults to OrderSort, so that unsorted files are ingested as they were before order modes were added
+	Order OrderMode
+	OrderWindow time.Duration
+	// SortRunSize limits number of records kept in memory by external sort
+	SortRunSize int
+	// MaxErrorRate fails processing of a file when share of malformed lines exceeds it, zero disables the check
+	MaxErrorRate float64
+	// Workers sets number of goroutines parsing lines and number of goroutines writing partitions
+	// of a single file, lines are parsed serially by default
+	Workers int
+	// DedupWindow enables dropping of exact duplicate records, records are checked against the ones
+	// at most DedupWindow older than the latest record read, zero disables dedup
+	DedupWindow time.Duration
+	// Format is a layout of partition data files, partition.FormatRows by default
+	Format partition.Format
+	// Compression sets how partition data is compressed, datasets could override it, data is not compressed by default
+	Compression partition.Compression
+	// FilterFPR is a false positive rate of Bloom filters over emails and session ids stored in partition meta,
+	// zero disables filters
+	FilterFPR float64
+	// Index makes processor write an index file of each partition, which maps emails and session ids
+	// to positions of their records, so that records are looked up without scanning partitions
+	Index bool
+}
+
 type Processor struct {
 	partitionSize int
 	partitionDirPath string
+	order OrderMode
+	// orderWindow is measured in nanoseconds as timestamps are
+	orderWindow int64
+	sortRunSize int
+	maxErrorRate float64
+	workers int
+	partitioning partitioning
+	// dedupWindow is measured in nanoseconds, zero disables dedup
+	dedupWindow int64
+	dedupSeed []*record.InternalRecord
+	format partition.Format
+	compression partition.Compression
+	filterFPR float64
+	index bool
+	newParser func() Parser
+	// schema is written to partition meta, nil stands for the default schema
+	schema *record.Schema
 
 	count int
 }
 
 func NewProcessor(partitionSize int, partitionDirPath string) *Processor {
-	return &Processor{
-		partitionSize: partitionSize,
-		partitionDirPath: partitionDirPath,
+	return NewProcessorWithOptions(Options{
+		PartitionSize: partitionSize,
+		PartitionDirPath: partitionDirPath,
+	})
+}
+
+func NewProcessorWithOptions(opts Options) *Processor {
+	p := &Processor{
+		partitionSize: opts.PartitionSize,
+		partitionDirPath: opts.PartitionDirPath,
+		order: opts.Order,
+		orderWindow: int64(opts.OrderWindow),
+		sortRunSize: opts.SortRunSize,
+		maxErrorRate: opts.MaxErrorRate,
+		workers: opts.Workers,
+		dedupWindow: int64(opts.DedupWindow),
+		format: opts.Format,
+		compression: opts.Compression,
+		filterFPR: opts.FilterFPR,
+		index: opts.Index,
+		partitioning: partitioning{
+			strategy: partition.StrategyCount,
+			records: opts.PartitionSize,
+		},
+		newParser: func() Parser {
+			return spaceParser{}
+		},
+	}
+	if p.order == "" {
+		p.order = OrderSort
+	}
+	if p.sortRunSize <= 0 {
+		p.sortRunSize = defaultSortRunSize
+	}
+	if p.workers <= 0 {
+		p.workers = 1
+	}
+	if p.format == 0 {
+		p.format = partition.FormatRows
 	}
+	return p
 }
 
 func recordFromString(s string) (*record.InternalRecord, error) {
@@ -37,25 +148,98 @@ func recordFromString(s string) (*record.InternalRecord, error) {
 	if len(tokens) != 3 {
 		return nil, fmt.Errorf("error parsing record %s", s)
 	}
-	ts, err := time.Parse(time.RFC3339, tokens[0])
+	ts, err := time.Parse(time.RFC3339Nano, tokens[0])
 	if err != nil {
 		return nil, fmt.Errorf("error parsing record %s", err)
 	}
 	return &record.InternalRecord{
-		Timestamp: ts.Unix(),
+		Timestamp: ts.UnixNano(),
 		Email: tokens[1],
 		SessionID: tokens[2],
 	}, nil
 }
 
-func (p *Processor) encodeToFile(path string, v interface{}) error {
-	metaFile, err := os.Create(path)
-	defer metaFile.Close()
+// ParseRecords reads records line by line, unlike file processing any malformed line fails the whole reader
+func ParseRecords(r io.Reader) ([]*record.InternalRecord, error) {
+	scanner := bufio.NewScanner(r)
+	records := make([]*record.InternalRecord, 0)
+	var line int
+	for scanner.Scan() {
+		line++
+		if scanner.Text() == "" {
+			continue
+		}
+		rec, err := recordFromString(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return records, nil
+}
+
+// atomicFile is written next to path under a temporary name and replaces path once it is committed,
+// so that a crash never leaves a partially written file at path
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	file, err := os.Create(path + partition.TempSuffix)
 	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{
+		File: file,
+		path: path,
+	}, nil
+}
+
+// commit syncs the file, renames it to path and syncs the dir so that the rename is durable as well
+func (f *atomicFile) commit() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
 		return err
 	}
-	metaEncoder := codec.NewEncoder(metaFile, &msgpackHandler)
-	return metaEncoder.Encode(v)
+	return syncDir(filepath.Dir(f.path))
+}
+
+// abort removes the temporary file, it does nothing once the file is committed
+func (f *atomicFile) abort() {
+	f.Close()
+	removeFiles(f.Name())
+}
+
+// syncDir makes renames and new files in dir durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// writeFile atomically writes data to path
+func writeFile(path string, data []byte) error {
+	file, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.commit()
 }
 
 func buildDataFilePath(origFilename, dir string, idx int) string {
@@ -66,81 +250,234 @@ func buildMetaFilePath(origFilename, dir string, idx int) string {
 	return fmt.Sprintf("%s/%s-%s-%s", dir, origFilename, partition.MetaFileName, strconv.Itoa(idx))
 }
 
-func (p *Processor) scanChunk(scanner *bufio.Scanner) ([]*record.InternalRecord, *partition.Meta, error) {
-	records := make([]*record.InternalRecord, 0, p.partitionSize)
-	for i := 0; i < p.partitionSize; i++ {
-		if ok := scanner.Scan(); !ok {
-			break
-		}
-		r, err := recordFromString(scanner.Text())
-		if err != nil {
-			log.Print(err.Error())
-			continue
-		}
-		records = append(records, r)
+func buildIndexFilePath(origFilename, dir string, idx int) string {
+	return fmt.Sprintf("%s/%s-%s-%s", dir, origFilename, partition.IndexFileName, strconv.Itoa(idx))
+}
+
+func buildPostingsFilePath(origFilename, dir string, idx int) string {
+	return fmt.Sprintf("%s/%s-%s-%s", dir, origFilename, partition.PostingsFileName, strconv.Itoa(idx))
+}
+
+// WritePostings merges index files of partitions or postings files of a dataset into a postings file with the index,
+// only postings of partitions which keep reports true for are written. Path of the file and data paths
+// of partitions covered by it are returned.
+func (p *Processor) WritePostings(prefix string, postingsIndex int, sources []string,
+	keep func(dataPath string) bool) (string, []string, error) {
+
+	path := buildPostingsFilePath(prefix, p.partitionDirPath, postingsIndex)
+	file, err := createAtomic(path)
+	if err != nil {
+		return "", nil, err
 	}
-	if scanner.Err() != nil {
-		return nil, nil, scanner.Err()
+	defer file.abort()
+	covered, err := partition.MergeIndexes(file, sources, keep)
+	if err != nil {
+		return "", nil, err
 	}
-	if len(records) == 0 {
-		return nil, nil, nil
+	if err := file.commit(); err != nil {
+		return "", nil, err
 	}
-	return records, &partition.Meta{
+	return path, covered, nil
+}
+
+func (p *Processor) newMeta(records []*record.InternalRecord) *partition.Meta {
+	meta := &partition.Meta{
 		MinTimestamp: records[0].Timestamp,
 		MaxTimestamp: records[len(records) - 1].Timestamp,
 		Size: len(records),
-	}, nil
+		Schema: p.schema,
+		Precision: time.Nanosecond,
+		Format: p.format,
+	}
+	p.partitioning.setMeta(meta)
+	if p.filterFPR > 0 {
+		emails := make([]string, len(records))
+		sessions := make([]string, len(records))
+		for i, r := range records {
+			emails[i] = r.Email
+			sessions[i] = r.SessionID
+		}
+		meta.EmailFilter = partition.NewBloom(emails, p.filterFPR)
+		meta.SessionFilter = partition.NewBloom(sessions, p.filterFPR)
+	}
+	return meta
 }
 
-func (p *Processor) processPartition(dir, origFilename string, partitionIndex int,
-	scanner *bufio.Scanner) (partition.Partition, error) {
+// writePartition encodes records, their index and meta to disk, records should be sorted by timestamp
+//
+// Meta is written once data and index are durable, so a partition with meta on disk is complete.
+// Nothing is written once ctx is done, files written partially are removed.
+func (p *Processor) writePartition(ctx context.Context, dir, origFilename string, partitionIndex int,
+	records []*record.InternalRecord) (partition.Partition, error) {
 
-	records, meta, err := p.scanChunk(scanner)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dataPath := buildDataFilePath(origFilename, dir, partitionIndex)
+	metaPath := buildMetaFilePath(origFilename, dir, partitionIndex)
+	var indexPath string
+	if p.index {
+		indexPath = buildIndexFilePath(origFilename, dir, partitionIndex)
+	}
+	meta := p.newMeta(records)
+	data, err := partition.EncodeData(meta, p.compression, records)
 	if err != nil {
 		return nil, err
 	}
-	if scanner.Err() != nil {
-		return nil, scanner.Err()
+	if err := writeFile(dataPath, data); err != nil {
+		removeFiles(dataPath)
+		return nil, err
 	}
-	if len(records) == 0 {
-		return nil, nil
+	if p.index {
+		index, err := partition.EncodeIndex(dataPath, records)
+		if err != nil {
+			removeFiles(dataPath)
+			return nil, err
+		}
+		if err := writeFile(indexPath, index); err != nil {
+			removeFiles(dataPath, indexPath)
+			return nil, err
+		}
 	}
-
-	dataPath := buildDataFilePath(origFilename, dir, partitionIndex)
-	if err := p.encodeToFile(dataPath, records); err != nil {
+	encodedMeta, err := partition.EncodeMeta(meta)
+	if err != nil {
+		removeFiles(dataPath, indexPath)
 		return nil, err
 	}
-
-	metaPath := buildMetaFilePath(origFilename, dir, partitionIndex)
-	if err := p.encodeToFile(metaPath, meta); err != nil {
+	if err := writeFile(metaPath, encodedMeta); err != nil {
+		removeFiles(dataPath, indexPath, metaPath)
 		return nil, err
 	}
 
-	return partition.NewPartition(dataPath, metaPath), nil
+	return partition.NewIndexedPartition(dataPath, metaPath, indexPath), nil
 }
 
-// ProcessRecords splits incoming lines from reader into multiple partition records and writes them to disk
+// WriteRecords splits records sorted by timestamp into partitions according to the partitioning strategy
+// and writes them to disk, partition indexes start with startIndex
 //
-// Partition records are encoded to json and written to disk. This method returns slice of partition objects which
-// are mmaped to data files on disk.
-// prefix arg will be used as a partition file prefix
-func (p *Processor) ProcessRecords(r io.Reader, prefix string) ([]partition.Partition, error) {
-	scanner := bufio.NewScanner(r)
-	var partitionIndex int
-	partitionList := make([]partition.Partition, 0)
-	for {
-		part, err := p.processPartition(p.partitionDirPath, prefix, partitionIndex, scanner)
-		if err != nil {
-			return nil, err
+// Partitions written so far are removed on failure, including cancellation of ctx.
+func (p *Processor) WriteRecords(ctx context.Context, records []*record.InternalRecord, prefix string,
+	startIndex int) ([]partition.Partition, error) {
+
+	chunks := p.partitioning.split(records)
+	partitionList := make([]partition.Partition, 0, len(chunks))
+	fail := func(err error) ([]partition.Partition, error) {
+		for _, part := range partitionList {
+			removeWritten(part)
 		}
-		if part == nil {
-			break
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		part, err := p.writePartition(ctx, p.partitionDirPath, prefix, startIndex + len(partitionList), chunk)
+		if err != nil {
+			return fail(err)
 		}
+		partitionList = append(partitionList, part)
 		if err := part.Setup(); err != nil {
-			return nil, err
+			return fail(err)
 		}
+	}
+	return partitionList, nil
+}
+
+// ProcessRecords splits incoming lines from reader into multiple partition records and writes them to disk
+//
+// Partition records are encoded in the processor format and written to disk. This method returns slice of partition
+// objects which are mmaped to data files on disk, partitions written before an error are closed and removed.
+// prefix arg will be used as a partition file prefix
+func (p *Processor) ProcessRecords(ctx context.Context, r io.Reader, prefix string) ([]partition.Partition, error) {
+	partitionList := make([]partition.Partition, 0)
+	_, err := p.ProcessRecordsFunc(ctx, r, prefix, nil, func(part partition.Partition) {
 		partitionList = append(partitionList, part)
-		partitionIndex++
+	}, func([]partition.Partition) {
+		partitionList = partitionList[:0]
+	})
+	if err != nil {
+		for _, part := range partitionList {
+			removeWritten(part)
+		}
+		return nil, err
 	}
 	return partitionList, nil
 }
+
+// ProcessRecordsFunc works like ProcessRecords but hands each partition to publish as soon as it is set up,
+// so that partitions can be queried before the whole reader is processed
+//
+// Lines are parsed and partitions are written by processor workers, partitions are published in order.
+// Records out of timestamp order are handled according to the processor order mode. In sort mode partitions
+// are published while records are sorted, once an out of order record is found partitions published so far
+// are handed to withdraw if it is not nil and are closed and removed, sorted records are published from scratch.
+// Malformed lines are passed to reject if it is not nil, exact duplicates are dropped if dedup is enabled,
+// counts of accepted, rejected and duplicate lines are returned.
+// Once ctx is done processing stops with ctx error, partitions which are written but not published are removed.
+func (p *Processor) ProcessRecordsFunc(ctx context.Context, r io.Reader, prefix string, reject RejectFunc,
+	publish func(partition.Partition), withdraw func([]partition.Partition)) (LineStats, error) {
+
+	lines := p.newLineReader(ctx, r, reject)
+	defer lines.close()
+	reader, err := p.orderedRecords(lines)
+	if err != nil {
+		return lines.stats, err
+	}
+	published := make([]partition.Partition, 0)
+	dropped, err := p.buildDeduped(ctx, reader, prefix, func(part partition.Partition) {
+		published = append(published, part)
+		publish(part)
+	})
+	if checker, ok := reader.(*orderChecker); ok && err == nil && checker.late != nil {
+		var resorted int64
+		resorted, err = p.sortRest(ctx, checker, published, prefix, publish, withdraw)
+		dropped += resorted
+	}
+	stats := lines.stats
+	stats.Duplicates = dropped
+	stats.Accepted -= dropped
+	return stats, err
+}
+
+// buildDeduped builds partitions of sorted records dropping exact duplicates if dedup is enabled,
+// number of dropped records is returned
+func (p *Processor) buildDeduped(ctx context.Context, reader recordReader, prefix string,
+	publish func(partition.Partition)) (int64, error) {
+
+	dedup := p.newDeduper()
+	if dedup != nil {
+		reader = &dedupReader{
+			reader: reader,
+			dedup: dedup,
+		}
+	}
+	err := p.buildPartitions(ctx, reader, prefix, publish)
+	if dedup == nil {
+		return 0, err
+	}
+	return dedup.dropped, err
+}
+
+// sortRest sorts records of partitions published before checker stopped at an out of order record along with
+// the rest of lines and replaces the partitions with partitions of sorted records
+//
+// Published partitions are withdrawn only once all records are read, so that they stay in place if reading fails.
+func (p *Processor) sortRest(ctx context.Context, checker *orderChecker, published []partition.Partition, prefix string,
+	publish func(partition.Partition), withdraw func([]partition.Partition)) (int64, error) {
+
+	sorted, cleanup, err := p.externalSort(&concatReader{
+		readers: []recordReader{
+			&partitionsReader{partitions: published},
+			&sliceReader{records: []*record.InternalRecord{checker.late}},
+			checker.reader,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	if withdraw != nil {
+		withdraw(published)
+	}
+	for _, part := range published {
+		removeWritten(part)
+	}
+	return p.buildDeduped(ctx, sorted, prefix, publish)
+}
@@ -1,10 +1,17 @@
 package processor
 
 import (
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,7 +25,7 @@ func TestProcessRecords(t *testing.T) {
 2001-07-08T22:21:42Z rupert.halvorson@paucekstoltenberg.uk e1f358b9-079f-4c46-8fa4-4e9dc39c844f
 2001-07-09T13:29:48Z rashawn.schmitt@bosco.com 47815165-5213-4001-8611-af20e8f1f5fc
 `)
-	partitions, err := NewProcessor(2, tmpdir).ProcessRecords(r, "sample1.txt")
+	partitions, err := NewProcessor(2, tmpdir).ProcessRecords(context.Background(), r, "sample1.txt")
 	require.NoError(t, err)
 	require.Len(t, partitions, 2)
 
@@ -26,18 +33,630 @@ func TestProcessRecords(t *testing.T) {
 	require.NoError(t, err)
 	maxTs1, err := time.Parse(time.RFC3339, "2001-07-08T22:21:42Z")
 	require.NoError(t, err)
-	require.Equal(t, minTs1.Unix(), partitions[0].MinTimestamp())
-	require.Equal(t, maxTs1.Unix(), partitions[0].MaxTimestamp())
+	require.Equal(t, minTs1.UnixNano(), partitions[0].MinTimestamp())
+	require.Equal(t, maxTs1.UnixNano(), partitions[0].MaxTimestamp())
 
 
 	minTs2, err := time.Parse(time.RFC3339, "2001-07-09T13:29:48Z")
 	require.NoError(t, err)
 	maxTs2, err := time.Parse(time.RFC3339, "2001-07-09T13:29:48Z")
 	require.NoError(t, err)
-	require.Equal(t, minTs2.Unix(), partitions[1].MinTimestamp())
-	require.Equal(t, maxTs2.Unix(), partitions[1].MaxTimestamp())
+	require.Equal(t, minTs2.UnixNano(), partitions[1].MinTimestamp())
+	require.Equal(t, maxTs2.UnixNano(), partitions[1].MaxTimestamp())
 
 	files, err := ioutil.ReadDir(tmpdir)
 	require.NoError(t, err)
 	require.Len(t, files, 4)
 }
+
+func TestFollow(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	path := tmpdir + "/live.log"
+	require.NoError(t, os.WriteFile(path, []byte(`2001-07-08T19:29:30Z dominique@schuster.com 2b457fa5-4453-475d-b9d1-f737e02ed732
+2001-07-08T22:21:42Z rupert.halvorson@paucekstoltenberg.uk e1f358b9-079f-4c46-8fa4-4e9dc39c844f
+2001-07-09T13:29:48Z rashawn.schmitt@bosco.com 47815165-5213-4001-8611-af20e8f1f5fc
+2001-07-09T13:29:49Z partial`), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var sealed []partition.Partition
+	var last FollowUpdate
+	err = NewProcessor(2, tmpdir).Follow(ctx, path, "live.log", FollowState{}, time.Millisecond, nil,
+		func(update FollowUpdate) {
+			sealed = append(sealed, update.Sealed...)
+			last = update
+			if update.CaughtUp {
+				cancel()
+			}
+		})
+	require.NoError(t, err)
+	require.Len(t, sealed, 1)
+	require.NotNil(t, last.Open)
+	require.Equal(t, last.Open.MinTimestamp(), last.Open.MaxTimestamp())
+	require.Equal(t, 1, last.State.PartitionIndex)
+	require.Equal(t, int64(177), last.State.Offset)
+	require.Equal(t, int64(2), last.State.Line)
+	require.Equal(t, LineStats{Accepted: 3}, last.Stats)
+}
+
+func TestRejects(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	input := `2001-07-08T19:29:30Z a@x.com s1
+malformed
+
+2001-07-08T19:29:40Z b@x.com s2
+2001-07-08T19:29:50Z c@x.com
+`
+	var rejects []Reject
+	reject := func(r Reject) error {
+		rejects = append(rejects, r)
+		return nil
+	}
+	stats, err := NewProcessor(10, tmpdir).ProcessRecordsFunc(context.Background(), strings.NewReader(input), "rejects", reject,
+		func(partition.Partition) {}, nil)
+	require.NoError(t, err)
+	require.Equal(t, LineStats{Accepted: 2, Rejected: 2}, stats)
+	require.Len(t, rejects, 2)
+	require.Equal(t, int64(2), rejects[0].Line)
+	require.Equal(t, "malformed", rejects[0].Text)
+	require.Equal(t, int64(5), rejects[1].Line)
+
+	p := NewProcessorWithOptions(Options{PartitionSize: 10, PartitionDirPath: tmpdir, MaxErrorRate: 0.4})
+	_, err = p.ProcessRecordsFunc(context.Background(), strings.NewReader(input), "threshold", nil, func(partition.Partition) {}, nil)
+	require.Error(t, err)
+}
+
+func TestProcessRecordsOrder(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	input := `2001-07-08T19:29:30Z a@x.com s1
+2001-07-08T19:29:10Z b@x.com s2
+2001-07-08T19:29:50Z c@x.com s3
+2001-07-08T19:29:20Z d@x.com s4
+2001-07-08T19:29:40Z e@x.com s5
+`
+	sessions := func(partitions []partition.Partition) []string {
+		var result []string
+		for _, part := range partitions {
+			records, err := part.SelectRecords(part.MinTimestamp(), part.MaxTimestamp())
+			require.NoError(t, err)
+			for _, r := range records {
+				result = append(result, r.SessionID)
+			}
+		}
+		return result
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		_, err := NewProcessorWithOptions(Options{
+			PartitionSize: 2,
+			PartitionDirPath: tmpdir,
+			Order: OrderReject,
+		}).ProcessRecords(context.Background(), strings.NewReader(input), "reject")
+		require.Error(t, err)
+	})
+
+	t.Run("Sort", func(t *testing.T) {
+		p := NewProcessorWithOptions(Options{
+			PartitionSize: 2,
+			PartitionDirPath: tmpdir,
+			Order: OrderSort,
+			SortRunSize: 2,
+		})
+		partitions, err := p.ProcessRecords(context.Background(), strings.NewReader(input), "sort")
+		require.NoError(t, err)
+		require.Equal(t, []string{"s2", "s4", "s1", "s5", "s3"}, sessions(partitions))
+
+		// partitions published while records are sorted are withdrawn once a late record is found
+		late := `2001-07-08T19:29:10Z a@x.com s1
+2001-07-08T19:29:20Z b@x.com s2
+2001-07-08T19:29:30Z c@x.com s3
+2001-07-08T19:29:40Z d@x.com s4
+2001-07-08T19:29:50Z e@x.com s5
+2001-07-08T19:29:15Z f@x.com s6
+2001-07-08T19:29:35Z g@x.com s7
+`
+		var published, withdrawn []partition.Partition
+		stats, err := p.ProcessRecordsFunc(context.Background(), strings.NewReader(late), "late", nil,
+			func(part partition.Partition) {
+				published = append(published, part)
+			}, func(parts []partition.Partition) {
+				withdrawn = append(withdrawn, parts...)
+				published = nil
+			})
+		require.NoError(t, err)
+		require.Equal(t, LineStats{Accepted: 7}, stats)
+		require.Len(t, withdrawn, 3)
+		require.Equal(t, []string{"s1", "s6", "s2", "s3", "s7", "s4", "s5"}, sessions(published))
+		// sorted partitions are written in place of the withdrawn ones
+		written, err := filepath.Glob(filepath.Join(tmpdir, "late-*"))
+		require.NoError(t, err)
+		require.Len(t, written, 2 * len(published))
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		p := NewProcessorWithOptions(Options{
+			PartitionSize: 2,
+			PartitionDirPath: tmpdir,
+			Order: OrderWindow,
+			OrderWindow: 30 * time.Second,
+		})
+		partitions, err := p.ProcessRecords(context.Background(), strings.NewReader(input), "window")
+		require.NoError(t, err)
+		require.Equal(t, []string{"s2", "s4", "s1", "s5", "s3"}, sessions(partitions))
+
+		p = NewProcessorWithOptions(Options{
+			PartitionSize: 2,
+			PartitionDirPath: tmpdir,
+			Order: OrderWindow,
+			OrderWindow: 10 * time.Second,
+		})
+		_, err = p.ProcessRecords(context.Background(), strings.NewReader(input), "window-short")
+		require.Error(t, err)
+	})
+}
+
+func TestParsers(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	tests := []struct {
+		name string
+		cfg DatasetConfig
+		input string
+	}{
+		{
+			name: "csv",
+			cfg: DatasetConfig{Format: FormatCSV, Fields: FieldMapping{Timestamp: "time"}},
+			input: "time,sessionId,email\n2001-07-08T19:29:30Z,s1,a@x.com\n\"2001-07-08T19:29:40Z\",s2,b@x.com\n",
+		},
+		{
+			name: "json",
+			cfg: DatasetConfig{Format: FormatJSON},
+			input: `{"timestamp":"2001-07-08T19:29:30Z","email":"a@x.com","sessionId":"s1"}
+{"timestamp":994620580,"email":"b@x.com","sessionId":"s2","extra":true}
+`,
+		},
+		{
+			name: "logfmt",
+			cfg: DatasetConfig{Format: FormatLogfmt, Fields: FieldMapping{Email: "user"}},
+			input: `timestamp=2001-07-08T19:29:30Z user=a@x.com sessionId=s1 msg="hello world"
+level=info timestamp=2001-07-08T19:29:40Z user="b@x.com" sessionId=s2 debug
+`,
+		},
+		{
+			name: "regex",
+			cfg: DatasetConfig{
+				Format: FormatRegex,
+				Pattern: `^\[(?P<timestamp>[^\]]+)\] (?P<email>\S+) session=(?P<sessionId>\S+)`,
+			},
+			input: "[2001-07-08T19:29:30Z] a@x.com session=s1\n[2001-07-08T19:29:40Z] b@x.com session=s2\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProcessor(10, tmpdir).ForDataset(tt.cfg)
+			require.NoError(t, err)
+			partitions, err := p.ProcessRecords(context.Background(), strings.NewReader(tt.input), tt.name)
+			require.NoError(t, err)
+			require.Len(t, partitions, 1)
+			records, err := partitions[0].SelectRecords(partitions[0].MinTimestamp(), partitions[0].MaxTimestamp())
+			require.NoError(t, err)
+			require.Len(t, records, 2)
+			require.Equal(t, "a@x.com", records[0].Email)
+			require.Equal(t, "s2", records[1].SessionID)
+			require.Equal(t, int64(994620580) * int64(time.Second), records[1].Timestamp)
+		})
+	}
+}
+
+func TestSchema(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	schema := &record.Schema{
+		Fields: []record.Field{
+			{Name: "email", Type: record.TypeString},
+			{Name: "country", Type: record.TypeString, Required: true},
+			{Name: "latency", Type: record.TypeFloat},
+			{Name: "status", Type: record.TypeInt},
+			{Name: "mobile", Type: record.TypeBool},
+		},
+	}
+	p, err := NewProcessor(10, tmpdir).ForDataset(DatasetConfig{Format: FormatJSON, Schema: schema})
+	require.NoError(t, err)
+	input := `{"timestamp":"2001-07-08T19:29:30Z","country":"nl","latency":1.5,"status":200,"mobile":true}
+{"timestamp":"2001-07-08T19:29:35Z","email":"a@x.com"}
+{"timestamp":"2001-07-08T19:29:40Z","country":"de","status":"bad"}
+{"timestamp":"2001-07-08T19:29:45Z","email":"b@x.com","country":"fr"}
+`
+	partitions, err := p.ProcessRecords(context.Background(), strings.NewReader(input), "schema")
+	require.NoError(t, err)
+	require.Len(t, partitions, 1)
+	require.Equal(t, schema, partitions[0].Schema())
+
+	records, err := partitions[0].SelectRecords(partitions[0].MinTimestamp(), partitions[0].MaxTimestamp())
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, map[string]interface{}{"country": "nl", "latency": 1.5, "status": int64(200), "mobile": true},
+		records[0].Attrs)
+	require.Equal(t, "b@x.com", records[1].Email)
+	require.Equal(t, map[string]interface{}{"country": "fr"}, records[1].Attrs)
+
+	_, err = NewProcessor(10, tmpdir).ForDataset(DatasetConfig{
+		Format: FormatCSV,
+		Schema: &record.Schema{Fields: []record.Field{{Name: "email", Type: record.TypeInt}}},
+	})
+	require.Error(t, err)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"2001-07-08T19:29:30.000000123Z": 994620570000000123,
+		"2001-07-08T19:29:30.5+00:00": 994620570500000000,
+		"994620570": 994620570000000000,
+		"994620570.25": 994620570250000000,
+		"-1.5": -1500000000,
+	} {
+		ts, err := parseTimestamp(s)
+		require.NoError(t, err)
+		require.Equal(t, expected, ts, s)
+	}
+	_, err := parseTimestamp("994620570.2x")
+	require.Error(t, err)
+}
+
+func TestProcessRecordsWorkers(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	var input strings.Builder
+	input.WriteString("timestamp,email,sessionId\n")
+	start := time.Date(2001, 7, 8, 19, 29, 30, 0, time.UTC)
+	for i := 0; i < 5000; i++ {
+		if i % 97 == 0 {
+			input.WriteString("malformed\n")
+			continue
+		}
+		fmt.Fprintf(&input, "%s,%d@x.com,s%d\n", start.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano), i, i)
+	}
+
+	process := func(workers int, prefix string) ([]*record.InternalRecord, []int64, LineStats) {
+		p, err := NewProcessorWithOptions(Options{PartitionSize: 100, PartitionDirPath: tmpdir, Workers: workers}).
+			ForDataset(DatasetConfig{Format: FormatCSV})
+		require.NoError(t, err)
+		var records []*record.InternalRecord
+		var rejected []int64
+		stats, err := p.ProcessRecordsFunc(context.Background(), strings.NewReader(input.String()), prefix,
+			func(r Reject) error {
+				rejected = append(rejected, r.Line)
+				return nil
+			},
+			func(part partition.Partition) {
+				partRecords, err := part.SelectRecords(part.MinTimestamp(), part.MaxTimestamp())
+				require.NoError(t, err)
+				records = append(records, partRecords...)
+			}, func([]partition.Partition) {
+				records = nil
+			})
+		require.NoError(t, err)
+		return records, rejected, stats
+	}
+	serialRecords, serialRejected, serialStats := process(1, "serial")
+	records, rejected, stats := process(4, "parallel")
+	require.Len(t, records, 5000 - 52)
+	require.Equal(t, serialRecords, records)
+	require.Equal(t, serialRejected, rejected)
+	require.Equal(t, serialStats, stats)
+}
+
+func TestPartitioning(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	var input strings.Builder
+	start := time.Date(2001, 7, 8, 22, 30, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(&input, "%s a@x.com s%02d\n", start.Add(time.Duration(i) * 15 * time.Minute).Format(time.RFC3339), i)
+	}
+	hour := int64(time.Hour)
+	window := func(h int) [2]int64 {
+		windowStart := time.Date(2001, 7, 8, h, 0, 0, 0, time.UTC).UnixNano()
+		return [2]int64{windowStart, windowStart + hour}
+	}
+
+	tests := []struct {
+		name string
+		cfg PartitioningConfig
+		sizes []int
+		windows [][2]int64
+	}{
+		{"count", PartitioningConfig{Records: 5}, []int{5, 5, 2}, nil},
+		{"time", PartitioningConfig{Strategy: partition.StrategyTime, Window: "1h"}, []int{2, 4, 4, 2},
+			[][2]int64{window(22), window(23), window(24), window(25)}},
+		{"size", PartitioningConfig{Strategy: partition.StrategySize, Size: 3 * (recordOverhead + 10)}, []int{3, 3, 3, 3}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProcessor(4096, tmpdir).ForDataset(DatasetConfig{Partitioning: &tt.cfg})
+			require.NoError(t, err)
+			partitions, err := p.ProcessRecords(context.Background(), strings.NewReader(input.String()), tt.name)
+			require.NoError(t, err)
+			sizes := make([]int, 0)
+			windows := make([][2]int64, 0)
+			for _, part := range partitions {
+				records, err := part.SelectRecords(part.MinTimestamp(), part.MaxTimestamp())
+				require.NoError(t, err)
+				sizes = append(sizes, len(records))
+				windowStart, windowEnd := part.Window()
+				windows = append(windows, [2]int64{windowStart, windowEnd})
+			}
+			require.Equal(t, tt.sizes, sizes)
+			if tt.windows != nil {
+				require.Equal(t, tt.windows, windows)
+			}
+
+			records, err := ParseRecords(strings.NewReader(input.String()))
+			require.NoError(t, err)
+			written, err := p.WriteRecords(context.Background(), records, tt.name + "-written", 0)
+			require.NoError(t, err)
+			require.Len(t, written, len(tt.sizes))
+		})
+	}
+
+	_, err = newPartitioning(&PartitioningConfig{Strategy: partition.StrategyTime, Window: "7m"}, 0)
+	require.Error(t, err)
+	_, err = newPartitioning(&PartitioningConfig{Strategy: partition.StrategySize}, 0)
+	require.Error(t, err)
+}
+
+// cancelingReader cancels processing once half of the input is read
+type cancelingReader struct {
+	r io.Reader
+	left int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	if len(p) > 512 {
+		p = p[:512]
+	}
+	n, err := r.r.Read(p)
+	r.left -= n
+	if r.left <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestProcessRecordsCancel(t *testing.T) {
+	var input strings.Builder
+	start := time.Date(2001, 7, 8, 19, 29, 30, 0, time.UTC)
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&input, "%s a@x.com s%d\n", start.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano), i)
+	}
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers-%d", workers), func(t *testing.T) {
+			tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+			require.NoError(t, err)
+			defer os.RemoveAll(tmpdir)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := &cancelingReader{r: strings.NewReader(input.String()), left: input.Len() / 2, cancel: cancel}
+			p := NewProcessorWithOptions(Options{PartitionSize: 100, PartitionDirPath: tmpdir, Workers: workers})
+			var published []partition.Partition
+			_, err = p.ProcessRecordsFunc(ctx, r, "cancel", nil, func(part partition.Partition) {
+				published = append(published, part)
+			}, nil)
+			require.ErrorIs(t, err, context.Canceled)
+
+			files, err := os.ReadDir(tmpdir)
+			require.NoError(t, err)
+			require.Len(t, files, 2 * len(published))
+
+			// partitions collected by ProcessRecords are removed along with the rest
+			require.NoError(t, os.RemoveAll(tmpdir))
+			require.NoError(t, os.Mkdir(tmpdir, os.ModePerm))
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			r = &cancelingReader{r: strings.NewReader(input.String()), left: input.Len() / 2, cancel: cancel}
+			// records are streamed to partitions instead of being sorted first
+			p = NewProcessorWithOptions(Options{PartitionSize: 100, PartitionDirPath: tmpdir, Workers: workers, Order: OrderReject})
+			partitions, err := p.ProcessRecords(ctx, r, "cancel")
+			require.ErrorIs(t, err, context.Canceled)
+			require.Nil(t, partitions)
+			files, err = os.ReadDir(tmpdir)
+			require.NoError(t, err)
+			require.Empty(t, files)
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	input := "2001-07-08T19:29:30Z a@x.com s1\n" +
+		"2001-07-08T19:29:31Z a@x.com s1\n" +
+		"2001-07-08T19:29:31Z a@x.com s1\n" +
+		"2001-07-08T19:29:31Z b@x.com s1\n" +
+		"2001-07-08T19:29:32Z a@x.com s1\n" +
+		"2001-07-08T19:29:31Z a@x.com s1\n"
+	p := NewProcessorWithOptions(Options{
+		PartitionSize: 2,
+		PartitionDirPath: tmpdir,
+		Order: OrderSort,
+		DedupWindow: time.Second,
+	})
+	var records []*record.InternalRecord
+	stats, err := p.ProcessRecordsFunc(context.Background(), strings.NewReader(input), "dedup", nil,
+		func(part partition.Partition) {
+			partRecords, err := part.SelectRecords(part.MinTimestamp(), part.MaxTimestamp())
+			require.NoError(t, err)
+			records = append(records, partRecords...)
+		}, func([]partition.Partition) {
+			records = nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, LineStats{Accepted: 4, Duplicates: 2}, stats)
+	require.Len(t, records, 4)
+
+	minute := time.Date(2001, 7, 8, 19, 29, 0, 0, time.UTC).UnixNano()
+	second := func(n int64) int64 {
+		return minute + n * int64(time.Second)
+	}
+	seed := []*record.InternalRecord{
+		{Timestamp: second(30), Email: "a@x.com", SessionID: "s1"},
+		{Timestamp: second(33), Email: "a@x.com", SessionID: "s1"},
+	}
+	appended := []*record.InternalRecord{
+		{Timestamp: second(30), Email: "a@x.com", SessionID: "s1"},
+		{Timestamp: second(32), Email: "a@x.com", SessionID: "s1", Attrs: map[string]interface{}{"n": int64(1)}},
+		{Timestamp: second(32), Email: "a@x.com", SessionID: "s1", Attrs: map[string]interface{}{"n": "1"}},
+		{Timestamp: second(32), Email: "a@x.com", SessionID: "s1", Attrs: map[string]interface{}{"n": "1"}},
+		{Timestamp: second(33), Email: "a@x.com", SessionID: "s1"},
+	}
+	kept, dropped := p.WithDedupSeed(seed).DropDuplicates(appended)
+	// the first record is older than the window of the latest seed record so it is not checked
+	require.Equal(t, int64(2), dropped)
+	require.Equal(t, appended[:3], kept)
+
+	kept, dropped = NewProcessor(2, tmpdir).DropDuplicates(appended)
+	require.Equal(t, int64(0), dropped)
+	require.Equal(t, appended, kept)
+
+	// followed records rejected as out of order are not remembered, so their copies are rejected as well
+	path := tmpdir + "/live.log"
+	require.NoError(t, os.WriteFile(path, []byte("2001-07-08T19:29:30Z a@x.com s1\n" +
+		"2001-07-08T19:29:32Z a@x.com s1\n" +
+		"2001-07-08T19:29:31Z a@x.com s1\n" +
+		"2001-07-08T19:29:31Z a@x.com s1\n" +
+		"2001-07-08T19:29:32Z a@x.com s1\n"), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	var rejected []int64
+	var last FollowUpdate
+	err = p.Follow(ctx, path, "live.log", FollowState{}, time.Millisecond,
+		func(r Reject) error {
+			rejected = append(rejected, r.Line)
+			return nil
+		},
+		func(update FollowUpdate) {
+			last = update
+			if update.CaughtUp {
+				cancel()
+			}
+		})
+	require.NoError(t, err)
+	require.Equal(t, []int64{3, 4}, rejected)
+	require.Equal(t, LineStats{Accepted: 2, Rejected: 2, Duplicates: 1}, last.Stats)
+}
+
+// slowReader reads r in small pieces with a delay, so that lines are still being read when processing fails
+type slowReader struct {
+	r io.Reader
+	reads atomic.Int64
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	time.Sleep(100 * time.Microsecond)
+	if len(p) > 64 {
+		p = p[:64]
+	}
+	return r.r.Read(p)
+}
+
+func TestProcessRecordsStopsReading(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	var input strings.Builder
+	start := time.Date(2001, 7, 8, 19, 29, 30, 0, time.UTC)
+	fmt.Fprintf(&input, "%s a@x.com s\n", start.Add(time.Hour).Format(time.RFC3339))
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&input, "%s a@x.com s%d\n", start.Add(time.Duration(i) * time.Second).Format(time.RFC3339), i)
+	}
+	r := &slowReader{r: strings.NewReader(input.String())}
+	p := NewProcessorWithOptions(Options{PartitionSize: 100, PartitionDirPath: tmpdir, Workers: 4, Order: OrderReject})
+	_, err = p.ProcessRecordsFunc(context.Background(), r, "stop", nil, func(partition.Partition) {}, nil)
+	require.Error(t, err)
+	// the caller closes the reader once processing returns, so it must not be read anymore
+	reads := r.reads.Load()
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, reads, r.reads.Load())
+}
+
+func TestCompact(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	var input strings.Builder
+	start := time.Date(2001, 7, 8, 22, 30, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(&input, "%s a@x.com s%02d\n", start.Add(time.Duration(i) * 15 * time.Minute).Format(time.RFC3339), i)
+	}
+	records, err := ParseRecords(strings.NewReader(input.String()))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		cfg PartitioningConfig
+		groups [][2]int
+		sizes []int
+	}{
+		// partitions of 1, 1, 1, 1, 5 and 3 records
+		{"count", PartitioningConfig{Records: 5}, [][2]int{{0, 4}}, []int{4}},
+		// partitions of 1, 1, 1, 1, 2, 4 and 2 records, the first four share windows with neighbours
+		{"time", PartitioningConfig{Strategy: partition.StrategyTime, Window: "1h"}, [][2]int{{0, 2}, {2, 5}}, []int{2, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProcessor(4096, tmpdir).ForDataset(DatasetConfig{Partitioning: &tt.cfg})
+			require.NoError(t, err)
+			// partitions appended record by record and one partition which is full already
+			partitions := make([]partition.Partition, 0)
+			for i := 0; i < 4; i++ {
+				written, err := p.WriteRecords(context.Background(), records[i:i + 1], tt.name, i)
+				require.NoError(t, err)
+				partitions = append(partitions, written...)
+			}
+			written, err := p.WriteRecords(context.Background(), records[4:], tt.name, 4)
+			require.NoError(t, err)
+			partitions = append(partitions, written...)
+
+			groups := p.CompactionGroups(partitions)
+			require.Equal(t, tt.groups, groups)
+			merged := make([]int, 0)
+			index := 100
+			for _, group := range groups {
+				compacted, err := p.Compact(context.Background(), partitions[group[0]:group[1]], tt.name, index)
+				require.NoError(t, err)
+				require.Len(t, compacted, 1)
+				index++
+				merged = append(merged, compacted[0].Size())
+			}
+			require.Equal(t, tt.sizes, merged)
+
+			// partitions which do not make fewer partitions once merged are left as they are
+			compacted, err := p.Compact(context.Background(), partitions[4:6], tt.name, index)
+			require.NoError(t, err)
+			require.Nil(t, compacted)
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package processor
+
+import (
+	"fmt"
+)
+
+// LineStats counts parsed lines of a data file, empty lines and csv header are not counted
+type LineStats struct {
+	Accepted int64
+	Rejected int64
+	// Duplicates counts lines dropped as duplicates of accepted ones, they are not counted as accepted
+	Duplicates int64
+}
+
+// ErrorRate returns share of rejected lines
+func (s LineStats) ErrorRate() float64 {
+	if s.Accepted + s.Rejected == 0 {
+		return 0
+	}
+	return float64(s.Rejected) / float64(s.Accepted + s.Rejected)
+}
+
+// Reject describes a line which is not ingested
+type Reject struct {
+	// Line is a number of the line in the data file starting with 1
+	Line int64 `json:"line"`
+	Text string `json:"text"`
+	Error string `json:"error"`
+}
+
+// RejectFunc receives lines which are not ingested, returned error fails processing
+type RejectFunc func(Reject) error
+
+// checkErrorRate fails when share of rejected lines exceeds max error rate, zero max error rate disables the check
+func (p *Processor) checkErrorRate(stats LineStats) error {
+	if p.maxErrorRate > 0 && stats.ErrorRate() > p.maxErrorRate {
+		return fmt.Errorf("%d of %d lines are rejected, error rate exceeds %v",
+			stats.Rejected, stats.Accepted + stats.Rejected, p.maxErrorRate)
+	}
+	return nil
+}
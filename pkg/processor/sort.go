@@ -0,0 +1,223 @@
+package processor
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/ugorji/go/codec"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// sliceReader returns records of a sorted in-memory run
+type sliceReader struct {
+	records []*record.InternalRecord
+}
+
+func (r *sliceReader) Read() (*record.InternalRecord, error) {
+	if len(r.records) == 0 {
+		return nil, io.EOF
+	}
+	rec := r.records[0]
+	r.records = r.records[1:]
+	return rec, nil
+}
+
+// concatReader returns records of readers one reader after another
+type concatReader struct {
+	readers []recordReader
+}
+
+func (r *concatReader) Read() (*record.InternalRecord, error) {
+	for len(r.readers) > 0 {
+		rec, err := r.readers[0].Read()
+		if err != io.EOF {
+			return rec, err
+		}
+		r.readers = r.readers[1:]
+	}
+	return nil, io.EOF
+}
+
+// partitionsReader returns records of partitions decoding one partition at a time
+type partitionsReader struct {
+	partitions []partition.Partition
+	records []*record.InternalRecord
+}
+
+func (r *partitionsReader) Read() (*record.InternalRecord, error) {
+	for len(r.records) == 0 {
+		if len(r.partitions) == 0 {
+			return nil, io.EOF
+		}
+		records, err := r.partitions[0].SelectRecords(math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		r.partitions = r.partitions[1:]
+		r.records = records
+	}
+	rec := r.records[0]
+	r.records = r.records[1:]
+	return rec, nil
+}
+
+// runReader decodes records of a sorted run spilled to disk
+type runReader struct {
+	file *os.File
+	decoder *codec.Decoder
+	left int
+}
+
+func (r *runReader) Read() (*record.InternalRecord, error) {
+	if r.left == 0 {
+		return nil, io.EOF
+	}
+	rec := &record.InternalRecord{}
+	if err := r.decoder.Decode(rec); err != nil {
+		return nil, fmt.Errorf("error decoding sorted run: %v", err)
+	}
+	r.left--
+	return rec, nil
+}
+
+// mergeReader merges sorted runs, equal timestamps are returned in run order to keep the sort stable
+type mergeReader struct {
+	runs []recordReader
+	heads recordHeap
+}
+
+func newMergeReader(runs []recordReader) (*mergeReader, error) {
+	m := &mergeReader{
+		runs: runs,
+	}
+	for i := range runs {
+		if err := m.advance(i); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *mergeReader) advance(run int) error {
+	rec, err := m.runs[run].Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(&m.heads, windowItem{rec: rec, seq: run})
+	return nil
+}
+
+func (m *mergeReader) Read() (*record.InternalRecord, error) {
+	if len(m.heads) == 0 {
+		return nil, io.EOF
+	}
+	item := heap.Pop(&m.heads).(windowItem)
+	if err := m.advance(item.seq); err != nil {
+		return nil, err
+	}
+	return item.rec, nil
+}
+
+func sortRun(records []*record.InternalRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp < records[j].Timestamp
+	})
+}
+
+// SortRunPrefix starts names of temporary files which sorted runs are spilled to
+const SortRunPrefix = ".sort-run-"
+
+// spillRun writes sorted run to a temporary file in partition dir
+func (p *Processor) spillRun(records []*record.InternalRecord) (*runReader, error) {
+	file, err := os.CreateTemp(p.partitionDirPath, SortRunPrefix + "*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating sorted run: %v", err)
+	}
+	fail := func(err error) (*runReader, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	w := bufio.NewWriter(file)
+	encoder := codec.NewEncoder(w, &msgpackHandler)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return fail(fmt.Errorf("error encoding sorted run: %v", err))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(fmt.Errorf("error writing sorted run: %v", err))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(fmt.Errorf("error seeking sorted run: %v", err))
+	}
+	return &runReader{
+		file: file,
+		decoder: codec.NewDecoder(bufio.NewReader(file), &msgpackHandler),
+		left: len(records),
+	}, nil
+}
+
+// externalSort sorts records keeping at most sort run size of them in memory
+//
+// Input is split into runs which are sorted in memory and spilled to temporary files,
+// then the runs are merged. Input which fits into a single run is not spilled at all.
+func (p *Processor) externalSort(reader recordReader) (recordReader, func(), error) {
+	var spilled []*runReader
+	cleanup := func() {
+		for _, run := range spilled {
+			run.file.Close()
+			os.Remove(run.file.Name())
+		}
+	}
+
+	for {
+		run := make([]*record.InternalRecord, 0)
+		var eof bool
+		for len(run) < p.sortRunSize {
+			rec, err := reader.Read()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				cleanup()
+				return nil, func() {}, err
+			}
+			run = append(run, rec)
+		}
+		sortRun(run)
+
+		if eof && len(spilled) == 0 {
+			return &sliceReader{records: run}, cleanup, nil
+		}
+		if eof {
+			runs := make([]recordReader, 0, len(spilled) + 1)
+			for _, r := range spilled {
+				runs = append(runs, r)
+			}
+			runs = append(runs, &sliceReader{records: run})
+			merged, err := newMergeReader(runs)
+			if err != nil {
+				cleanup()
+				return nil, func() {}, err
+			}
+			return merged, cleanup, nil
+		}
+
+		spilledRun, err := p.spillRun(run)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		spilled = append(spilled, spilledRun)
+	}
+}
@@ -0,0 +1,368 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FollowState is a position in a followed file which allows to resume following after restart
+type FollowState struct {
+	// Inode identifies the file currently read from path
+	Inode uint64
+	// Offset points right after the last record of the last sealed partition
+	Offset int64
+	// PartitionIndex is an index of the next partition to seal
+	PartitionIndex int
+	// LastTimestamp is a timestamp of the last sealed record, it is only valid when PartitionIndex > 0
+	LastTimestamp int64
+	// Line is a number of lines before Offset
+	Line int64
+	// Stats counts lines of the followed path read before Offset, including rotated files
+	Stats LineStats
+}
+
+// FollowUpdate is published by Follow every time new records are read
+type FollowUpdate struct {
+	// Sealed contains partitions written to disk since the previous update
+	Sealed []partition.Partition
+	// Open is an in-memory partition with records which are not sealed yet, nil if there are none
+	Open partition.Partition
+	State FollowState
+	// CaughtUp is set when the end of file is reached
+	CaughtUp bool
+	// Stats counts all lines read so far, including ones of the open partition
+	Stats LineStats
+}
+
+// followPosition is a position in the followed file right after an accepted record
+type followPosition struct {
+	offset int64
+	line int64
+	stats LineStats
+}
+
+type follower struct {
+	// ctx stops writing partitions once it is done
+	ctx context.Context
+	p *Processor
+	path string
+	prefix string
+	state FollowState
+
+	parser Parser
+	// needHeader is set until the header line is passed to header parser
+	needHeader bool
+	reject RejectFunc
+
+	file *os.File
+	reader *bufio.Reader
+	// offset points right after the last complete line read, line is a number of lines read
+	offset int64
+	line int64
+	partial string
+	stats LineStats
+
+	records []*record.InternalRecord
+	ends []followPosition
+	cut cutter
+	// dedup is kept across rotations, so that lines delivered again to the new file are dropped
+	dedup *deduper
+	// lastTimestamp is a timestamp of the latest accepted record, older records are dropped
+	lastTimestamp int64
+	started bool
+}
+
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
+
+// Follow keeps reading file at path as it grows, the same way tail -F does
+//
+// Records are gathered into the open partition which is sealed and written to disk once the partitioning
+// strategy cuts it, the open partition is published after each read so new records become visible
+// within interval. Malformed records and records older than the latest accepted one are passed to reject
+// if it is not nil and dropped, error rate threshold is not applied to followed files. With dedup enabled
+// exact duplicates of accepted records are dropped before the order check, see WithDedupSeed to catch
+// duplicates of sealed records.
+// Renamed file is read to the end and then path is reopened, truncated file is read from the beginning,
+// in both cases the open partition is sealed right away.
+// Follow returns when ctx is done, partitions are not sealed after that and following resumes
+// from the last sealed partition.
+func (p *Processor) Follow(ctx context.Context, path, prefix string, state FollowState,
+	interval time.Duration, reject RejectFunc, publish func(FollowUpdate)) error {
+
+	f := &follower{
+		ctx: ctx,
+		p: p,
+		path: path,
+		prefix: prefix,
+		state: state,
+		parser: p.newParser(),
+		reject: reject,
+		cut: p.partitioning.newCutter(),
+		dedup: p.newDeduper(),
+		stats: state.Stats,
+		lastTimestamp: state.LastTimestamp,
+		started: state.PartitionIndex > 0,
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	defer func() {
+		f.file.Close()
+	}()
+
+	// seal fails once ctx is done, state still points to the last sealed partition then
+	stopped := func(err error) error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	for {
+		if err := f.checkRotation(publish); err != nil {
+			return stopped(err)
+		}
+		if err := f.readLines(publish); err != nil {
+			return stopped(err)
+		}
+		publish(FollowUpdate{
+			Open: f.openPartition(),
+			State: f.state,
+			CaughtUp: true,
+			Stats: f.stats,
+		})
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// open opens path and resumes from the saved offset if it is still the same file
+func (f *follower) open() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading file info: %v", err)
+	}
+	if inode(info) != f.state.Inode || info.Size() < f.state.Offset {
+		f.state.Inode = inode(info)
+		f.state.Offset = 0
+		f.state.Line = 0
+	}
+	_, f.needHeader = f.parser.(headerParser)
+	if f.needHeader && f.state.Offset > 0 {
+		// header precedes the saved offset so it is read separately
+		header, err := bufio.NewReader(io.NewSectionReader(file, 0, f.state.Offset)).ReadString('\n')
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("error reading header: %v", err)
+		}
+		if err := f.parser.(headerParser).ParseHeader(strings.TrimRight(header, "\r\n")); err != nil {
+			file.Close()
+			return err
+		}
+		f.needHeader = false
+	}
+	if _, err := file.Seek(f.state.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("error seeking file: %v", err)
+	}
+	f.file = file
+	f.reader = bufio.NewReader(file)
+	f.offset = f.state.Offset
+	f.line = f.state.Line
+	f.partial = ""
+	return nil
+}
+
+func (f *follower) checkRotation(publish func(FollowUpdate)) error {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		// file is moved away and not yet recreated, keep waiting
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading file info: %v", err)
+	}
+	current, err := f.file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading file info: %v", err)
+	}
+
+	if !os.SameFile(info, current) {
+		log.Printf("file %s is rotated", f.path)
+		if err := f.readLines(publish); err != nil {
+			return err
+		}
+		if err := f.sealAll(publish); err != nil {
+			return err
+		}
+		f.file.Close()
+		f.state.Offset = 0
+		f.state.Line = 0
+		return f.open()
+	}
+	if info.Size() < f.offset {
+		log.Printf("file %s is truncated", f.path)
+		if err := f.sealAll(publish); err != nil {
+			return err
+		}
+		f.state.Offset = 0
+		f.state.Line = 0
+		f.file.Close()
+		return f.open()
+	}
+	return nil
+}
+
+// readLines reads complete lines available in file, partitions are sealed as they fill up
+func (f *follower) readLines(publish func(FollowUpdate)) error {
+	for {
+		line, err := f.reader.ReadString('\n')
+		if err == io.EOF {
+			f.partial += line
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
+		f.offset += int64(len(f.partial) + len(line))
+		f.line++
+		line = strings.TrimRight(f.partial + line, "\r\n")
+		f.partial = ""
+		if f.needHeader {
+			if err := f.parser.(headerParser).ParseHeader(line); err != nil {
+				return err
+			}
+			f.needHeader = false
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		r, err := f.parser.Parse(line)
+		if err != nil {
+			log.Print(err.Error())
+			if err := f.rejectLine(line, err); err != nil {
+				return err
+			}
+			continue
+		}
+		var key dedupKey
+		if f.dedup != nil {
+			key = keyOf(r)
+			if f.dedup.contains(key) {
+				f.stats.Duplicates++
+				continue
+			}
+		}
+		if f.started && r.Timestamp < f.lastTimestamp {
+			log.Printf("record %s in %s is out of order, dropping it", line, f.path)
+			if err := f.rejectLine(line, fmt.Errorf("record is out of order")); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.dedup != nil {
+			// rejected records are not remembered, so that their copies are not taken for duplicates
+			f.dedup.add(key)
+		}
+		f.started = true
+		f.lastTimestamp = r.Timestamp
+		f.stats.Accepted++
+		if f.cut.add(r) {
+			// cutter keeps r as the first record of the next partition so it is not reset
+			if err := f.seal(len(f.records), publish); err != nil {
+				return err
+			}
+		}
+		f.records = append(f.records, r)
+		f.ends = append(f.ends, followPosition{
+			offset: f.offset,
+			line: f.line,
+			stats: f.stats,
+		})
+
+		if f.cut.full() {
+			if err := f.sealAll(publish); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *follower) rejectLine(line string, err error) error {
+	f.stats.Rejected++
+	if f.reject == nil {
+		return nil
+	}
+	return f.reject(Reject{
+		Line: f.line,
+		Text: line,
+		Error: err.Error(),
+	})
+}
+
+// seal writes first n open records to disk as a new partition
+func (f *follower) seal(n int, publish func(FollowUpdate)) error {
+	part, err := f.p.writePartition(f.ctx, f.p.partitionDirPath, f.prefix, f.state.PartitionIndex, f.records[:n])
+	if err != nil {
+		return err
+	}
+	if err := part.Setup(); err != nil {
+		removeWritten(part)
+		return err
+	}
+	f.state.PartitionIndex++
+	f.state.Offset = f.ends[n - 1].offset
+	f.state.Line = f.ends[n - 1].line
+	f.state.Stats = f.ends[n - 1].stats
+	f.state.LastTimestamp = f.records[n - 1].Timestamp
+	// published open partitions keep referring to the previous slice so it is not reused
+	f.records = append([]*record.InternalRecord(nil), f.records[n:]...)
+	f.ends = append([]followPosition(nil), f.ends[n:]...)
+
+	publish(FollowUpdate{
+		Sealed: []partition.Partition{part},
+		Open: f.openPartition(),
+		State: f.state,
+		Stats: f.stats,
+	})
+	return nil
+}
+
+// sealAll seals all open records and starts the next partition from scratch
+func (f *follower) sealAll(publish func(FollowUpdate)) error {
+	f.cut.reset()
+	if len(f.records) == 0 {
+		return nil
+	}
+	return f.seal(len(f.records), publish)
+}
+
+func (f *follower) openPartition() partition.Partition {
+	if len(f.records) == 0 {
+		return nil
+	}
+	return partition.NewMemPartition(f.records, f.p.schema)
+}
@@ -8,17 +8,32 @@ import (
 type InternalRecord struct {
 	Email string
 	SessionID string
+	// Timestamp is unix time in nanoseconds
 	Timestamp int64
+	// Attrs keeps values of schema fields other than email and sessionId
+	Attrs map[string]interface{} `codec:",omitempty"`
 }
 
 func ConvertInternalRecordToAPI(r *InternalRecord) *APIRecord {
 	return &APIRecord{
 		Email: r.Email,
 		SessionID: r.SessionID,
-		EventTime: time.Unix(r.Timestamp, 0).Format(time.RFC3339),
+		EventTime: time.Unix(0, r.Timestamp).Format(time.RFC3339Nano),
 	}
 }
 
+func ConvertAPIRecordToInternal(r *APIRecord) (*InternalRecord, error) {
+	ts, err := time.Parse(time.RFC3339Nano, r.EventTime)
+	if err != nil {
+		return nil, err
+	}
+	return &InternalRecord{
+		Email: r.Email,
+		SessionID: r.SessionID,
+		Timestamp: ts.UnixNano(),
+	}, nil
+}
+
 // APIRecord represent record object encoded to json and used in http server
 type APIRecord struct {
 	Email       string  `json:"email"`
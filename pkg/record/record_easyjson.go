@@ -42,6 +42,28 @@ func easyjson15d5d517DecodeGithubComSsfilatovTsPkgRecord(in *jlexer.Lexer, out *
 			out.SessionID = string(in.String())
 		case "Timestamp":
 			out.Timestamp = int64(in.Int64())
+		case "Attrs":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				in.Delim('{')
+				out.Attrs = make(map[string]interface{})
+				for !in.IsDelim('}') {
+					key := string(in.String())
+					in.WantColon()
+					var v1 interface{}
+					if m, ok := v1.(easyjson.Unmarshaler); ok {
+						m.UnmarshalEasyJSON(in)
+					} else if m, ok := v1.(json.Unmarshaler); ok {
+						_ = m.UnmarshalJSON(in.Raw())
+					} else {
+						v1 = in.Interface()
+					}
+					(out.Attrs)[key] = v1
+					in.WantComma()
+				}
+				in.Delim('}')
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -71,6 +93,33 @@ func easyjson15d5d517EncodeGithubComSsfilatovTsPkgRecord(out *jwriter.Writer, in
 		out.RawString(prefix)
 		out.Int64(int64(in.Timestamp))
 	}
+	{
+		const prefix string = ",\"Attrs\":"
+		out.RawString(prefix)
+		if in.Attrs == nil && (out.Flags&jwriter.NilMapAsEmpty) == 0 {
+			out.RawString(`null`)
+		} else {
+			out.RawByte('{')
+			v2First := true
+			for v2Name, v2Value := range in.Attrs {
+				if v2First {
+					v2First = false
+				} else {
+					out.RawByte(',')
+				}
+				out.String(string(v2Name))
+				out.RawByte(':')
+				if m, ok := v2Value.(easyjson.Marshaler); ok {
+					m.MarshalEasyJSON(out)
+				} else if m, ok := v2Value.(json.Marshaler); ok {
+					out.Raw(m.MarshalJSON())
+				} else {
+					out.Raw(json.Marshal(v2Value))
+				}
+			}
+			out.RawByte('}')
+		}
+	}
 	out.RawByte('}')
 }
 
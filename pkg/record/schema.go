@@ -0,0 +1,125 @@
+package record
+
+import (
+	"fmt"
+	"github.com/mailru/easyjson/jwriter"
+	"time"
+)
+
+// FieldType is a type of schema field value
+type FieldType string
+
+const (
+	// TypeString values are stored as string
+	TypeString FieldType = "string"
+	// TypeInt values are stored as int64
+	TypeInt FieldType = "int"
+	// TypeFloat values are stored as float64
+	TypeFloat FieldType = "float"
+	// TypeBool values are stored as bool
+	TypeBool FieldType = "bool"
+	// TypeTimestamp values are stored as int64 unix nanoseconds and encoded to json as RFC3339
+	TypeTimestamp FieldType = "timestamp"
+)
+
+const (
+	// FieldEmail and FieldSessionID are stored in record fields of the same name, the rest go to Attrs
+	FieldEmail = "email"
+	FieldSessionID = "sessionId"
+	// FieldEventTime is a name of record timestamp in json output, it is not a part of schema
+	FieldEventTime = "eventTime"
+)
+
+// Field describes a single record field besides timestamp
+type Field struct {
+	Name string `json:"name"`
+	Type FieldType `json:"type"`
+	// Required fields must be present in every record, optional ones are omitted when missing
+	Required bool `json:"required"`
+}
+
+// Schema describes fields of dataset records, every record has a timestamp in addition to them
+type Schema struct {
+	Fields []Field `json:"fields"`
+}
+
+// DefaultSchema is applied to datasets without schema and to partitions written before schemas were introduced
+var DefaultSchema = &Schema{
+	Fields: []Field{
+		{Name: FieldEmail, Type: TypeString, Required: true},
+		{Name: FieldSessionID, Type: TypeString, Required: true},
+	},
+}
+
+func (t FieldType) valid() bool {
+	switch t {
+	case TypeString, TypeInt, TypeFloat, TypeBool, TypeTimestamp:
+		return true
+	}
+	return false
+}
+
+// Validate checks field names are unique and types are known
+func (s *Schema) Validate() error {
+	seen := make(map[string]bool, len(s.Fields))
+	for _, field := range s.Fields {
+		switch {
+		case field.Name == "":
+			return fmt.Errorf("field name is empty")
+		case field.Name == FieldEventTime:
+			return fmt.Errorf("field name %s is reserved", field.Name)
+		case seen[field.Name]:
+			return fmt.Errorf("field %s is duplicated", field.Name)
+		case !field.Type.valid():
+			return fmt.Errorf("field %s has unknown type %s", field.Name, field.Type)
+		case (field.Name == FieldEmail || field.Name == FieldSessionID) && field.Type != TypeString:
+			return fmt.Errorf("field %s should be string", field.Name)
+		}
+		seen[field.Name] = true
+	}
+	return nil
+}
+
+// Value returns value of the field, false is returned for missing optional fields
+func (r *InternalRecord) Value(field Field) (interface{}, bool) {
+	switch field.Name {
+	case FieldEmail:
+		return r.Email, r.Email != "" || field.Required
+	case FieldSessionID:
+		return r.SessionID, r.SessionID != "" || field.Required
+	}
+	v, found := r.Attrs[field.Name]
+	return v, found
+}
+
+// WriteJSON encodes record as a json object with eventTime and schema fields
+func WriteJSON(w *jwriter.Writer, r *InternalRecord, schema *Schema) {
+	w.RawString(`{"` + FieldEventTime + `":`)
+	w.String(time.Unix(0, r.Timestamp).Format(time.RFC3339Nano))
+	for _, field := range schema.Fields {
+		v, found := r.Value(field)
+		if !found {
+			continue
+		}
+		w.RawByte(',')
+		w.String(field.Name)
+		w.RawByte(':')
+		switch value := v.(type) {
+		case string:
+			w.String(value)
+		case int64:
+			if field.Type == TypeTimestamp {
+				w.String(time.Unix(0, value).Format(time.RFC3339Nano))
+			} else {
+				w.Int64(value)
+			}
+		case float64:
+			w.Float64(value)
+		case bool:
+			w.Bool(value)
+		default:
+			w.Raw(nil, fmt.Errorf("field %s has unsupported value %v", field.Name, v))
+		}
+	}
+	w.RawByte('}')
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ssfilatov/ts/pkg/errorx"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/ssfilatov/ts/pkg/storage"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// AppendResponse is returned once appended records are durable
+type AppendResponse struct {
+	Accepted int `json:"accepted"`
+	// Duplicates counts records dropped as duplicates of stored ones
+	Duplicates int `json:"duplicates"`
+}
+
+type appendHandler struct {
+	storage *storage.Storage
+}
+
+func newAppendHandler(storage *storage.Storage) *appendHandler {
+	return &appendHandler{
+		storage: storage,
+	}
+}
+
+func (h *appendHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	records, err := decodeRecords(req)
+	var duplicates int64
+	if err == nil {
+		duplicates, err = h.storage.Append(req.Context(), name, records)
+	}
+	if err != nil {
+		err = appendError(name, err)
+		log.Printf(err.Error())
+		http.Error(w, err.Error(), errorx.Code(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AppendResponse{
+		Accepted: len(records) - int(duplicates),
+		Duplicates: int(duplicates),
+	}); err != nil {
+		log.Printf(err.Error())
+	}
+}
+
+// decodeRecords reads either a json array of records or plain text lines in the same format as data files
+func decodeRecords(req *http.Request) ([]*record.InternalRecord, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		records, err := processor.ParseRecords(req.Body)
+		if err != nil {
+			return nil, errorx.BadRequest(err)
+		}
+		return records, nil
+	}
+
+	var apiRecords []*record.APIRecord
+	if err := json.NewDecoder(req.Body).Decode(&apiRecords); err != nil {
+		return nil, errorx.BadRequest(err)
+	}
+	records := make([]*record.InternalRecord, 0, len(apiRecords))
+	for i, apiRecord := range apiRecords {
+		r, err := record.ConvertAPIRecordToInternal(apiRecord)
+		if err != nil {
+			return nil, errorx.BadRequest(fmt.Errorf("record %d: %v", i, err))
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func appendError(name string, err error) error {
+	switch {
+	case errors.Is(err, storage.ErrLateData), errors.Is(err, storage.ErrNotDataset):
+		return errorx.Conflict(fmt.Sprintf("error appending to %s: %v", name, err))
+	case errors.Is(err, storage.ErrInvalidName):
+		return errorx.NotFound(fmt.Sprintf("error appending to %s: %v", name, err))
+	}
+	return err
+}
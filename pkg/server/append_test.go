@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ssfilatov/ts/pkg/storage"
+	"github.com/stretchr/testify/require"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	// partitions are kept in a dir relative to the working dir
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "server")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	require.NoError(t, os.Chdir(tmpdir))
+	defer os.Chdir(wd)
+	require.NoError(t, os.Mkdir("data", os.ModePerm))
+	require.NoError(t, os.WriteFile("data/a.txt", []byte("2026-01-01T00:00:00Z a@x.com s1\n"), 0644))
+	s, err := storage.NewStorage(context.Background(), storage.Config{
+		PartitionSize: 2,
+		Dir: "data",
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Ingest(context.Background()))
+	server := httptest.NewServer(NewServer(s).httpServer.Handler)
+	defer server.Close()
+
+	post := func(name, contentType, body string) (int, AppendResponse) {
+		resp, err := http.Post(server.URL + "/v1/datasets/" + name + "/records", contentType, strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var appended AppendResponse
+		if resp.StatusCode == http.StatusOK {
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&appended))
+		}
+		return resp.StatusCode, appended
+	}
+
+	// records are taken either as a json array or as lines in the format of data files
+	code, appended := post("ds", "application/json",
+		`[{"email": "a@x.com", "sessionId": "s1", "eventTime": "2026-01-01T00:00:01Z"},` +
+		`{"email": "b@x.com", "sessionId": "s2", "eventTime": "2026-01-01T00:00:00Z"}]`)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, AppendResponse{Accepted: 2}, appended)
+	code, appended = post("ds", "text/plain", "2026-01-01T00:00:02Z c@x.com s3\n2026-01-01T00:00:03Z d@x.com s4\n")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, AppendResponse{Accepted: 2}, appended)
+	partitions, found := s.GetPartitionsByFilename("ds")
+	require.True(t, found)
+	emails := make([]string, 0)
+	for _, part := range partitions {
+		records, err := part.SelectRecords(math.MinInt64, math.MaxInt64)
+		require.NoError(t, err)
+		for _, r := range records {
+			emails = append(emails, r.Email)
+		}
+	}
+	require.Equal(t, []string{"b@x.com", "a@x.com", "c@x.com", "d@x.com"}, emails)
+
+	for _, c := range []struct {
+		name string
+		contentType string
+		body string
+		code int
+	}{
+		// records older than the stored ones
+		{"ds", "text/plain", "2026-01-01T00:00:00Z e@x.com s5\n", http.StatusConflict},
+		// name of a file from data dir
+		{"a.txt", "text/plain", "2026-01-01T00:00:05Z e@x.com s5\n", http.StatusConflict},
+		{".ds", "text/plain", "2026-01-01T00:00:05Z e@x.com s5\n", http.StatusNotFound},
+		{"ds", "application/json", `[{"email": "e@x.com"`, http.StatusBadRequest},
+		{"ds", "application/json", `[{"email": "e@x.com", "sessionId": "s5", "eventTime": "yesterday"}]`,
+			http.StatusBadRequest},
+		{"ds", "text/plain", "2026-01-01T00:00:05Z e@x.com\n", http.StatusBadRequest},
+	} {
+		code, _ := post(c.name, c.contentType, c.body)
+		require.Equal(t, c.code, code, c.body)
+	}
+	partitions, _ = s.GetPartitionsByFilename("ds")
+	require.Len(t, partitions, 2)
+}
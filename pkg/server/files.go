@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ssfilatov/ts/pkg/errorx"
+	"github.com/ssfilatov/ts/pkg/storage"
+	"io"
+	"log"
+	"net/http"
+)
+
+// FileStatus represents ingestion state of a file encoded to json
+type FileStatus struct {
+	Filename   string `json:"filename"`
+	Status     string `json:"status"`
+	Partitions int    `json:"partitions"`
+	Error      string `json:"error,omitempty"`
+	Accepted   int64  `json:"accepted"`
+	Rejected   int64  `json:"rejected"`
+	Duplicates int64  `json:"duplicates"`
+	// Corrupt counts partitions which failed checksum verification, they are skipped by queries
+	Corrupt    int    `json:"corrupt,omitempty"`
+}
+
+type filesHandler struct {
+	storage *storage.Storage
+}
+
+func newFilesHandler(storage *storage.Storage) *filesHandler {
+	return &filesHandler{
+		storage: storage,
+	}
+}
+
+func (h *filesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	states := h.storage.FileStates()
+	statuses := make([]FileStatus, 0, len(states))
+	for _, state := range states {
+		status := FileStatus{
+			Filename:   state.Name,
+			Status:     string(state.Status),
+			Partitions: len(state.Partitions),
+			Accepted:   state.Stats.Accepted,
+			Rejected:   state.Stats.Rejected,
+			Duplicates: state.Stats.Duplicates,
+		}
+		if state.Err != nil {
+			status.Error = state.Err.Error()
+		}
+		for _, part := range state.Partitions {
+			if part.Corrupt() != nil {
+				status.Corrupt++
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Printf(err.Error())
+	}
+}
+
+type rejectsHandler struct {
+	storage *storage.Storage
+}
+
+func newRejectsHandler(storage *storage.Storage) *rejectsHandler {
+	return &rejectsHandler{
+		storage: storage,
+	}
+}
+
+// ServeHTTP writes rejected lines of a file as json lines with line number, text and parse error
+func (h *rejectsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if _, found := h.storage.GetFileState(name); !found {
+		err := errorx.NotFound(fmt.Sprintf("file %s is not found", name))
+		http.Error(w, err.Error(), errorx.Code(err))
+		return
+	}
+	file, err := h.storage.OpenRejects(name)
+	if err != nil {
+		log.Printf(err.Error())
+		http.Error(w, err.Error(), errorx.Code(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if file == nil {
+		return
+	}
+	defer file.Close()
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf(err.Error())
+	}
+}
+
+type cacheHandler struct {
+	storage *storage.Storage
+}
+
+func newCacheHandler(storage *storage.Storage) *cacheHandler {
+	return &cacheHandler{
+		storage: storage,
+	}
+}
+
+// ServeHTTP writes hit, miss and eviction counts and memory taken by the cache of decoded partitions
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.storage.CacheStats()); err != nil {
+		log.Printf(err.Error())
+	}
+}
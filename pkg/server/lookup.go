@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/ssfilatov/ts/pkg/errorx"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/ssfilatov/ts/pkg/storage"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type lookupHandler struct {
+	storage *storage.Storage
+}
+
+func newLookupHandler(storage *storage.Storage) *lookupHandler {
+	return &lookupHandler{
+		storage: storage,
+	}
+}
+
+// ServeHTTP writes all records of a file with email and session id given by query parameters sorted by timestamp,
+// partial parameter allows to look up a file which is still being ingested
+func (h *lookupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	query := req.URL.Query()
+	filter := partition.Filter{
+		Email: query.Get("email"),
+		SessionID: query.Get("sessionId"),
+	}
+	if filter.Empty() {
+		err := errorx.BadRequest(errors.New("email or sessionId is required"))
+		http.Error(w, err.Error(), errorx.Code(err))
+		return
+	}
+	state, err := readableState(h.storage, name, query.Get("partial") == "true")
+	if err != nil {
+		log.Printf(err.Error())
+		http.Error(w, err.Error(), errorx.Code(err))
+		return
+	}
+	defer storage.ReleasePartitions(state.Partitions)
+	w.Header().Set("Content-Type", "application/json")
+	corrupt := make([]string, 0)
+	for _, part := range state.Partitions {
+		if part.Corrupt() != nil {
+			corrupt = append(corrupt, path.Base(part.DataPath()))
+		}
+	}
+	if len(corrupt) > 0 {
+		w.Header().Set(corruptHeader, strings.Join(corrupt, ","))
+	}
+	if err := writeToken(w, "["); err != nil {
+		return
+	}
+	defer func() {
+		_ = writeToken(w, "]")
+	}()
+	var written bool
+	err = h.storage.Lookup(state, filter, func(part partition.Partition, records []*record.InternalRecord) error {
+		for _, r := range records {
+			if written {
+				if err := writeToken(w, ","); err != nil {
+					return err
+				}
+			}
+			if err := writeRecord(w, r, part.Schema()); err != nil {
+				return err
+			}
+			written = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf(err.Error())
+	}
+}
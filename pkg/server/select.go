@@ -2,8 +2,10 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mailru/easyjson"
+	"github.com/mailru/easyjson/jwriter"
 	"github.com/ssfilatov/ts/pkg/errorx"
 	"github.com/ssfilatov/ts/pkg/partition"
 	"github.com/ssfilatov/ts/pkg/record"
@@ -11,14 +13,31 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
 	"sort"
+	"strings"
 	"time"
 )
 
+// corruptHeader lists data files of corrupt partitions which are skipped by a query
+const corruptHeader = "X-Corrupt-Partitions"
+
 type SelectRequest struct {
 	Filename string
 	From string
 	To string
+	// Partial allows to query a file which is still being ingested using partitions built so far
+	Partial bool
+	// Email and SessionID select records with the values, partitions which filters rule the values out are skipped
+	Email string
+	SessionID string
+}
+
+type selectQuery struct {
+	partitions []partition.Partition
+	start time.Time
+	end time.Time
+	filter partition.Filter
 }
 
 type handler struct {
@@ -36,40 +55,88 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	query, err := h.HandleSelect(req)
+	if err != nil {
+		log.Printf(err.Error())
+		http.Error(w, err.Error(), errorx.Code(err))
+		return
+	}
+	// partitions replaced while the query runs are unmapped once it is done
+	defer storage.ReleasePartitions(query.partitions)
 	w.Header().Set("Content-Type", "application/json")
+	if corrupt := corruptPartitions(query.partitions, query.start, query.end); len(corrupt) > 0 {
+		w.Header().Set(corruptHeader, strings.Join(corrupt, ","))
+	}
 	if err := writeToken(w, "["); err != nil {
 		return
 	}
 	defer func() {
 		_ = writeToken(w, "]")
 	}()
-	err := h.HandleSelect(w, req)
-	if err != nil {
+	if err := h.Select(w, query.partitions, query.start, query.end, query.filter); err != nil {
 		log.Printf(err.Error())
 	}
 }
 
-func (h *handler) HandleSelect(w io.Writer, req *http.Request) error {
+// HandleSelect decodes request and acquires partitions to read from
+func (h *handler) HandleSelect(req *http.Request) (*selectQuery, error) {
 	var selectReq SelectRequest
 	if err := json.NewDecoder(req.Body).Decode(&selectReq); err != nil {
-		return errorx.BadRequest(err)
+		return nil, errorx.BadRequest(err)
 	}
 
-	start, err := time.Parse(time.RFC3339, selectReq.From)
+	start, err := time.Parse(time.RFC3339Nano, selectReq.From)
 	if err != nil {
-		return errorx.BadRequest(err)
+		return nil, errorx.BadRequest(err)
 	}
-	end, err := time.Parse(time.RFC3339, selectReq.To)
+	end, err := time.Parse(time.RFC3339Nano, selectReq.To)
 	if err != nil {
-		return errorx.BadRequest(err)
+		return nil, errorx.BadRequest(err)
 	}
 
-	partitionsByFilename, found := h.storage.GetPartitionsByFilename(selectReq.Filename)
-	if !found {
-		return errorx.New(fmt.Sprintf("file %s is not found", selectReq.Filename))
+	partitions, err := readablePartitions(h.storage, selectReq.Filename, selectReq.Partial)
+	if err != nil {
+		return nil, err
 	}
 
-	return h.Select(w, partitionsByFilename, start, end)
+	return &selectQuery{
+		partitions: partitions,
+		start: start,
+		end: end,
+		filter: partition.Filter{
+			Email: selectReq.Email,
+			SessionID: selectReq.SessionID,
+		},
+	}, nil
+}
+
+// readablePartitions acquires partitions of a file which is ready, partitions of a file being ingested
+// are returned if partial results are allowed, they should be released with storage.ReleasePartitions
+func readablePartitions(s *storage.Storage, filename string, partial bool) ([]partition.Partition, error) {
+	state, err := readableState(s, filename, partial)
+	if err != nil {
+		return nil, err
+	}
+	return state.Partitions, nil
+}
+
+// readableState acquires state of a file which could be read, partitions of the state should be released
+func readableState(s *storage.Storage, filename string, partial bool) (storage.FileState, error) {
+	state, found := s.AcquireFileState(filename)
+	if !found {
+		return storage.FileState{}, errorx.NotFound(fmt.Sprintf("file %s is not found", filename))
+	}
+	switch state.Status {
+	case storage.StatusFailed:
+		storage.ReleasePartitions(state.Partitions)
+		return storage.FileState{}, errorx.WrapWithMessage(state.Err, fmt.Sprintf("file %s failed to ingest", filename))
+	case storage.StatusPending, storage.StatusIngesting:
+		if !partial {
+			storage.ReleasePartitions(state.Partitions)
+			return storage.FileState{}, errorx.NotReady(fmt.Sprintf("file %s is not ready: %s", filename, state.Status))
+		}
+	}
+	return state, nil
 }
 
 func writeToken(w io.Writer, s string) error {
@@ -80,36 +147,89 @@ func writeToken(w io.Writer, s string) error {
 	return nil
 }
 
-// Select uses binary search to look for partitions and returns sorted record slice
-func (h *handler) Select(w io.Writer, partitions []partition.Partition,
-	start, end time.Time) error {
-
+// selectRange uses binary search over partition windows to look for partitions overlapping with the range
+func selectRange(partitions []partition.Partition, start, end time.Time) []partition.Partition {
 	startIdx := sort.Search(len(partitions), func(i int) bool {
-		return partitions[i].MaxTimestamp() >= start.Unix()
+		_, windowEnd := partitions[i].Window()
+		return windowEnd > start.UnixNano()
 	})
 	endIdx := sort.Search(len(partitions), func(i int) bool {
-		return partitions[i].MinTimestamp() > end.Unix()
+		windowStart, _ := partitions[i].Window()
+		return windowStart > end.UnixNano()
 	})
-	for i := startIdx; i < endIdx; i++ {
-		partitionRecords, err := partitions[i].SelectRecords(start.Unix(), end.Unix())
+	if startIdx >= endIdx {
+		return nil
+	}
+	return partitions[startIdx:endIdx]
+}
+
+// corruptPartitions returns data file names of partitions in the range which are known to be corrupt
+func corruptPartitions(partitions []partition.Partition, start, end time.Time) []string {
+	corrupt := make([]string, 0)
+	for _, part := range selectRange(partitions, start, end) {
+		if part.Corrupt() != nil {
+			corrupt = append(corrupt, path.Base(part.DataPath()))
+		}
+	}
+	return corrupt
+}
+
+// Select writes records of partitions within the range matching filter sorted by timestamp,
+// corrupt partitions and partitions which definitely have no matching records are skipped
+func (h *handler) Select(w io.Writer, partitions []partition.Partition,
+	start, end time.Time, filter partition.Filter) error {
+
+	var written bool
+	for _, part := range selectRange(partitions, start, end) {
+		if !filter.Empty() && !part.MayContain(filter) {
+			continue
+		}
+		partitionRecords, err := h.selectRecords(part, start.UnixNano(), end.UnixNano())
+		if errors.Is(err, partition.ErrCorrupt) {
+			log.Printf("skipping partition: %v", err)
+			continue
+		}
 		if err != nil {
 			return errorx.WrapWithMessage(err, "error selecting records")
 		}
-		if i != startIdx {
-			if err := writeToken(w, ","); err != nil {
-				return err
+		schema := part.Schema()
+		for _, r := range partitionRecords {
+			if !filter.Match(r) {
+				continue
 			}
-		}
-		for i, r := range partitionRecords {
-			if i != 0 {
+			if written {
 				if err := writeToken(w, ","); err != nil {
 					return err
 				}
 			}
-			if _, err := easyjson.MarshalToWriter(record.ConvertInternalRecordToAPI(r), w); err != nil {
+			if err := writeRecord(w, r, schema); err != nil {
 				return err
 			}
+			written = true
 		}
 	}
 	return nil
 }
+
+// selectRecords reads partition through the storage cache, handlers without storage read partitions directly
+func (h *handler) selectRecords(part partition.Partition, start, end int64) ([]*record.InternalRecord, error) {
+	if h.storage == nil {
+		return part.SelectRecords(start, end)
+	}
+	return h.storage.SelectRecords(part, start, end)
+}
+
+// writeRecord encodes record with fields of partition schema, records of the default schema are encoded as APIRecord
+func writeRecord(w io.Writer, r *record.InternalRecord, schema *record.Schema) error {
+	if schema == nil {
+		_, err := easyjson.MarshalToWriter(record.ConvertInternalRecordToAPI(r), w)
+		return err
+	}
+	jw := jwriter.Writer{}
+	record.WriteJSON(&jw, r, schema)
+	if jw.Error != nil {
+		return jw.Error
+	}
+	_, err := jw.DumpTo(w)
+	return err
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/golang/mock/gomock"
 	"github.com/ssfilatov/ts/mocks"
 	"github.com/ssfilatov/ts/pkg/partition"
@@ -22,8 +23,12 @@ func TestSelect(t *testing.T) {
 
 		m1.EXPECT().MaxTimestamp().Return(int64(50)).AnyTimes()
 		m1.EXPECT().MinTimestamp().Return(int64(10)).AnyTimes()
+		m1.EXPECT().Window().Return(int64(10), int64(51)).AnyTimes()
 		m2.EXPECT().MaxTimestamp().Return(int64(100)).AnyTimes()
 		m2.EXPECT().MinTimestamp().Return(int64(60)).AnyTimes()
+		m2.EXPECT().Window().Return(int64(60), int64(101)).AnyTimes()
+		m1.EXPECT().Schema().Return(nil).AnyTimes()
+		m2.EXPECT().Schema().Return(nil).AnyTimes()
 
 		m1.
 			EXPECT().
@@ -36,14 +41,14 @@ func TestSelect(t *testing.T) {
 		buffer := bytes.Buffer{}
 		buffer.Write([]byte("["))
 		err := newHandler(nil).Select(&buffer,
-			[]partition.Partition{m1, m2}, time.Unix(20, 0), time.Unix(70, 0))
+			[]partition.Partition{m1, m2}, time.Unix(0, 20), time.Unix(0, 70), partition.Filter{})
 		require.NoError(t, err)
 		buffer.Write([]byte("]"))
 		var records []*record.APIRecord
 		require.NoError(t, json.Unmarshal(buffer.Bytes(), &records))
 		require.Equal(t, []*record.APIRecord{
-			{EventTime: time.Unix(50, 0).Format(time.RFC3339)},
-			{EventTime: time.Unix(60, 0).Format(time.RFC3339)}},
+			{EventTime: time.Unix(0, 50).Format(time.RFC3339Nano)},
+			{EventTime: time.Unix(0, 60).Format(time.RFC3339Nano)}},
 			records)
 	})
 
@@ -56,13 +61,17 @@ func TestSelect(t *testing.T) {
 
 		m1.EXPECT().MaxTimestamp().Return(int64(50)).AnyTimes()
 		m1.EXPECT().MinTimestamp().Return(int64(10)).AnyTimes()
+		m1.EXPECT().Window().Return(int64(10), int64(51)).AnyTimes()
 		m2.EXPECT().MaxTimestamp().Return(int64(100)).AnyTimes()
 		m2.EXPECT().MinTimestamp().Return(int64(60)).AnyTimes()
+		m2.EXPECT().Window().Return(int64(60), int64(101)).AnyTimes()
+		m1.EXPECT().Schema().Return(nil).AnyTimes()
+		m2.EXPECT().Schema().Return(nil).AnyTimes()
 
 		buffer := bytes.Buffer{}
 		buffer.Write([]byte("["))
 		err := newHandler(nil).Select(&buffer,
-			[]partition.Partition{m1, m2}, time.Unix(0, 0), time.Unix(5, 0))
+			[]partition.Partition{m1, m2}, time.Unix(0, 0), time.Unix(0, 5), partition.Filter{})
 		require.NoError(t, err)
 		buffer.Write([]byte("]"))
 		var records []*record.APIRecord
@@ -79,13 +88,17 @@ func TestSelect(t *testing.T) {
 
 		m1.EXPECT().MaxTimestamp().Return(int64(50)).AnyTimes()
 		m1.EXPECT().MinTimestamp().Return(int64(10)).AnyTimes()
+		m1.EXPECT().Window().Return(int64(10), int64(51)).AnyTimes()
 		m2.EXPECT().MaxTimestamp().Return(int64(100)).AnyTimes()
 		m2.EXPECT().MinTimestamp().Return(int64(60)).AnyTimes()
+		m2.EXPECT().Window().Return(int64(60), int64(101)).AnyTimes()
+		m1.EXPECT().Schema().Return(nil).AnyTimes()
+		m2.EXPECT().Schema().Return(nil).AnyTimes()
 
 		buffer := bytes.Buffer{}
 		buffer.Write([]byte("["))
 		err := newHandler(nil).Select(&buffer,
-			[]partition.Partition{m1, m2}, time.Unix(200, 0), time.Unix(300, 0))
+			[]partition.Partition{m1, m2}, time.Unix(0, 200), time.Unix(0, 300), partition.Filter{})
 		require.NoError(t, err)
 		buffer.Write([]byte("]"))
 		var records []*record.APIRecord
@@ -102,8 +115,12 @@ func TestSelect(t *testing.T) {
 
 		m1.EXPECT().MaxTimestamp().Return(int64(50)).AnyTimes()
 		m1.EXPECT().MinTimestamp().Return(int64(10)).AnyTimes()
+		m1.EXPECT().Window().Return(int64(10), int64(51)).AnyTimes()
 		m2.EXPECT().MaxTimestamp().Return(int64(100)).AnyTimes()
 		m2.EXPECT().MinTimestamp().Return(int64(60)).AnyTimes()
+		m2.EXPECT().Window().Return(int64(60), int64(101)).AnyTimes()
+		m1.EXPECT().Schema().Return(nil).AnyTimes()
+		m2.EXPECT().Schema().Return(nil).AnyTimes()
 
 		m1.
 			EXPECT().
@@ -116,14 +133,115 @@ func TestSelect(t *testing.T) {
 		buffer := bytes.Buffer{}
 		buffer.Write([]byte("["))
 		err := newHandler(nil).Select(&buffer,
-			[]partition.Partition{m1, m2}, time.Unix(0, 0), time.Unix(70, 0))
+			[]partition.Partition{m1, m2}, time.Unix(0, 0), time.Unix(0, 70), partition.Filter{})
 		require.NoError(t, err)
 		buffer.Write([]byte("]"))
 		var records []*record.APIRecord
 		require.NoError(t, json.Unmarshal(buffer.Bytes(), &records))
 		require.Equal(t, []*record.APIRecord{
-			{EventTime: time.Unix(50, 0).Format(time.RFC3339)},
-			{EventTime: time.Unix(60, 0).Format(time.RFC3339)}},
+			{EventTime: time.Unix(0, 50).Format(time.RFC3339Nano)},
+			{EventTime: time.Unix(0, 60).Format(time.RFC3339Nano)}},
 		records)
 	})
+
+	t.Run("SelectCorrupt", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		m1 := mocks.NewMockPartition(ctrl)
+		m2 := mocks.NewMockPartition(ctrl)
+
+		m1.EXPECT().Window().Return(int64(10), int64(51)).AnyTimes()
+		m2.EXPECT().Window().Return(int64(60), int64(101)).AnyTimes()
+		m2.EXPECT().Schema().Return(nil).AnyTimes()
+
+		m1.
+			EXPECT().
+			SelectRecords(gomock.Eq(int64(20)), gomock.Eq(int64(70))).
+			Return(nil, fmt.Errorf("data checksum mismatch: %w", partition.ErrCorrupt))
+		m2.
+			EXPECT().
+			SelectRecords(gomock.Eq(int64(20)), gomock.Eq(int64(70))).
+			Return([]*record.InternalRecord{{Timestamp: 60}}, nil)
+		buffer := bytes.Buffer{}
+		buffer.Write([]byte("["))
+		err := newHandler(nil).Select(&buffer,
+			[]partition.Partition{m1, m2}, time.Unix(0, 20), time.Unix(0, 70), partition.Filter{})
+		require.NoError(t, err)
+		buffer.Write([]byte("]"))
+		var records []*record.APIRecord
+		require.NoError(t, json.Unmarshal(buffer.Bytes(), &records))
+		require.Equal(t, []*record.APIRecord{
+			{EventTime: time.Unix(0, 60).Format(time.RFC3339Nano)}},
+			records)
+	})
+
+	t.Run("SelectFilter", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		m1 := mocks.NewMockPartition(ctrl)
+		m2 := mocks.NewMockPartition(ctrl)
+
+		filter := partition.Filter{Email: "a@x.com"}
+		m1.EXPECT().Window().Return(int64(10), int64(51)).AnyTimes()
+		m1.EXPECT().MayContain(filter).Return(false)
+		m2.EXPECT().Window().Return(int64(60), int64(101)).AnyTimes()
+		m2.EXPECT().MayContain(filter).Return(true)
+		m2.EXPECT().Schema().Return(nil).AnyTimes()
+
+		m2.
+			EXPECT().
+			SelectRecords(gomock.Eq(int64(20)), gomock.Eq(int64(70))).
+			Return([]*record.InternalRecord{{Timestamp: 60, Email: "b@x.com"}, {Timestamp: 70, Email: "a@x.com"}}, nil)
+		buffer := bytes.Buffer{}
+		buffer.Write([]byte("["))
+		err := newHandler(nil).Select(&buffer,
+			[]partition.Partition{m1, m2}, time.Unix(0, 20), time.Unix(0, 70), filter)
+		require.NoError(t, err)
+		buffer.Write([]byte("]"))
+		var records []*record.APIRecord
+		require.NoError(t, json.Unmarshal(buffer.Bytes(), &records))
+		require.Equal(t, []*record.APIRecord{
+			{EventTime: time.Unix(0, 70).Format(time.RFC3339Nano), Email: "a@x.com"}},
+			records)
+	})
+}
+
+func TestSelectSchema(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	schema := &record.Schema{
+		Fields: []record.Field{
+			{Name: "email", Type: record.TypeString},
+			{Name: "country", Type: record.TypeString},
+			{Name: "status", Type: record.TypeInt},
+			{Name: "seen", Type: record.TypeTimestamp},
+		},
+	}
+	m := mocks.NewMockPartition(ctrl)
+	m.EXPECT().MaxTimestamp().Return(int64(60)).AnyTimes()
+	m.EXPECT().MinTimestamp().Return(int64(50)).AnyTimes()
+	m.EXPECT().Window().Return(int64(50), int64(61)).AnyTimes()
+	m.EXPECT().Schema().Return(schema).AnyTimes()
+	m.
+		EXPECT().
+		SelectRecords(gomock.Eq(int64(0)), gomock.Eq(int64(70))).
+		Return([]*record.InternalRecord{
+			{Timestamp: 50, Email: "a@x.com", Attrs: map[string]interface{}{"country": "nl", "status": int64(200)}},
+			{Timestamp: 60, Attrs: map[string]interface{}{"seen": int64(10)}},
+		}, nil)
+
+	buffer := bytes.Buffer{}
+	buffer.Write([]byte("["))
+	err := newHandler(nil).Select(&buffer, []partition.Partition{m}, time.Unix(0, 0), time.Unix(0, 70), partition.Filter{})
+	require.NoError(t, err)
+	buffer.Write([]byte("]"))
+	var records []map[string]interface{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &records))
+	require.Equal(t, []map[string]interface{}{
+		{"eventTime": time.Unix(0, 50).Format(time.RFC3339Nano), "email": "a@x.com", "country": "nl", "status": 200.0},
+		{"eventTime": time.Unix(0, 60).Format(time.RFC3339Nano), "seen": time.Unix(0, 10).Format(time.RFC3339Nano)},
+	}, records)
 }
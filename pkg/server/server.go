@@ -19,6 +19,11 @@ type Server struct {
 func NewServer(storage *storage.Storage) *Server{
 	router := mux.NewRouter()
 	router.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
+	router.Handle("/v1/files", newFilesHandler(storage)).Methods(http.MethodGet)
+	router.Handle("/v1/cache", newCacheHandler(storage)).Methods(http.MethodGet)
+	router.Handle("/v1/files/{name:.+}/rejects", newRejectsHandler(storage)).Methods(http.MethodGet)
+	router.Handle("/v1/files/{name:.+}/lookup", newLookupHandler(storage)).Methods(http.MethodGet)
+	router.Handle("/v1/datasets/{name}/records", newAppendHandler(storage)).Methods(http.MethodPost)
 	router.Handle("/", newHandler(storage))
 	return &Server{
 		httpServer: &http.Server{
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"github.com/ssfilatov/ts/pkg/cache"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"math"
+)
+
+// SelectRecords returns records of partition that are >= start and <= end
+//
+// With cache enabled records of partitions written to disk are decoded as a whole once and are shared
+// by queries until they are evicted or partition files are removed, returned records must not be modified.
+// Partitions which do not fit the cache budget are read by range using blocks and the offset index instead.
+func (s *Storage) SelectRecords(part partition.Partition, start, end int64) ([]*record.InternalRecord, error) {
+	if s.cache == nil || part.DataPath() == "" || !s.cache.Fits(part.DataPath(), part.Size()) {
+		return part.SelectRecords(start, end)
+	}
+	records, found := s.cache.Get(part.DataPath())
+	if !found {
+		// generation is taken before decoding, so that records of a partition removed meanwhile are not cached
+		generation := s.cache.Generation()
+		var err error
+		records, err = part.SelectRecords(math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		s.cache.Add(part.DataPath(), records, generation)
+	}
+	return partition.SelectRange(start, end, records), nil
+}
+
+// CacheStats returns stats of the cache of decoded partitions, stats are empty when the cache is disabled
+func (s *Storage) CacheStats() cache.Stats {
+	if s.cache == nil {
+		return cache.Stats{}
+	}
+	return s.cache.Stats()
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"github.com/ssfilatov/ts/pkg/cache"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSelectRecordsOversizedPartitions(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records, err := processor.ParseRecords(strings.NewReader(
+		"2026-01-01T00:00:00Z a@x.com s1\n" +
+		"2026-01-01T00:00:01Z b@x.com s2\n" +
+		"2026-01-01T00:00:02Z " + strings.Repeat("c", 64) + "@x.com s3\n"))
+	require.NoError(t, err)
+	partitions, err := processor.NewProcessorWithOptions(processor.Options{
+		PartitionSize: 2,
+		PartitionDirPath: dir,
+	}).WriteRecords(context.Background(), records, "oversized", 0)
+	require.NoError(t, err)
+	require.Len(t, partitions, 2)
+
+	// a budget of a single short record
+	s := &Storage{
+		cache: cache.NewCache(cache.Size(records[:1])),
+	}
+	for i := 0; i < 2; i++ {
+		// the first partition is too large to be cached by the number of records alone, so it is read by range
+		selected, err := s.SelectRecords(partitions[0], records[1].Timestamp, math.MaxInt64)
+		require.NoError(t, err)
+		require.Len(t, selected, 1)
+		require.Equal(t, "b@x.com", selected[0].Email)
+
+		// the second one is decoded once and turns out to be too large, so that it is read by range afterwards
+		selected, err = s.SelectRecords(partitions[1], math.MinInt64, math.MaxInt64)
+		require.NoError(t, err)
+		require.Len(t, selected, 1)
+	}
+	stats := s.CacheStats()
+	require.Equal(t, int64(1), stats.Misses)
+	require.Zero(t, stats.Entries)
+}
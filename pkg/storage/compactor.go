@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"log"
+	"time"
+)
+
+// Compact merges adjacent small partitions of ready files and datasets every interval until ctx is done
+//
+// Partitions are merged according to the partitioning strategy of a dataset, see processor.CompactionGroups.
+// Followed files are not compacted as their partitions are sealed by the follower.
+func (s *Storage) Compact(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// unmergeable remembers groups which did not make fewer partitions, so that they are not read again
+	unmergeable := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.compact(ctx, unmergeable)
+		}
+	}
+}
+
+func (s *Storage) compact(ctx context.Context, unmergeable map[string]bool) {
+	var merged, written int
+	for _, state := range s.FileStates() {
+		if ctx.Err() != nil {
+			return
+		}
+		if state.Status != StatusReady || state.busy {
+			continue
+		}
+		from, to, err := s.compactFile(ctx, state.Name, unmergeable)
+		if err != nil {
+			log.Printf("error compacting %s: %v", state.Name, err)
+			continue
+		}
+		merged += from
+		written += to
+	}
+	if merged > 0 {
+		log.Printf("compacted %d partitions into %d", merged, written)
+	}
+}
+
+// compactFile replaces groups of adjacent partitions of a file or dataset with merged ones and returns
+// numbers of partitions merged and written
+//
+// Merged partitions are written next to the source ones and are listed in catalog before they are published
+// at once, queries which are running keep reading source partitions. Source partitions are closed and removed
+// afterwards, they are unmapped once the queries release them.
+func (s *Storage) compactFile(ctx context.Context, name string, unmergeable map[string]bool) (int, int, error) {
+	state, found := s.GetFileState(name)
+	if !found {
+		return 0, 0, nil
+	}
+	// writers of the file are held off while it is compacted
+	if state.appendable {
+		s.appendMu.Lock()
+		defer s.appendMu.Unlock()
+	} else {
+		owner := name
+		if state.parent != "" {
+			owner = state.parent
+		}
+		if !s.acquire(owner) {
+			return 0, 0, nil
+		}
+		defer s.release(owner)
+	}
+
+	state, found = s.GetFileState(name)
+	entry, listed := s.catalog.Get(name)
+	if !found || !listed || state.Status != StatusReady || entry.Followed ||
+		len(entry.Partitions) != len(state.Partitions) {
+		return 0, 0, nil
+	}
+	for i, part := range state.Partitions {
+		if part.DataPath() != entry.Partitions[i].DataPath {
+			return 0, 0, nil
+		}
+	}
+
+	var fileProcessor *processor.Processor
+	var err error
+	prefix := fmt.Sprintf("%s-%d", name, entry.Generation)
+	if state.appendable {
+		fileProcessor, err = s.datasetProcessor(name)
+	} else {
+		fileProcessor, err = s.processorFor(name)
+		prefix = fmt.Sprintf("%s-%d", diskName(name), entry.Generation)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	nextIndex := entry.NextIndex
+	if nextIndex < len(entry.Partitions) {
+		nextIndex = len(entry.Partitions)
+	}
+	partitions := make([]partition.Partition, 0, len(state.Partitions))
+	files := make([]catalog.PartitionFiles, 0, len(entry.Partitions))
+	written := &catalog.Entry{}
+	replaced := &catalog.Entry{}
+	mergedPartitions := make([]partition.Partition, 0)
+	discard := func() {
+		closeReplaced(mergedPartitions, nil)
+		s.removePartitionFiles(written)
+	}
+	var last int
+	for _, group := range fileProcessor.CompactionGroups(state.Partitions) {
+		key := state.Partitions[group[0]].DataPath() + ":" + state.Partitions[group[1] - 1].DataPath()
+		if unmergeable[key] {
+			continue
+		}
+		merged, err := fileProcessor.Compact(ctx, state.Partitions[group[0]:group[1]], prefix, nextIndex)
+		if err != nil {
+			discard()
+			return 0, 0, err
+		}
+		if merged == nil {
+			unmergeable[key] = true
+			continue
+		}
+		nextIndex += len(merged)
+		partitions = append(partitions, state.Partitions[last:group[0]]...)
+		files = append(files, entry.Partitions[last:group[0]]...)
+		for _, part := range merged {
+			partitions = append(partitions, part)
+			mergedPartitions = append(mergedPartitions, part)
+			files = append(files, partitionFiles(part))
+			written.Partitions = append(written.Partitions, partitionFiles(part))
+		}
+		replaced.Partitions = append(replaced.Partitions, entry.Partitions[group[0]:group[1]]...)
+		last = group[1]
+	}
+	if len(written.Partitions) == 0 {
+		return 0, 0, nil
+	}
+	partitions = append(partitions, state.Partitions[last:]...)
+	files = append(files, entry.Partitions[last:]...)
+
+	compacted := entry.Copy()
+	compacted.Partitions = files
+	compacted.NextIndex = nextIndex
+	postings, writtenPostings, obsolete, err := s.updatePostings(fileProcessor, prefix, compacted, partitions,
+		state.postings, false)
+	if err != nil {
+		log.Printf("error indexing %s: %v", name, err)
+	}
+	written.Postings = writtenPostings
+	s.catalog.Set(name, compacted)
+	if err := s.catalog.Save(); err != nil {
+		s.catalog.Set(name, entry)
+		discard()
+		return 0, 0, fmt.Errorf("error saving catalog: %v", err)
+	}
+	s.mu.Lock()
+	if current, found := s.files[name]; found {
+		current.Partitions = partitions
+		current.postings = postings
+	}
+	s.mu.Unlock()
+	closeReplaced(state.Partitions, partitions)
+	replaced.Postings = obsolete
+	s.removePartitionFiles(replaced)
+	return len(replaced.Partitions), len(written.Partitions), nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompactDataset(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := catalog.Load(filepath.Join(dir, catalogFileName))
+	require.NoError(t, err)
+	s := &Storage{
+		files: map[string]*FileState{},
+		catalog: c,
+		dirConfig: &processor.DirConfig{},
+		processor: processor.NewProcessorWithOptions(processor.Options{
+			PartitionSize: 4,
+			PartitionDirPath: dir,
+			Index: true,
+		}),
+	}
+	appendRecord := func(i int) {
+		_, err := s.Append(context.Background(), "ds", []*record.InternalRecord{{
+			Timestamp: int64(i),
+			Email: fmt.Sprintf("user%d@x.com", i % 2),
+			SessionID: "s",
+		}})
+		require.NoError(t, err)
+	}
+	readAll := func(partitions []partition.Partition) []int64 {
+		timestamps := make([]int64, 0)
+		for _, part := range partitions {
+			records, err := part.SelectRecords(math.MinInt64, math.MaxInt64)
+			require.NoError(t, err)
+			for _, r := range records {
+				timestamps = append(timestamps, r.Timestamp)
+			}
+		}
+		return timestamps
+	}
+	for i := 0; i < 6; i++ {
+		appendRecord(i)
+	}
+	// a query running during compaction holds partitions it has acquired
+	state, _ := s.AcquireFileState("ds")
+	before := state.Partitions
+	require.Len(t, before, 6)
+
+	unmergeable := map[string]bool{}
+	merged, written, err := s.compactFile(context.Background(), "ds", unmergeable)
+	require.NoError(t, err)
+	require.Equal(t, 6, merged)
+	require.Equal(t, 2, written)
+	after, _ := s.GetPartitionsByFilename("ds")
+	require.Len(t, after, 2)
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5}, readAll(after))
+	// partitions taken before compaction stay readable
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5}, readAll(before))
+	for _, part := range before {
+		_, err := os.Stat(part.DataPath())
+		require.True(t, os.IsNotExist(err))
+	}
+	ReleasePartitions(before)
+	_, err = before[0].SelectRecords(math.MinInt64, math.MaxInt64)
+	require.ErrorIs(t, err, partition.ErrClosed)
+	found, err := s.LookupRecords(after[0], partition.Filter{Email: "user1@x.com"})
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+
+	merged, _, err = s.compactFile(context.Background(), "ds", unmergeable)
+	require.NoError(t, err)
+	require.Zero(t, merged)
+
+	appendRecord(6)
+	c, err = catalog.Load(filepath.Join(dir, catalogFileName))
+	require.NoError(t, err)
+	entry, _ := c.Get("ds")
+	require.Len(t, entry.Partitions, 3)
+	for _, files := range entry.Partitions {
+		_, err := os.Stat(files.DataPath)
+		require.NoError(t, err)
+	}
+	all, _ := s.GetPartitionsByFilename("ds")
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6}, readAll(all))
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"github.com/ssfilatov/ts/pkg/record"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrLateData is returned by Append for records older than the data already stored in a dataset
+	ErrLateData = errors.New("records are older than the dataset's sealed range")
+	// ErrNotDataset is returned by Append for names which belong to files from data dir
+	ErrNotDataset = errors.New("name belongs to a file, not to a dataset")
+	ErrInvalidName = errors.New("invalid dataset name")
+)
+
+// openDatasets publishes datasets stored in the catalog, they have no source file to be ingested from
+func (s *Storage) openDatasets() {
+	for _, name := range s.catalog.Names() {
+		entry, _ := s.catalog.Get(name)
+		if !entry.Appended {
+			continue
+		}
+		state := &FileState{
+			Name: name,
+			Status: StatusReady,
+			appendable: true,
+		}
+		partitionList, err := reopenPartitions(entry, true)
+		if err != nil {
+			log.Printf("error reopening dataset %s: %v", name, err)
+			state.Status = StatusFailed
+			state.Err = err
+		}
+		state.Partitions = partitionList
+		state.postings = s.openPostings(entry)
+		s.files[name] = state
+	}
+}
+
+// Append writes records to a dataset, creating it if needed, and returns once the records are durable
+//
+// Records are sorted by timestamp before writing. Records older than the latest stored record are rejected
+// with ErrLateData unless late data is allowed, in which case partitions overlapping with the records are
+// merged with them and written again. Nothing is stored if ctx is done before all partitions are written.
+// With dedup enabled exact duplicates of each other and of stored records within dedup window of the latest one
+// are dropped before the check for late data, so that batches delivered again are not rejected,
+// number of dropped records is returned.
+func (s *Storage) Append(ctx context.Context, name string, records []*record.InternalRecord) (int64, error) {
+	if name == "" || strings.ContainsAny(name, "/") || strings.HasPrefix(name, ".") {
+		return 0, ErrInvalidName
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+
+	state, found := s.GetFileState(name)
+	if found && !state.appendable {
+		return 0, ErrNotDataset
+	}
+	if found && state.Status == StatusFailed {
+		return 0, fmt.Errorf("dataset %s is failed: %v", name, state.Err)
+	}
+	entry := &catalog.Entry{
+		Appended: true,
+	}
+	prevEntry, hasEntry := s.catalog.Get(name)
+	if hasEntry && found {
+		entry = prevEntry.Copy()
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp < records[j].Timestamp
+	})
+	partitions := state.Partitions
+	datasetProcessor, err := s.datasetProcessor(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var duplicates int64
+	if s.dedupWindow > 0 {
+		var seed []*record.InternalRecord
+		if len(partitions) > 0 {
+			seedStart := partitions[len(partitions) - 1].MaxTimestamp() - int64(s.dedupWindow)
+			if records[0].Timestamp > seedStart {
+				seedStart = records[0].Timestamp
+			}
+			if seed, err = recentRecords(partitions, seedStart); err != nil {
+				return 0, err
+			}
+		}
+		records, duplicates = datasetProcessor.WithDedupSeed(seed).DropDuplicates(records)
+		if len(records) == 0 {
+			return duplicates, nil
+		}
+	}
+
+	keep := len(partitions)
+	if keep > 0 && records[0].Timestamp < partitions[keep - 1].MaxTimestamp() {
+		if !s.allowLateData {
+			return 0, ErrLateData
+		}
+		keep = sort.Search(len(partitions), func(i int) bool {
+			return partitions[i].MaxTimestamp() > records[0].Timestamp
+		})
+		merged, err := mergeRecords(partitions[keep:], records)
+		if err != nil {
+			return 0, err
+		}
+		records = merged
+	}
+
+	prefix := fmt.Sprintf("%s-%d", name, entry.Generation)
+	written, err := datasetProcessor.WriteRecords(ctx, records, prefix, entry.NextIndex)
+	if err != nil {
+		return 0, fmt.Errorf("error writing records: %v", err)
+	}
+	replaced := &catalog.Entry{
+		Partitions: entry.Partitions[keep:],
+	}
+	entry.NextIndex += len(written)
+	entry.Partitions = entry.Partitions[:keep:keep]
+	for _, part := range written {
+		entry.Partitions = append(entry.Partitions, partitionFiles(part))
+	}
+	partitionList := append(partitions[:keep:keep], written...)
+	postings, writtenPostings, obsolete, err := s.updatePostings(datasetProcessor, prefix, entry, partitionList,
+		state.postings, false)
+	if err != nil {
+		log.Printf("error indexing %s: %v", name, err)
+	}
+	s.catalog.Set(name, entry)
+	if err := s.catalog.Save(); err != nil {
+		if hasEntry {
+			s.catalog.Set(name, prevEntry)
+		} else {
+			s.catalog.Delete(name)
+		}
+		closeReplaced(written, nil)
+		s.removePartitionFiles(&catalog.Entry{Partitions: entry.Partitions[keep:], Postings: writtenPostings})
+		return 0, fmt.Errorf("error saving catalog: %v", err)
+	}
+
+	s.mu.Lock()
+	if !found {
+		s.files[name] = &FileState{
+			Name: name,
+			Status: StatusReady,
+			appendable: true,
+		}
+	}
+	s.files[name].Partitions = partitionList
+	s.files[name].postings = postings
+	s.mu.Unlock()
+	closeReplaced(partitions[keep:], nil)
+
+	replaced.Postings = obsolete
+	s.removePartitionFiles(replaced)
+	return duplicates, nil
+}
+
+// datasetProcessor returns processor writing partitions of an appended dataset,
+// appended records have the default schema, only partitioning is taken from dir config
+func (s *Storage) datasetProcessor(name string) (*processor.Processor, error) {
+	return s.processor.ForDataset(processor.DatasetConfig{
+		Partitioning: s.dirConfig.Lookup(name).Partitioning,
+	})
+}
+
+// mergeRecords merges records of partitions with sorted records, stored records go first on equal timestamps
+func mergeRecords(partitions []partition.Partition, records []*record.InternalRecord) ([]*record.InternalRecord, error) {
+	stored := make([]*record.InternalRecord, 0)
+	for _, part := range partitions {
+		partitionRecords, err := part.SelectRecords(math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, fmt.Errorf("error reading partition: %v", err)
+		}
+		stored = append(stored, partitionRecords...)
+	}
+
+	merged := make([]*record.InternalRecord, 0, len(stored) + len(records))
+	var i, j int
+	for i < len(stored) && j < len(records) {
+		if records[j].Timestamp < stored[i].Timestamp {
+			merged = append(merged, records[j])
+			j++
+		} else {
+			merged = append(merged, stored[i])
+			i++
+		}
+	}
+	merged = append(merged, stored[i:]...)
+	return append(merged, records[j:]...), nil
+}
+
+// recentRecords returns stored records of partitions with timestamps starting with start
+func recentRecords(partitions []partition.Partition, start int64) ([]*record.InternalRecord, error) {
+	first := sort.Search(len(partitions), func(i int) bool {
+		return partitions[i].MaxTimestamp() >= start
+	})
+	recent := make([]*record.InternalRecord, 0)
+	for _, part := range partitions[first:] {
+		partitionRecords, err := part.SelectRecords(start, math.MaxInt64)
+		if err != nil {
+			return nil, fmt.Errorf("error reading partition: %v", err)
+		}
+		recent = append(recent, partitionRecords...)
+	}
+	return recent, nil
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+// datasetRecords returns records with the given timestamps
+func datasetRecords(timestamps ...int64) []*record.InternalRecord {
+	records := make([]*record.InternalRecord, 0, len(timestamps))
+	for _, ts := range timestamps {
+		records = append(records, &record.InternalRecord{Timestamp: ts, Email: "a@x.com", SessionID: "s1"})
+	}
+	return records
+}
+
+// datasetStorage returns storage over a data dir holding the given files
+func datasetStorage(t *testing.T, files map[string]string) (*Storage, Config) {
+	cfg := Config{
+		PartitionSize: 2,
+		Dir: inTempDir(t),
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(buildPath(cfg.Dir, name), []byte(data), 0644))
+	}
+	s, err := NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	require.NoError(t, s.Ingest(context.Background()))
+	return s, cfg
+}
+
+func TestAppendLateData(t *testing.T) {
+	s, _ := datasetStorage(t, nil)
+	_, err := s.Append(context.Background(), "ds", datasetRecords(5, 0, 4, 1, 2, 3))
+	require.NoError(t, err)
+	partitions, _ := s.GetPartitionsByFilename("ds")
+	require.Len(t, partitions, 3)
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5}, readTimestamps(t, partitions))
+
+	// records older than the latest stored one are rejected and nothing is written
+	_, err = s.Append(context.Background(), "ds", datasetRecords(3, 6))
+	require.ErrorIs(t, err, ErrLateData)
+	stored, _ := s.GetPartitionsByFilename("ds")
+	require.Equal(t, dataPaths(partitions), dataPaths(stored))
+	require.Len(t, partitionFileNames(t, "ds"), 6)
+
+	// with late data allowed partitions overlapping with the records are merged with them and written again
+	s.allowLateData = true
+	_, err = s.Append(context.Background(), "ds", datasetRecords(3, 6))
+	require.NoError(t, err)
+	merged, _ := s.GetPartitionsByFilename("ds")
+	require.Equal(t, []int64{0, 1, 2, 3, 3, 4, 5, 6}, readTimestamps(t, merged))
+	require.Equal(t, dataPaths(partitions[:2]), dataPaths(merged[:2]))
+	_, err = os.Stat(partitions[2].DataPath())
+	require.True(t, os.IsNotExist(err))
+	entry, _ := s.catalog.Get("ds")
+	require.Len(t, entry.Partitions, len(merged))
+	require.Len(t, partitionFileNames(t, "ds"), 2 * len(merged))
+}
+
+func TestAppendInvalidName(t *testing.T) {
+	s, _ := datasetStorage(t, map[string]string{"a.txt": lines(0, 1)})
+	for _, name := range []string{"", "a/b", ".ds", "..", "../ds"} {
+		_, err := s.Append(context.Background(), name, datasetRecords(1))
+		require.ErrorIs(t, err, ErrInvalidName, name)
+	}
+	// names of files from data dir are not datasets
+	_, err := s.Append(context.Background(), "a.txt", datasetRecords(1))
+	require.ErrorIs(t, err, ErrNotDataset)
+}
+
+func TestAppendCatalogFailure(t *testing.T) {
+	s, _ := datasetStorage(t, nil)
+	_, err := s.Append(context.Background(), "ds", datasetRecords(0, 1))
+	require.NoError(t, err)
+	prevEntry, _ := s.catalog.Get("ds")
+	partitions, _ := s.GetPartitionsByFilename("ds")
+
+	// a non-empty dir in place of the catalog is not replaced by rename, so that saving the catalog fails
+	catalogPath := buildPath(partitionDir, catalogFileName)
+	require.NoError(t, os.Remove(catalogPath))
+	require.NoError(t, os.MkdirAll(buildPath(catalogPath, "dir"), os.ModePerm))
+	_, err = s.Append(context.Background(), "ds", datasetRecords(2, 3))
+	require.Error(t, err)
+	_, err = s.Append(context.Background(), "new", datasetRecords(2, 3))
+	require.Error(t, err)
+
+	// the previous state is kept and partitions written by failed appends are removed
+	entry, _ := s.catalog.Get("ds")
+	require.Equal(t, prevEntry, entry)
+	_, found := s.catalog.Get("new")
+	require.False(t, found)
+	_, found = s.GetFileState("new")
+	require.False(t, found)
+	stored, _ := s.GetPartitionsByFilename("ds")
+	require.Equal(t, dataPaths(partitions), dataPaths(stored))
+	require.Equal(t, []int64{0, 1}, readTimestamps(t, stored))
+	require.Len(t, partitionFileNames(t, "ds"), 2)
+	require.Empty(t, partitionFileNames(t, "new"))
+}
+
+func TestAppendReopen(t *testing.T) {
+	s, cfg := datasetStorage(t, nil)
+	_, err := s.Append(context.Background(), "ds", datasetRecords(0, 1, 2))
+	require.NoError(t, err)
+	s.Close()
+
+	// datasets have no source file, they are opened from catalog
+	s, err = NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Ingest(context.Background()))
+	state, found := s.GetFileState("ds")
+	require.True(t, found)
+	require.Equal(t, StatusReady, state.Status)
+	require.Equal(t, []int64{0, 1, 2}, readTimestamps(t, state.Partitions))
+	_, err = s.Append(context.Background(), "ds", datasetRecords(3))
+	require.NoError(t, err)
+	partitions, _ := s.GetPartitionsByFilename("ds")
+	require.Equal(t, []int64{0, 1, 2, 3}, readTimestamps(t, partitions))
+
+	c, err := catalog.Load(buildPath(partitionDir, catalogFileName))
+	require.NoError(t, err)
+	entry, found := c.Get("ds")
+	require.True(t, found)
+	require.True(t, entry.Appended)
+	require.Len(t, entry.Partitions, len(partitions))
+}
+
+func TestAppendDedup(t *testing.T) {
+	s, err := NewStorage(context.Background(), Config{
+		PartitionSize: 2,
+		Dir: inTempDir(t),
+		DedupWindow: 3,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Append(context.Background(), "ds", datasetRecords(0, 1, 2, 3, 4, 5))
+	require.NoError(t, err)
+	partitions, _ := s.GetPartitionsByFilename("ds")
+
+	// a batch delivered again is dropped against the stored tail instead of being rejected as late
+	duplicates, err := s.Append(context.Background(), "ds", datasetRecords(3, 4, 5))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), duplicates)
+	stored, _ := s.GetPartitionsByFilename("ds")
+	require.Equal(t, dataPaths(partitions), dataPaths(stored))
+
+	duplicates, err = s.Append(context.Background(), "ds", datasetRecords(5, 6, 6))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), duplicates)
+	stored, _ = s.GetPartitionsByFilename("ds")
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6}, readTimestamps(t, stored))
+
+	// stored records older than the window are not looked at
+	_, err = s.Append(context.Background(), "ds", datasetRecords(1, 7))
+	require.ErrorIs(t, err, ErrLateData)
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/record"
+	"log"
+	"math"
+)
+
+// Lookup calls visit with records matching non-empty filter of each partition of state holding any,
+// partitions are visited in order and records are sorted by timestamp regardless of time range
+//
+// Postings files of the dataset point to partitions and positions of matching records at once, they are mapped
+// once they are opened. Partitions which are not covered by readable postings files or which positions are out
+// of them are looked up one by one. Only records at the positions are read, corrupt partitions are skipped.
+// Partitions of state should be acquired by the caller.
+func (s *Storage) Lookup(state FileState, filter partition.Filter,
+	visit func(part partition.Partition, records []*record.InternalRecord) error) error {
+
+	found := map[string][]int{}
+	files := make([]postingsFile, 0, len(state.postings))
+	for _, file := range state.postings {
+		refs, err := s.lookupPostings(file.path, filter)
+		if err != nil {
+			// files replaced since state was taken are removed, their partitions are looked up one by one as well
+			log.Printf("error looking up postings file, looking up partitions instead: %v", err)
+			continue
+		}
+		files = append(files, file)
+		for _, ref := range refs {
+			for _, pos := range ref.Positions {
+				found[ref.Partition] = append(found[ref.Partition], int(pos))
+			}
+		}
+	}
+	for _, part := range state.Partitions {
+		var records []*record.InternalRecord
+		var err error
+		if covers(files, part.DataPath()) {
+			records, err = part.RecordsAt(found[part.DataPath()])
+			if err != nil && !errors.Is(err, partition.ErrCorrupt) {
+				log.Printf("error reading records found by postings, looking up partition instead: %v", err)
+				records, err = s.LookupRecords(part, filter)
+			}
+		} else {
+			records, err = s.LookupRecords(part, filter)
+		}
+		if errors.Is(err, partition.ErrCorrupt) {
+			log.Printf("skipping partition: %v", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error looking up %s: %v", part.DataPath(), err)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if err := visit(part, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) lookupPostings(path string, filter partition.Filter) ([]partition.IndexRef, error) {
+	index, err := s.postings.acquire(path)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Release()
+	return index.Lookup(filter)
+}
+
+// LookupRecords returns records of partition matching non-empty filter sorted by timestamp regardless of time range
+//
+// Positions of matching records are taken from partition index and only records at the positions are read.
+// Partitions without index or with an unreadable one are scanned, through the cache if it is enabled.
+func (s *Storage) LookupRecords(part partition.Partition, filter partition.Filter) ([]*record.InternalRecord, error) {
+	positions, err := part.Lookup(filter)
+	if err != nil {
+		if !errors.Is(err, partition.ErrNoIndex) {
+			log.Printf("error looking up partition, scanning it: %v", err)
+		}
+		return s.scanRecords(part, filter)
+	}
+	return part.RecordsAt(positions)
+}
+
+func (s *Storage) scanRecords(part partition.Partition, filter partition.Filter) ([]*record.InternalRecord, error) {
+	if !part.MayContain(filter) {
+		return nil, nil
+	}
+	partitionRecords, err := s.SelectRecords(part, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*record.InternalRecord, 0)
+	for _, r := range partitionRecords {
+		if filter.Match(r) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
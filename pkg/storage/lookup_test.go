@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/cache"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"github.com/ssfilatov/ts/pkg/record"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupRecords(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	records, err := processor.ParseRecords(strings.NewReader(
+		"2026-01-01T00:00:00Z a@x.com s1\n" +
+		"2026-01-01T00:00:01Z b@x.com s2\n" +
+		"2026-01-01T00:00:02Z a@x.com s3\n" +
+		"2026-01-01T00:00:03Z b@x.com s2\n" +
+		"2026-01-01T00:00:04Z b@x.com s2\n" +
+		"2026-01-01T00:00:05Z a@x.com s1\n"))
+	require.NoError(t, err)
+	write := func(prefix string, index bool) []partition.Partition {
+		partitions, err := processor.NewProcessorWithOptions(processor.Options{
+			PartitionSize: 2,
+			PartitionDirPath: dir,
+			Index: index,
+		}).WriteRecords(context.Background(), records, prefix, 0)
+		require.NoError(t, err)
+		return partitions
+	}
+
+	s := &Storage{
+		cache: cache.NewCache(1 << 20),
+	}
+	lookup := func(partitions []partition.Partition, f partition.Filter) []int64 {
+		timestamps := make([]int64, 0)
+		for _, part := range partitions {
+			found, err := s.LookupRecords(part, f)
+			require.NoError(t, err)
+			for _, r := range found {
+				require.True(t, f.Match(r))
+				timestamps = append(timestamps, r.Timestamp)
+			}
+		}
+		return timestamps
+	}
+	indexed, unindexed := write("indexed", true), write("unindexed", false)
+	for _, part := range indexed {
+		require.NotEmpty(t, part.IndexPath())
+	}
+	for _, f := range []partition.Filter{{Email: "a@x.com"}, {SessionID: "s2"}, {Email: "b@x.com", SessionID: "s2"}} {
+		expected := make([]int64, 0)
+		for _, r := range records {
+			if f.Match(r) {
+				expected = append(expected, r.Timestamp)
+			}
+		}
+		require.Equal(t, expected, lookup(indexed, f))
+		require.Equal(t, expected, lookup(unindexed, f))
+	}
+	require.Empty(t, lookup(indexed, partition.Filter{Email: "c@x.com"}))
+
+	mem := partition.NewMemPartition(records, nil)
+	found, err := s.LookupRecords(mem, partition.Filter{SessionID: "s1"})
+	require.NoError(t, err)
+	require.Equal(t, []*record.InternalRecord{records[0], records[5]}, found)
+}
+
+// lookupTimestamps returns timestamps of records of the file matching filter found through its postings files
+func lookupTimestamps(t *testing.T, s *Storage, name string, f partition.Filter) []int64 {
+	state, found := s.AcquireFileState(name)
+	require.True(t, found)
+	defer ReleasePartitions(state.Partitions)
+	timestamps := make([]int64, 0)
+	require.NoError(t, s.Lookup(state, f, func(part partition.Partition, records []*record.InternalRecord) error {
+		for _, r := range records {
+			require.True(t, f.Match(r))
+			timestamps = append(timestamps, r.Timestamp)
+		}
+		return nil
+	}))
+	return timestamps
+}
+
+func indexPartitions(t *testing.T, path string) []string {
+	index, err := partition.OpenIndex(path)
+	require.NoError(t, err)
+	defer index.Close()
+	return index.Partitions()
+}
+
+func TestLookupDataset(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := catalog.Load(filepath.Join(dir, catalogFileName))
+	require.NoError(t, err)
+	s := &Storage{
+		files: map[string]*FileState{},
+		catalog: c,
+		dirConfig: &processor.DirConfig{},
+		processor: processor.NewProcessorWithOptions(processor.Options{
+			PartitionSize: 1,
+			PartitionDirPath: dir,
+			Index: true,
+		}),
+	}
+	const n = 40
+	for i := 0; i < n; i++ {
+		_, err := s.Append(context.Background(), "ds", []*record.InternalRecord{{
+			Timestamp: int64(i),
+			Email: fmt.Sprintf("user%d@x.com", i % 3),
+			SessionID: fmt.Sprintf("s%d", i % 5),
+		}})
+		require.NoError(t, err)
+	}
+	// batches of 16 partitions are indexed and merged, the last partitions are looked up one by one
+	entry, _ := s.catalog.Get("ds")
+	require.Len(t, entry.Partitions, n)
+	require.Len(t, entry.Postings, 1)
+	require.Len(t, indexPartitions(t, entry.Postings[0]), 2 * postingsBatch)
+	postings, err := filepath.Glob(filepath.Join(dir, "*-" + partition.PostingsFileName + "-*"))
+	require.NoError(t, err)
+	require.Equal(t, entry.Postings, postings)
+
+	for _, f := range []partition.Filter{{Email: "user1@x.com"}, {SessionID: "s2"}, {Email: "user2@x.com", SessionID: "s2"},
+		{Email: "user9@x.com"}} {
+
+		expected := make([]int64, 0)
+		for i := 0; i < n; i++ {
+			if f.Match(&record.InternalRecord{Email: fmt.Sprintf("user%d@x.com", i % 3), SessionID: fmt.Sprintf("s%d", i % 5)}) {
+				expected = append(expected, int64(i))
+			}
+		}
+		require.Equal(t, expected, lookupTimestamps(t, s, "ds", f), f)
+	}
+
+	// postings of partitions which are replaced by late data are dropped
+	s.allowLateData = true
+	_, err = s.Append(context.Background(), "ds", []*record.InternalRecord{{
+		Timestamp: 5,
+		Email: "user1@x.com",
+		SessionID: "s0",
+	}})
+	require.NoError(t, err)
+	entry, _ = s.catalog.Get("ds")
+	require.Len(t, entry.Postings, 1)
+	require.Len(t, indexPartitions(t, entry.Postings[0]), n + 1)
+	require.Equal(t, []int64{1, 4, 5, 7, 10, 13, 16, 19, 22, 25, 28, 31, 34, 37},
+		lookupTimestamps(t, s, "ds", partition.Filter{Email: "user1@x.com"}))
+	postings, err = filepath.Glob(filepath.Join(dir, "*-" + partition.PostingsFileName + "-*"))
+	require.NoError(t, err)
+	require.Equal(t, entry.Postings, postings)
+}
+
+func TestLookupIngested(t *testing.T) {
+	dir := inTempDir(t)
+	require.NoError(t, os.WriteFile(buildPath(dir, "a.txt"), []byte(lines(0, 40)), 0644))
+	cfg := Config{
+		PartitionSize: 2,
+		Dir: dir,
+		Index: true,
+	}
+	s, err := NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	// partitions of an ingested file are indexed by a single postings file
+	entry, _ := s.catalog.Get("a.txt")
+	require.Len(t, entry.Postings, 1)
+	require.Equal(t, []int64{time.Date(2001, 7, 8, 0, 0, 7, 0, time.UTC).UnixNano()},
+		lookupTimestamps(t, s, "a.txt", partition.Filter{Email: "user7@x.com"}))
+	s.Close()
+
+	s, err = NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	defer s.Close()
+	state, _ := s.GetFileState("a.txt")
+	require.Len(t, state.postings, 1)
+	require.Equal(t, []int64{time.Date(2001, 7, 8, 0, 0, 33, 0, time.UTC).UnixNano()},
+		lookupTimestamps(t, s, "a.txt", partition.Filter{SessionID: "s33"}))
+}
+
+func TestLookupBrokenPostings(t *testing.T) {
+	dir := inTempDir(t)
+	require.NoError(t, os.WriteFile(buildPath(dir, "a.txt"), []byte(lines(0, 40)), 0644))
+	cfg := Config{
+		PartitionSize: 2,
+		Dir: dir,
+		Index: true,
+	}
+	s, err := NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	entry, _ := s.catalog.Get("a.txt")
+	require.Len(t, entry.Postings, 1)
+	expected := []int64{time.Date(2001, 7, 8, 0, 0, 7, 0, time.UTC).UnixNano()}
+
+	// corrupt postings file is not opened, partitions are looked up by their own index files
+	data, err := os.ReadFile(entry.Postings[0])
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, os.WriteFile(entry.Postings[0], data, 0644))
+	require.Equal(t, expected, lookupTimestamps(t, s, "a.txt", partition.Filter{Email: "user7@x.com"}))
+	s.Close()
+	s, err = NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	state, _ := s.GetFileState("a.txt")
+	require.Empty(t, state.postings)
+	require.Equal(t, expected, lookupTimestamps(t, s, "a.txt", partition.Filter{Email: "user7@x.com"}))
+	s.Close()
+
+	// positions out of partition found by a postings file with a valid checksum are not read
+	records := make([]*record.InternalRecord, 5)
+	for i := range records {
+		records[i] = &record.InternalRecord{Timestamp: int64(i), Email: "user7@x.com", SessionID: "s7"}
+	}
+	data, err = partition.EncodeIndex(entry.Partitions[3].DataPath, records)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(entry.Postings[0], data, 0644))
+	s, err = NewStorage(context.Background(), cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	defer s.Close()
+	state, _ = s.GetFileState("a.txt")
+	require.Len(t, state.postings, 1)
+	require.Equal(t, expected, lookupTimestamps(t, s, "a.txt", partition.Filter{Email: "user7@x.com"}))
+}
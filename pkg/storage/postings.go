@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"log"
+	"os"
+	"sync"
+)
+
+// postingsBatch is a number of partitions of a dataset missing in its postings files which are indexed at once,
+// partitions which are not covered by postings files yet are looked up by their own index files
+const postingsBatch = 16
+
+// postingsFile is a postings file of a dataset along with data paths of partitions covered by it
+type postingsFile struct {
+	path string
+	covered map[string]bool
+}
+
+func newPostingsFile(path string, covered []string) postingsFile {
+	file := postingsFile{
+		path: path,
+		covered: make(map[string]bool, len(covered)),
+	}
+	for _, dataPath := range covered {
+		file.covered[dataPath] = true
+	}
+	return file
+}
+
+// live returns number of covered partitions which are among indexed ones
+func (f postingsFile) live(indexed map[string]bool) int {
+	var n int
+	for dataPath := range f.covered {
+		if indexed[dataPath] {
+			n++
+		}
+	}
+	return n
+}
+
+func covers(files []postingsFile, dataPath string) bool {
+	for _, file := range files {
+		if file.covered[dataPath] {
+			return true
+		}
+	}
+	return false
+}
+
+// openPostings opens postings files listed in entry, files which fail verification are skipped,
+// so that their partitions are looked up one by one until they are indexed again
+func (s *Storage) openPostings(entry *catalog.Entry) []postingsFile {
+	files := make([]postingsFile, 0, len(entry.Postings))
+	for _, path := range entry.Postings {
+		index, err := s.postings.acquire(path)
+		if err != nil {
+			log.Printf("error opening postings file: %v", err)
+			continue
+		}
+		files = append(files, newPostingsFile(path, index.Partitions()))
+		index.Release()
+	}
+	return files
+}
+
+// updatePostings indexes partitions of a dataset which are not covered by its postings files once there are
+// postingsBatch of them, or any number of them if all is set, and lists postings files in entry
+//
+// The latest postings files are merged while the last one covers at least half as many partitions as the one
+// before it, so that a dataset has a logarithmic number of postings files. Postings of partitions which are
+// replaced are dropped as files are merged, files covering no partitions are dropped at once. Paths of written
+// files and of files which are no longer listed are returned: the former should be removed if entry is not stored,
+// the latter once it is. Files written by a failed update are removed and files are returned as is.
+func (s *Storage) updatePostings(p *processor.Processor, prefix string, entry *catalog.Entry,
+	partitions []partition.Partition, files []postingsFile, all bool) ([]postingsFile, []string, []string, error) {
+
+	indexed := make(map[string]bool, len(partitions))
+	uncovered := make([]string, 0)
+	for _, part := range partitions {
+		if part.IndexPath() == "" {
+			continue
+		}
+		indexed[part.DataPath()] = true
+		if !covers(files, part.DataPath()) {
+			uncovered = append(uncovered, part.IndexPath())
+		}
+	}
+	kept := make([]postingsFile, 0, len(files) + 1)
+	for _, file := range files {
+		if file.live(indexed) > 0 {
+			kept = append(kept, file)
+		}
+	}
+
+	written := make([]string, 0)
+	write := func(sources []string) (postingsFile, error) {
+		path, covered, err := p.WritePostings(prefix, entry.NextPostings, sources, func(dataPath string) bool {
+			return indexed[dataPath]
+		})
+		if err != nil {
+			return postingsFile{}, err
+		}
+		entry.NextPostings++
+		written = append(written, path)
+		return newPostingsFile(path, covered), nil
+	}
+	if len(uncovered) >= postingsBatch || all && len(uncovered) > 0 {
+		file, err := write(uncovered)
+		if err != nil {
+			return files, nil, nil, err
+		}
+		kept = append(kept, file)
+	}
+	for n := len(kept); n >= 2 && 2 * kept[n - 1].live(indexed) >= kept[n - 2].live(indexed); n = len(kept) {
+		file, err := write([]string{kept[n - 2].path, kept[n - 1].path})
+		if err != nil {
+			s.removeFiles(written)
+			return files, nil, nil, err
+		}
+		kept = append(kept[:n - 2], file)
+	}
+
+	listed := make(map[string]bool, len(kept))
+	paths := make([]string, 0, len(kept))
+	for _, file := range kept {
+		listed[file.path] = true
+		paths = append(paths, file.path)
+	}
+	obsolete := make([]string, 0)
+	for _, path := range append(entry.Postings, written...) {
+		if !listed[path] {
+			obsolete = append(obsolete, path)
+		}
+	}
+	entry.Postings = paths
+	return kept, written, obsolete, nil
+}
+
+func (s *Storage) setPostings(filename string, files []postingsFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, found := s.files[filename]; found {
+		state.postings = files
+	}
+}
+
+// openPostingsFiles keeps postings files mapped once they are opened by lookups, so that they are not read
+// from disk by every lookup, files are closed as they are removed
+type openPostingsFiles struct {
+	mu sync.Mutex
+	opened map[string]*partition.Index
+}
+
+// acquire returns postings file at path acquired by the caller, the file is opened unless it is open already
+func (o *openPostingsFiles) acquire(path string) (*partition.Index, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	index, found := o.opened[path]
+	if !found {
+		var err error
+		index, err = partition.OpenIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		if o.opened == nil {
+			o.opened = map[string]*partition.Index{}
+		}
+		o.opened[path] = index
+	}
+	// files are closed along with their removal from opened
+	index.Acquire()
+	return index, nil
+}
+
+// close closes postings file at path if it is open, lookups which acquired it keep it mapped until they are done,
+// it is called with mu held
+func (o *openPostingsFiles) close(path string) {
+	index, found := o.opened[path]
+	if !found {
+		return
+	}
+	delete(o.opened, path)
+	if err := index.Close(); err != nil {
+		log.Printf("error closing postings file %s: %v", path, err)
+	}
+}
+
+func (o *openPostingsFiles) closeAll() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for path := range o.opened {
+		o.close(path)
+	}
+}
+
+// removeFiles removes partition and postings files, open postings files are closed first, so that they are
+// not opened again by lookups which took the state listing them before it was replaced
+func (s *Storage) removeFiles(paths []string) {
+	s.postings.mu.Lock()
+	defer s.postings.mu.Unlock()
+	for _, path := range paths {
+		s.postings.close(path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing partition file %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"log"
+	"os"
+	"strings"
+)
+
+// recoverPartitionDir brings partition dir in line with catalog after a crash and returns paths of removed files
+//
+// Temporary files of interrupted writes and sorts are removed, as are partition files not listed in catalog,
+// such as ones written by an ingestion which did not finish. Partitions listed in catalog which miss a file
+// are incomplete: the entry is dropped along with its files, so that the source is ingested again.
+// Appended datasets have no source to be ingested from, they only lose incomplete partitions.
+// Missing postings files are dropped from catalog, partitions they covered are looked up one by one.
+func recoverPartitionDir(dir string, c *catalog.Catalog) ([]string, error) {
+	removed := make([]string, 0)
+	remove := func(path string) {
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("error removing partition file %s: %v", path, err)
+			}
+			return
+		}
+		removed = append(removed, path)
+	}
+
+	var changed bool
+	for _, name := range c.Names() {
+		entry, _ := c.Get(name)
+		complete := make([]catalog.PartitionFiles, 0, len(entry.Partitions))
+		for _, files := range entry.Partitions {
+			if exists(files.DataPath) && exists(files.MetaPath) {
+				complete = append(complete, files)
+				continue
+			}
+			log.Printf("partition %s of %s is incomplete", files.DataPath, name)
+			remove(files.DataPath)
+			remove(files.MetaPath)
+			if files.IndexPath != "" {
+				remove(files.IndexPath)
+			}
+		}
+		postings := make([]string, 0, len(entry.Postings))
+		for _, path := range entry.Postings {
+			if exists(path) {
+				postings = append(postings, path)
+				continue
+			}
+			log.Printf("postings file %s of %s is missing", path, name)
+		}
+		if len(complete) == len(entry.Partitions) && len(postings) == len(entry.Postings) {
+			continue
+		}
+		changed = true
+		if !entry.Appended && len(complete) != len(entry.Partitions) {
+			// the rest of files of the entry are not listed anymore and are removed below
+			c.Delete(name)
+			continue
+		}
+		recovered := entry.Copy()
+		recovered.Partitions = complete
+		recovered.Postings = postings
+		c.Set(name, recovered)
+	}
+
+	listed := map[string]bool{}
+	for _, name := range c.Names() {
+		entry, _ := c.Get(name)
+		for _, files := range entry.Partitions {
+			listed[files.DataPath] = true
+			listed[files.MetaPath] = true
+			listed[files.IndexPath] = true
+		}
+		for _, path := range entry.Postings {
+			listed[path] = true
+		}
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return removed, fmt.Errorf("error reading partition dir: %v", err)
+	}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		path := buildPath(dir, name)
+		switch {
+		case dirEntry.IsDir() || name == catalogFileName:
+		case strings.HasSuffix(name, partition.TempSuffix) || strings.HasPrefix(name, processor.SortRunPrefix):
+			remove(path)
+		case isPartitionFile(name) && !listed[path]:
+			remove(path)
+		}
+	}
+
+	if changed {
+		if err := c.Save(); err != nil {
+			return removed, fmt.Errorf("error saving catalog: %v", err)
+		}
+	}
+	return removed, nil
+}
+
+// isPartitionFile tells data, meta, index and postings files apart from other files which could be found in partition dir
+func isPartitionFile(name string) bool {
+	return strings.Contains(name, "-" + partition.DataFileName + "-") ||
+		strings.Contains(name, "-" + partition.MetaFileName + "-") ||
+		strings.Contains(name, "-" + partition.IndexFileName + "-") ||
+		strings.Contains(name, "-" + partition.PostingsFileName + "-")
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestRecoverPartitionDir(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "partitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := func(prefix string, idx string) catalog.PartitionFiles {
+		return catalog.PartitionFiles{
+			DataPath: buildPath(dir, prefix + "-data-" + idx),
+			MetaPath: buildPath(dir, prefix + "-meta-" + idx),
+		}
+	}
+	create := func(names ...string) {
+		for _, name := range names {
+			require.NoError(t, os.WriteFile(buildPath(dir, name), []byte("x"), 0644))
+		}
+	}
+	create(
+		"a.txt-0-data-0", "a.txt-0-meta-0", "a.txt-0-postings-0",
+		// b.txt misses meta of the second partition
+		"b.txt-0-data-0", "b.txt-0-meta-0", "b.txt-0-data-1",
+		// ds misses data of the first partition
+		"ds-0-meta-0", "ds-0-data-1", "ds-0-meta-1",
+		// written by an ingestion which did not finish
+		"c.txt-0-data-0", "c.txt-0-data-1.tmp", "c.txt-0-postings-0",
+		".sort-run-123", "catalog.tmp", "notes",
+	)
+
+	c, err := catalog.Load(filepath.Join(dir, catalogFileName))
+	require.NoError(t, err)
+	// the second postings file of a.txt is missing
+	c.Set("a.txt", &catalog.Entry{
+		Partitions: []catalog.PartitionFiles{files("a.txt-0", "0")},
+		Postings: []string{buildPath(dir, "a.txt-0-postings-0"), buildPath(dir, "a.txt-0-postings-1")},
+	})
+	c.Set("b.txt", &catalog.Entry{Partitions: []catalog.PartitionFiles{files("b.txt-0", "0"), files("b.txt-0", "1")}})
+	c.Set("ds", &catalog.Entry{
+		Appended: true,
+		NextIndex: 2,
+		Partitions: []catalog.PartitionFiles{files("ds-0", "0"), files("ds-0", "1")},
+	})
+
+	removed, err := recoverPartitionDir(dir, c)
+	require.NoError(t, err)
+	for i := range removed {
+		removed[i] = filepath.Base(removed[i])
+	}
+	sort.Strings(removed)
+	require.Equal(t, []string{
+		".sort-run-123", "b.txt-0-data-0", "b.txt-0-data-1", "b.txt-0-meta-0", "c.txt-0-data-0",
+		"c.txt-0-data-1.tmp", "c.txt-0-postings-0", "catalog.tmp", "ds-0-meta-0",
+	}, removed)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	left := make([]string, 0)
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	require.Equal(t, []string{"a.txt-0-data-0", "a.txt-0-meta-0", "a.txt-0-postings-0", "catalog", "ds-0-data-1",
+		"ds-0-meta-1", "notes"}, left)
+
+	c, err = catalog.Load(filepath.Join(dir, catalogFileName))
+	require.NoError(t, err)
+	a, found := c.Get("a.txt")
+	require.True(t, found)
+	require.Equal(t, []string{buildPath(dir, "a.txt-0-postings-0")}, a.Postings)
+	_, found = c.Get("b.txt")
+	require.False(t, found)
+	ds, found := c.Get("ds")
+	require.True(t, found)
+	require.Equal(t, []catalog.PartitionFiles{files("ds-0", "1")}, ds.Partitions)
+	require.Equal(t, 2, ds.NextIndex)
+}
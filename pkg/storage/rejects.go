@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/processor"
+	"log"
+	"os"
+)
+
+const rejectDir = "rejects"
+
+// rejectSink writes rejected lines of a file to a side file as json lines,
+// the side file is only created on the first rejected line
+type rejectSink struct {
+	path string
+	file *os.File
+	encoder *json.Encoder
+}
+
+// newRejectSink returns sink of rejected lines of a file, lines rejected previously are dropped unless keep is set
+func newRejectSink(filename string, keep bool) *rejectSink {
+	sink := &rejectSink{
+		path: buildPath(rejectDir, diskName(filename)),
+	}
+	if !keep {
+		removeRejects(filename)
+	}
+	return sink
+}
+
+func (s *rejectSink) Reject(r processor.Reject) error {
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening reject file: %v", err)
+		}
+		s.file = file
+		s.encoder = json.NewEncoder(file)
+	}
+	if err := s.encoder.Encode(r); err != nil {
+		return fmt.Errorf("error writing reject file: %v", err)
+	}
+	return nil
+}
+
+func (s *rejectSink) Close() {
+	if s.file == nil {
+		return
+	}
+	if err := s.file.Close(); err != nil {
+		log.Printf("error closing reject file %s: %v", s.path, err)
+	}
+}
+
+func removeRejects(filename string) {
+	path := buildPath(rejectDir, diskName(filename))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing reject file %s: %v", path, err)
+	}
+}
+
+// OpenRejects opens json lines with rejected lines of a file, nil is returned if no lines are rejected
+func (s *Storage) OpenRejects(filename string) (*os.File, error) {
+	file, err := os.Open(buildPath(rejectDir, diskName(filename)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening reject file: %v", err)
+	}
+	return file, nil
+}
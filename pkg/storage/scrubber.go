@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Scrub verifies checksums of partitions every interval until ctx is done
+//
+// Partitions failing verification are marked corrupt, queries skip them and report them in response headers.
+// Partitions already known to be corrupt are not verified again.
+func (s *Storage) Scrub(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.scrub(ctx)
+		}
+	}
+}
+
+func (s *Storage) scrub(ctx context.Context) {
+	var verified, corrupt int
+	for _, state := range s.FileStates() {
+		for _, part := range state.Partitions {
+			if ctx.Err() != nil {
+				return
+			}
+			// partitions closed since the states are taken are not verified
+			if part.Corrupt() != nil || !part.Acquire() {
+				continue
+			}
+			verified++
+			if err := part.Verify(); err != nil {
+				log.Printf("partition of %s is corrupt: %v", state.Name, err)
+				corrupt++
+			}
+			part.Release()
+		}
+	}
+	log.Printf("scrubbed %d partitions, %d found corrupt", verified, corrupt)
+}
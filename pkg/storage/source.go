@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// compression of a data file, it is detected by magic bytes
+type compression string
+
+const (
+	compressionNone compression = ""
+	compressionGzip compression = "gzip"
+	compressionBzip2 compression = "bzip2"
+	compressionZstd compression = "zstd"
+)
+
+// archiveFormat of a data file, every regular file of an archive is ingested as its own dataset
+type archiveFormat string
+
+const (
+	archiveNone archiveFormat = ""
+	archiveTar archiveFormat = "tar"
+	archiveZip archiveFormat = "zip"
+)
+
+// sourceFormat tells how records are read from a data file
+type sourceFormat struct {
+	compression compression
+	archive archiveFormat
+}
+
+// plain reports whether data file is read as is, only plain files could be followed
+func (f sourceFormat) plain() bool {
+	return f.compression == compressionNone && f.archive == archiveNone
+}
+
+var compressionMagics = []struct {
+	compression compression
+	magic []byte
+	suffixes []string
+}{
+	{compressionGzip, []byte{0x1f, 0x8b}, []string{".gz", ".gzip"}},
+	{compressionBzip2, []byte("BZh"), []string{".bz2"}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}, []string{".zst", ".zstd"}},
+}
+
+var zipMagic = []byte("PK\x03\x04")
+
+const (
+	tarMagicOffset = 257
+	tarMagic = "ustar"
+	tarBlockSize = 512
+)
+
+// detectFormat reads magic bytes of a data file, tar archives are recognized after decompression
+func detectFormat(filePath string) (sourceFormat, error) {
+	var format sourceFormat
+	file, err := os.Open(filePath)
+	if err != nil {
+		return format, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, len(zipMagic))
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return format, fmt.Errorf("error reading file: %v", err)
+	}
+	header = header[:n]
+	if bytes.Equal(header, zipMagic) {
+		format.archive = archiveZip
+		return format, nil
+	}
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			format.compression = m.compression
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return format, fmt.Errorf("error seeking file: %v", err)
+	}
+	r, closeReader, err := decompress(file, format.compression)
+	if err != nil {
+		return format, err
+	}
+	defer closeReader()
+	block := make([]byte, tarBlockSize)
+	n, _ = io.ReadFull(r, block)
+	if n == tarBlockSize && string(block[tarMagicOffset:tarMagicOffset + len(tarMagic)]) == tarMagic {
+		format.archive = archiveTar
+	}
+	return format, nil
+}
+
+// decompress returns reader of decompressed contents of r, close releases decompressor resources
+func decompress(r io.Reader, c compression) (io.Reader, func(), error) {
+	noop := func() {}
+	switch c {
+	case compressionGzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, noop, fmt.Errorf("error reading gzip header: %v", err)
+		}
+		return gzipReader, func() {
+			gzipReader.Close()
+		}, nil
+	case compressionBzip2:
+		return bzip2.NewReader(r), noop, nil
+	case compressionZstd:
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, noop, fmt.Errorf("error creating zstd reader: %v", err)
+		}
+		return zstdReader, zstdReader.Close, nil
+	}
+	return r, noop, nil
+}
+
+// logicalName strips compression and archive suffixes from a data file name,
+// so that events.log.gz is queried as events.log and members of logs.tar.gz as logs/<member>
+func logicalName(source string, format sourceFormat) string {
+	name := source
+	lower := strings.ToLower(name)
+	trim := func(suffix string) bool {
+		if strings.HasSuffix(lower, suffix) && len(name) > len(suffix) {
+			name = name[:len(name) - len(suffix)]
+			lower = lower[:len(lower) - len(suffix)]
+			return true
+		}
+		return false
+	}
+	if format.archive == archiveTar && format.compression == compressionGzip && trim(".tgz") {
+		return name
+	}
+	for _, m := range compressionMagics {
+		if m.compression != format.compression {
+			continue
+		}
+		for _, suffix := range m.suffixes {
+			if trim(suffix) {
+				break
+			}
+		}
+	}
+	switch format.archive {
+	case archiveTar:
+		trim(".tar")
+	case archiveZip:
+		trim(".zip")
+	}
+	return name
+}
+
+// sourceReader decompresses data file on the fly, seeking to the start restarts decompression
+type sourceReader struct {
+	raw *hashingReader
+	compression compression
+	reader io.Reader
+	close func()
+}
+
+func newSourceReader(raw *hashingReader, c compression) (*sourceReader, error) {
+	r := &sourceReader{
+		raw: raw,
+		compression: c,
+	}
+	if err := r.reset(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *sourceReader) reset() error {
+	reader, closeReader, err := decompress(r.raw, r.compression)
+	if err != nil {
+		return err
+	}
+	r.reader = reader
+	r.close = closeReader
+	return nil
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func (r *sourceReader) Seek(offset int64, whence int) (int64, error) {
+	if _, err := r.raw.Seek(offset, whence); err != nil {
+		return 0, err
+	}
+	r.close()
+	return 0, r.reset()
+}
+
+func (r *sourceReader) Close() {
+	r.close()
+}
+
+// memberName cleans up name of an archive member, it returns false for entries which are not data files
+func memberName(name string, regular bool) (string, bool) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if !regular || strings.HasPrefix(path.Base(name), ".") || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// readArchive calls fn for every data file of an archive, r reads raw contents of the archive
+func readArchive(r io.Reader, file *os.File, size int64, format sourceFormat,
+	fn func(member string, r io.Reader) error) error {
+
+	switch format.archive {
+	case archiveTar:
+		decompressed, closeReader, err := decompress(r, format.compression)
+		if err != nil {
+			return err
+		}
+		defer closeReader()
+		tarReader := tar.NewReader(decompressed)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading tar archive: %v", err)
+			}
+			name, ok := memberName(header.Name, header.FileInfo().Mode().IsRegular())
+			if !ok {
+				continue
+			}
+			if err := fn(name, tarReader); err != nil {
+				return err
+			}
+		}
+	case archiveZip:
+		zipReader, err := zip.NewReader(file, size)
+		if err != nil {
+			return fmt.Errorf("error reading zip archive: %v", err)
+		}
+		for _, f := range zipReader.File {
+			name, ok := memberName(f.Name, f.Mode().IsRegular())
+			if !ok {
+				continue
+			}
+			memberReader, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("error reading zip member %s: %v", f.Name, err)
+			}
+			err = fn(name, memberReader)
+			memberReader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown archive format %s", format.archive)
+}
+
+// diskName escapes name of a dataset to be used in file names, names of archive members contain slashes
+func diskName(name string) string {
+	return url.PathEscape(name)
+}
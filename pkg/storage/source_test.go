@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const sample = "2001-07-08T19:29:30Z a@x.com s1\n"
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstdCompressed(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func tarred(t *testing.T, members map[string]string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for name, contents := range members {
+		require.NoError(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}))
+		_, err := w.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestSourceFormat(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "sources")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	tests := []struct {
+		source string
+		data []byte
+		format sourceFormat
+		name string
+	}{
+		{"events.log", []byte(sample), sourceFormat{}, "events.log"},
+		{"events.log.gz", gzipped(t, []byte(sample)), sourceFormat{compression: compressionGzip}, "events.log"},
+		{"events.zst", zstdCompressed(t, []byte(sample)), sourceFormat{compression: compressionZstd}, "events"},
+		{"unnamed", gzipped(t, []byte(sample)), sourceFormat{compression: compressionGzip}, "unnamed"},
+		{"logs.tar", tarred(t, map[string]string{"a.log": sample}), sourceFormat{archive: archiveTar}, "logs"},
+		{"logs.tgz", gzipped(t, tarred(t, map[string]string{"a.log": sample})),
+			sourceFormat{compression: compressionGzip, archive: archiveTar}, "logs"},
+		{"logs.tar.gz", gzipped(t, tarred(t, map[string]string{"a.log": sample})),
+			sourceFormat{compression: compressionGzip, archive: archiveTar}, "logs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			path := filepath.Join(tmpdir, tt.source)
+			require.NoError(t, os.WriteFile(path, tt.data, 0644))
+			format, err := detectFormat(path)
+			require.NoError(t, err)
+			require.Equal(t, tt.format, format)
+			require.Equal(t, tt.name, logicalName(tt.source, format))
+		})
+	}
+}
+
+func TestSourceReader(t *testing.T) {
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "sources")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	path := filepath.Join(tmpdir, "events.log.gz")
+	require.NoError(t, os.WriteFile(path, gzipped(t, []byte(sample)), 0644))
+	expectedHash, err := hashFile(path)
+	require.NoError(t, err)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	hashed := newHashingReader(file)
+	r, err := newSourceReader(hashed, compressionGzip)
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, sample, string(data))
+	_, err = r.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, sample, string(data))
+
+	hash, err := hashed.Sum()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, hash)
+}
+
+func TestReadArchive(t *testing.T) {
+	members := map[string]string{}
+	data := tarred(t, map[string]string{"./app/a.log": sample, "app/.hidden": sample})
+	err := readArchive(bytes.NewReader(data), nil, 0, sourceFormat{archive: archiveTar},
+		func(member string, r io.Reader) error {
+			contents, err := ioutil.ReadAll(r)
+			members[member] = string(contents)
+			return err
+		})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"app/a.log": sample}, members)
+}
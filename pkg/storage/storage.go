@@ -2,80 +2,1076 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/ssfilatov/ts/pkg/cache"
+	"github.com/ssfilatov/ts/pkg/catalog"
 	"github.com/ssfilatov/ts/pkg/partition"
 	"github.com/ssfilatov/ts/pkg/processor"
 	"golang.org/x/sync/errgroup"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	partitionDir = "partitions"
+	catalogFileName = "catalog"
 )
 
+// FileStatus describes ingestion progress of a single file
+type FileStatus string
+
+const (
+	StatusPending FileStatus = "pending"
+	StatusIngesting FileStatus = "ingesting"
+	StatusReady FileStatus = "ready"
+	StatusFailed FileStatus = "failed"
+)
+
+// FileState is a snapshot of file ingestion state along with partitions published so far
+type FileState struct {
+	Name string
+	Status FileStatus
+	Err error
+	Partitions []partition.Partition
+	// Stats counts accepted and rejected lines of the file
+	Stats processor.LineStats
+
+	// size and modTime of the source file when it was last picked up for ingestion
+	size int64
+	modTime int64
+	// busy is set while the file is being processed
+	busy bool
+	// appendable is set for datasets written through Append
+	appendable bool
+	// source is a name of the data file, it differs from Name for compressed files
+	source string
+	format sourceFormat
+	// parent is set for archive members to the name of the archive
+	parent string
+	// postings are postings files of the dataset, they are replaced as a whole
+	postings []postingsFile
+}
+
+// Config holds storage settings
+type Config struct {
+	PartitionSize int
+	// Dir contains data files
+	Dir string
+	// Follow makes storage read files as they grow instead of processing them once
+	Follow bool
+	// FollowInterval sets how often followed files are checked for new records
+	FollowInterval time.Duration
+	// AllowLateData makes Append accept records older than the data already stored in a dataset
+	AllowLateData bool
+	// Order sets how unsorted data files are handled, see processor.OrderMode
+	Order processor.OrderMode
+	OrderWindow time.Duration
+	SortRunSize int
+	// MaxErrorRate fails ingestion of a file when share of rejected lines exceeds it, zero disables the check
+	MaxErrorRate float64
+	// Workers sets number of parser and writer workers building partitions of a single file
+	Workers int
+	// MaxConcurrentFiles limits number of files ingested at once, zero means no limit
+	MaxConcurrentFiles int
+	// DedupWindow enables dropping of exact duplicate records, see processor.Options
+	DedupWindow time.Duration
+	// Format is a layout of new partition files, partitions are read in the format they are written in
+	Format partition.Format
+	// Compression of new partition files, datasets could override it in dir config
+	Compression partition.Compression
+	// CacheSize is a budget in bytes of decoded partition records kept in memory, zero disables the cache
+	CacheSize int64
+	// FilterFPR is a false positive rate of Bloom filters of new partitions, zero disables filters
+	FilterFPR float64
+	// Index makes new partitions get index files which records are looked up by, see Lookup
+	Index bool
+}
+
 type Storage struct {
-	mu sync.Mutex
-	partitionsByFile map[string][]partition.Partition
+	mu sync.RWMutex
+	files map[string]*FileState
+
+	dir string
+	follow bool
+	followInterval time.Duration
+	allowLateData bool
+	dedupWindow time.Duration
+	catalog *catalog.Catalog
+	processor *processor.Processor
+	dirConfig *processor.DirConfig
+	// ingestSlots limits number of files ingested at once, nil means no limit
+	ingestSlots chan struct{}
+	// running counts goroutines ingesting or following files in background
+	running sync.WaitGroup
+	// cache keeps decoded records of partitions read by queries, nil when it is disabled
+	cache *cache.Cache
+	postings openPostingsFiles
+
+	// appendMu serializes writes to datasets
+	appendMu sync.Mutex
 }
 
+// SetFilePartitions atomically replaces all partitions of a file, replaced partitions are closed
 func (s *Storage) SetFilePartitions(filename string, partitions []partition.Partition) {
+	s.mu.Lock()
+	state, found := s.files[filename]
+	if !found {
+		state = &FileState{Name: filename}
+		s.files[filename] = state
+	}
+	prev := state.Partitions
+	state.Partitions = partitions
+	state.Status = StatusReady
+	s.mu.Unlock()
+	closeReplaced(prev, partitions)
+}
+
+// closeReplaced closes partitions of prev which are not among partitions, queries which acquired them
+// keep them mapped until they are done
+func closeReplaced(prev, partitions []partition.Partition) {
+	kept := make(map[partition.Partition]bool, len(partitions))
+	for _, part := range partitions {
+		kept[part] = true
+	}
+	for _, part := range prev {
+		if kept[part] {
+			continue
+		}
+		if err := part.Close(); err != nil {
+			log.Printf("error closing partition %s: %v", part.DataPath(), err)
+		}
+	}
+}
+
+// AcquireFileState works like GetFileState but acquires partitions of the state, so that they are not unmapped
+// while they are read, partitions should be released with ReleasePartitions
+func (s *Storage) AcquireFileState(filename string) (FileState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, found := s.files[filename]
+	if !found {
+		return FileState{}, false
+	}
+	acquired := *state
+	acquired.Partitions = make([]partition.Partition, 0, len(state.Partitions))
+	for _, part := range state.Partitions {
+		// partitions are only closed once storage is closed as replaced ones are not listed anymore
+		if part.Acquire() {
+			acquired.Partitions = append(acquired.Partitions, part)
+		}
+	}
+	return acquired, true
+}
+
+// ReleasePartitions releases partitions of a state returned by AcquireFileState
+func ReleasePartitions(partitions []partition.Partition) {
+	for _, part := range partitions {
+		part.Release()
+	}
+}
+
+// Close closes partitions and postings files of all files, it is used on shutdown once ingestion is stopped
+func (s *Storage) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.partitionsByFile[filename] = partitions
+	for _, state := range s.files {
+		closeReplaced(state.Partitions, nil)
+	}
+	s.postings.closeAll()
 }
 
+// addSource registers a data file as pending under its logical name unless the name is already taken,
+// the logical name is returned
+func (s *Storage) addSource(source string) (string, bool) {
+	format, err := detectFormat(buildPath(s.dir, source))
+	if err != nil {
+		// the file is registered as is, so that the error is reported once it is processed
+		log.Printf("error detecting format of %s: %v", source, err)
+	}
+	name := logicalName(source, format)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.files[name]; found {
+		return name, false
+	}
+	s.files[name] = &FileState{
+		Name: name,
+		Status: StatusPending,
+		source: source,
+		format: format,
+	}
+	return name, true
+}
+
+// addMember registers archive member unless the name is taken by a file which is not a member of the same archive
+func (s *Storage) addMember(name, parent string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, found := s.files[name]; found {
+		return state.parent == parent
+	}
+	s.files[name] = &FileState{
+		Name: name,
+		Status: StatusPending,
+		parent: parent,
+	}
+	return true
+}
+
+// members returns names of known members of an archive
+func (s *Storage) members(parent string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0)
+	for name, state := range s.files {
+		if state.parent == parent {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// removeFile unpublishes a file and deletes its partitions, members of archives are removed along with them
+//
+// Files which are acquired by ingestion or compaction are not removed and false is returned, so that
+// compaction does not list the file in catalog again once it is removed.
+func (s *Storage) removeFile(filename string) bool {
+	s.mu.Lock()
+	var partitions []partition.Partition
+	if state, found := s.files[filename]; found {
+		if state.busy {
+			s.mu.Unlock()
+			return false
+		}
+		partitions = state.Partitions
+	}
+	delete(s.files, filename)
+	s.mu.Unlock()
+	closeReplaced(partitions, nil)
+	for _, member := range s.members(filename) {
+		s.removeFile(member)
+	}
+
+	if entry, found := s.catalog.Get(filename); found {
+		for _, member := range entry.Members {
+			s.removeFile(member)
+		}
+		s.removePartitionFiles(entry)
+		s.catalog.Delete(filename)
+	}
+	removeRejects(filename)
+	return true
+}
+
+// GetPartitionsByFilename returns partitions of a file regardless of its ingestion status
 func (s *Storage) GetPartitionsByFilename(filename string) ([]partition.Partition, bool) {
-	partitons, found := s.partitionsByFile[filename]
-	return partitons, found
+	state, found := s.GetFileState(filename)
+	if !found {
+		return nil, false
+	}
+	return state.Partitions, true
+}
+
+// GetFileState returns a copy of file state which is safe to use while ingestion goes on
+func (s *Storage) GetFileState(filename string) (FileState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, found := s.files[filename]
+	if !found {
+		return FileState{}, false
+	}
+	return *state, true
+}
+
+// FileStates returns states of all known files sorted by name
+func (s *Storage) FileStates() []FileState {
+	s.mu.RLock()
+	states := make([]FileState, 0, len(s.files))
+	for _, state := range s.files {
+		states = append(states, *state)
+	}
+	s.mu.RUnlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+func (s *Storage) setStatus(filename string, status FileStatus, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.files[filename]
+	state.Status = status
+	state.Err = err
+}
+
+// acquire marks file as being processed, it returns false if the file is processed already
+func (s *Storage) acquire(filename string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, found := s.files[filename]
+	if !found || state.busy {
+		return false
+	}
+	state.busy = true
+	return true
+}
+
+func (s *Storage) release(filename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, found := s.files[filename]; found {
+		state.busy = false
+	}
+}
+
+// background runs fn in a goroutine which is waited for by Wait
+func (s *Storage) background(fn func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		fn()
+	}()
+}
+
+// Wait blocks until files ingested or followed in background are done with,
+// it is used on shutdown once Ingest and Watch return
+func (s *Storage) Wait() {
+	s.running.Wait()
+}
+
+func (s *Storage) setStats(filename string, stats processor.LineStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[filename].Stats = stats
+}
+
+func entryStats(entry *catalog.Entry) processor.LineStats {
+	return processor.LineStats{
+		Accepted: entry.Accepted,
+		Rejected: entry.Rejected,
+		Duplicates: entry.Duplicates,
+	}
+}
+
+func (s *Storage) setFormat(filename string, format sourceFormat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[filename].format = format
+}
+
+func (s *Storage) setFileInfo(filename string, fileInfo os.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.files[filename]
+	state.size = fileInfo.Size()
+	state.modTime = fileInfo.ModTime().UnixNano()
+}
+
+// replacePartitions atomically replaces partitions of a file keeping its status, replaced partitions are closed
+func (s *Storage) replacePartitions(filename string, partitions []partition.Partition) {
+	s.mu.Lock()
+	prev := s.files[filename].Partitions
+	s.files[filename].Partitions = partitions
+	s.mu.Unlock()
+	closeReplaced(prev, partitions)
+}
+
+// dropPartitions unpublishes partitions of a file and closes them, partitions which are not published are closed as well
+func (s *Storage) dropPartitions(filename string, dropped []partition.Partition) {
+	s.mu.Lock()
+	if state, found := s.files[filename]; found {
+		closing := make(map[partition.Partition]bool, len(dropped))
+		for _, part := range dropped {
+			closing[part] = true
+		}
+		kept := make([]partition.Partition, 0, len(state.Partitions))
+		for _, part := range state.Partitions {
+			if !closing[part] {
+				kept = append(kept, part)
+			}
+		}
+		state.Partitions = kept
+	}
+	s.mu.Unlock()
+	closeReplaced(dropped, nil)
+}
+
+// publishPartition makes partition visible to readers, previously returned
+// slices are not affected as published elements are never modified
+func (s *Storage) publishPartition(filename string, part partition.Partition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.files[filename]
+	state.Partitions = append(state.Partitions, part)
+}
+
+// isDataFile filters out dirs and hidden files such as dir config
+func isDataFile(fileInfo os.FileInfo) bool {
+	return !fileInfo.IsDir() && !strings.HasPrefix(fileInfo.Name(), ".")
+}
+
+// processorFor returns processor configured for a file according to dir config,
+// archive members are looked up by their base name
+func (s *Storage) processorFor(fileName string) (*processor.Processor, error) {
+	return s.processor.ForDataset(s.dirConfig.Lookup(path.Base(fileName)))
 }
 
 func buildPath(dir, filename string) string {
 	return fmt.Sprintf("%s/%s", dir, filename)
 }
 
-func NewStorage(ctx context.Context, partitionSize int, dir string) (*Storage, error) {
-	if _, err := os.Stat(partitionDir); os.IsNotExist(err) {
-		if err := os.Mkdir(partitionDir, os.ModePerm); err != nil {
-			return nil, fmt.Errorf("error creating dir: %v", err)
+// NewStorage loads the catalog, removes files left in partition dir by an interrupted run
+// and registers files found in dir as pending, the files are processed by Ingest
+func NewStorage(ctx context.Context, cfg Config) (*Storage, error) {
+	for _, dir := range []string{partitionDir, rejectDir} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.Mkdir(dir, os.ModePerm); err != nil {
+				return nil, fmt.Errorf("error creating dir: %v", err)
+			}
 		}
 	}
 
-	partitionProcessor := processor.NewProcessor(partitionSize, partitionDir)
+	partitionCatalog, err := catalog.Load(buildPath(partitionDir, catalogFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error loading catalog: %v", err)
+	}
+	removed, err := recoverPartitionDir(partitionDir, partitionCatalog)
+	if err != nil {
+		return nil, fmt.Errorf("error recovering partitions: %v", err)
+	}
+	for _, path := range removed {
+		log.Printf("recovery removed %s", path)
+	}
+	if len(removed) > 0 {
+		log.Printf("recovery removed %d files left by an interrupted run", len(removed))
+	}
+
+	dirConfig, err := processor.LoadDirConfig(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading dir config: %v", err)
+	}
+
 	storage := &Storage{
-		partitionsByFile: map[string][]partition.Partition{},
+		files: map[string]*FileState{},
+		dirConfig: dirConfig,
+		dir: cfg.Dir,
+		follow: cfg.Follow,
+		followInterval: cfg.FollowInterval,
+		allowLateData: cfg.AllowLateData,
+		dedupWindow: cfg.DedupWindow,
+		catalog: partitionCatalog,
+		processor: processor.NewProcessorWithOptions(processor.Options{
+			PartitionSize: cfg.PartitionSize,
+			PartitionDirPath: partitionDir,
+			Order: cfg.Order,
+			OrderWindow: cfg.OrderWindow,
+			SortRunSize: cfg.SortRunSize,
+			MaxErrorRate: cfg.MaxErrorRate,
+			Workers: cfg.Workers,
+			DedupWindow: cfg.DedupWindow,
+			Format: cfg.Format,
+			Compression: cfg.Compression,
+			FilterFPR: cfg.FilterFPR,
+			Index: cfg.Index,
+		}),
+	}
+	if cfg.MaxConcurrentFiles > 0 {
+		storage.ingestSlots = make(chan struct{}, cfg.MaxConcurrentFiles)
 	}
+	if cfg.CacheSize > 0 {
+		storage.cache = cache.NewCache(cfg.CacheSize)
+	}
+
+	storage.openDatasets()
 
-	fileInfos, err := ioutil.ReadDir(dir)
+	fileInfos, err := ioutil.ReadDir(cfg.Dir)
 	if err != nil {
-		log.Fatalf("error reading dir: %v", err)
+		return nil, fmt.Errorf("error reading dir: %v", err)
 	}
-	errs, _ := errgroup.WithContext(ctx)
 	for _, fileInfo := range fileInfos {
-		fileInfo := fileInfo
+		if !isDataFile(fileInfo) {
+			continue
+		}
+		if name, added := storage.addSource(fileInfo.Name()); !added {
+			log.Printf("file %s is skipped, dataset %s exists", fileInfo.Name(), name)
+		}
+	}
+
+	return storage, nil
+}
+
+// Ingest processes pending files concurrently, files become available for reading as they are processed
+//
+// Failure to process a file only marks this file as failed.
+// In follow mode files are followed in background until ctx is done.
+// Once ctx is done files being ingested are failed and ctx error is returned, files left pending stay so.
+func (s *Storage) Ingest(ctx context.Context) error {
+	errs, ingestCtx := errgroup.WithContext(ctx)
+	for _, state := range s.FileStates() {
+		if state.Status != StatusPending || !s.acquire(state.Name) {
+			continue
+		}
+		fileName := state.Name
+		if s.follow && state.format.plain() {
+			s.background(func() {
+				s.followFile(ctx, fileName)
+			})
+			continue
+		}
 		errs.Go(func() error {
-			return storage.processFile(dir, fileInfo.Name(), partitionProcessor)
+			s.ingestFile(ingestCtx, fileName)
+			return nil
 		})
 	}
 	if err := errs.Wait(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return storage, nil
+	// files removed from dir since the previous run are dropped along with their partitions
+	for _, name := range s.catalog.Names() {
+		if _, found := s.GetFileState(name); found {
+			continue
+		}
+		entry, _ := s.catalog.Get(name)
+		s.removePartitionFiles(entry)
+		s.catalog.Delete(name)
+		removeRejects(name)
+	}
+	if err := s.catalog.Save(); err != nil {
+		return fmt.Errorf("error saving catalog: %v", err)
+	}
+	return ctx.Err()
 }
 
-func (s *Storage) processFile(dir, fileName string, partitionProcessor *processor.Processor) error {
-	file, err := os.Open(buildPath(dir, fileName))
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// removePartitionFiles removes partition and postings files of entry and drops records of partitions from cache
+func (s *Storage) removePartitionFiles(entry *catalog.Entry) {
+	for _, files := range entry.Partitions {
+		if s.cache != nil {
+			s.cache.Invalidate(files.DataPath)
+		}
+		paths := []string{files.DataPath, files.MetaPath}
+		if files.IndexPath != "" {
+			paths = append(paths, files.IndexPath)
+		}
+		s.removeFiles(paths)
+	}
+	s.removeFiles(entry.Postings)
+}
+
+// partitionFiles returns catalog record of partition files
+func partitionFiles(part partition.Partition) catalog.PartitionFiles {
+	return catalog.PartitionFiles{
+		DataPath: part.DataPath(),
+		MetaPath: part.MetaPath(),
+		IndexPath: part.IndexPath(),
+	}
+}
+
+// staleFiles returns entry listing partition and postings files of prev which are not listed in current
+func staleFiles(prev, current *catalog.Entry) *catalog.Entry {
+	kept := map[string]bool{}
+	for _, files := range current.Partitions {
+		kept[files.DataPath] = true
+	}
+	for _, path := range current.Postings {
+		kept[path] = true
+	}
+	stale := &catalog.Entry{}
+	for _, files := range prev.Partitions {
+		if !kept[files.DataPath] {
+			stale.Partitions = append(stale.Partitions, files)
+		}
+	}
+	for _, path := range prev.Postings {
+		if !kept[path] {
+			stale.Postings = append(stale.Postings, path)
+		}
+	}
+	return stale
+}
+
+// hashingReader computes hash of the file contents while it is being read,
+// it can only seek to the start of the file which resets the hash
+type hashingReader struct {
+	file *os.File
+	hasher hash.Hash
+}
+
+func newHashingReader(file *os.File) *hashingReader {
+	return &hashingReader{
+		file: file,
+		hasher: sha256.New(),
+	}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	r.hasher.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("only seeking to the start is supported")
+	}
+	r.hasher.Reset()
+	return r.file.Seek(0, io.SeekStart)
+}
+
+// Sum reads the rest of the file, decompressors could stop reading before the end, and returns the hash
+func (r *hashingReader) Sum() (string, error) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", fmt.Errorf("error reading file: %v", err)
+	}
+	return hex.EncodeToString(r.hasher.Sum(nil)), nil
+}
+
+// isUnchanged compares source file with the catalog entry, content hash is only
+// computed when size matches but modification time differs, in which case modification time
+// of the entry is updated and the caller should store it
+func (s *Storage) isUnchanged(path string, fileInfo os.FileInfo, entry *catalog.Entry) (bool, error) {
+	if entry.Size != fileInfo.Size() {
+		return false, nil
+	}
+	if entry.ModTime == fileInfo.ModTime().UnixNano() {
+		return true, nil
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+	if hash != entry.Hash {
+		return false, nil
+	}
+	entry.ModTime = fileInfo.ModTime().UnixNano()
+	return true, nil
+}
+
+// reopenPartitions sets up partitions listed in the catalog entry without re-ingesting the source
+//
+// Corrupt partitions fail reopening unless keepCorrupt is set, which is used for datasets having no source
+// to be ingested from again. Kept partitions are marked corrupt, partitions with corrupt meta always fail
+// as their range is unknown.
+func reopenPartitions(entry *catalog.Entry, keepCorrupt bool) ([]partition.Partition, error) {
+	partitionList := make([]partition.Partition, 0, len(entry.Partitions))
+	for _, files := range entry.Partitions {
+		part := partition.NewIndexedPartition(files.DataPath, files.MetaPath, files.IndexPath)
+		if err := part.Setup(); err != nil {
+			if !keepCorrupt || part.Corrupt() == nil {
+				closeReplaced(append(partitionList, part), nil)
+				return nil, err
+			}
+			log.Printf("error reopening partition: %v", err)
+		}
+		partitionList = append(partitionList, part)
+	}
+	return partitionList, nil
+}
+
+// ingestFile processes a file acquired by the caller and records the outcome in its state,
+// the file is left as is if ctx is done before processing starts
+func (s *Storage) ingestFile(ctx context.Context, fileName string) {
+	defer s.release(fileName)
+	if s.ingestSlots != nil {
+		select {
+		case s.ingestSlots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() {
+			<-s.ingestSlots
+		}()
+	}
+	if err := s.processFile(ctx, fileName); err != nil {
+		log.Printf("error processing file %s: %v", fileName, err)
+		s.setStatus(fileName, StatusFailed, err)
+		return
+	}
+	s.setStatus(fileName, StatusReady, nil)
+}
+
+// processFile builds partitions of a file or reopens them if the file did not change
+//
+// Files which are not yet ready publish partitions one by one as they are built.
+// Ready files keep serving previous partitions until the new ones replace them at once,
+// the new generation is written next to the previous one so mapped files are not overwritten.
+// Files of the previous generation are removed once the file is ingested, a failed ingestion keeps them.
+// Compressed files are decompressed on the fly, archives are passed to processArchive.
+// Partitions written before ctx is done are removed.
+func (s *Storage) processFile(ctx context.Context, fileName string) error {
+	state, _ := s.GetFileState(fileName)
+	path := buildPath(s.dir, state.source)
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error reading file info: %v", err)
+	}
+	s.setFileInfo(fileName, fileInfo)
+
+	var generation int
+	prevEntry, found := s.catalog.Get(fileName)
+	if found {
+		unchanged, err := s.isUnchanged(path, fileInfo, prevEntry)
+		if err != nil {
+			return fmt.Errorf("error checking file: %v", err)
+		}
+		if unchanged {
+			s.catalog.Set(fileName, prevEntry)
+		}
+		if unchanged && state.Status == StatusReady {
+			return nil
+		}
+		if unchanged {
+			err := s.reopenFile(fileName, prevEntry)
+			if err == nil {
+				return nil
+			}
+			log.Printf("error reopening partitions of %s, ingesting it again: %v", fileName, err)
+		}
+		generation = prevEntry.Generation + 1
+	}
+
+	// contents of the file could be replaced with a compressed one
+	format, err := detectFormat(path)
+	if err != nil {
+		return err
+	}
+	s.setFormat(fileName, format)
+
+	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
-	partitionList, err := partitionProcessor.ProcessRecords(file, fileName)
+	hashed := newHashingReader(file)
+
+	var entry *catalog.Entry
+	if format.archive != archiveNone {
+		entry, err = s.processArchive(ctx, fileName, hashed, file, fileInfo.Size(), format, generation, prevEntry)
+	} else {
+		var input io.Reader = hashed
+		if format.compression != compressionNone {
+			decompressed, decompressErr := newSourceReader(hashed, format.compression)
+			if decompressErr != nil {
+				return decompressErr
+			}
+			defer decompressed.Close()
+			input = decompressed
+		}
+		entry, err = s.ingestStream(ctx, fileName, input, generation)
+	}
 	if err != nil {
-		log.Fatalf("error processing files %s", err)
+		// previous partitions are kept until the file is ingested, the generation is kept as well,
+		// so that the next ingestion does not reuse names of partitions which could still be read
+		failed := &catalog.Entry{}
+		if found {
+			failed = prevEntry
+		}
+		failed.Generation = generation
+		s.catalog.Set(fileName, failed)
+		return err
+	}
+	if found {
+		s.removePartitionFiles(prevEntry)
+	}
+	entry.Size = fileInfo.Size()
+	entry.ModTime = fileInfo.ModTime().UnixNano()
+	if format.archive == archiveZip {
+		// zip archives are read at random offsets bypassing the hashing reader
+		entry.Hash, err = hashFile(path)
+	} else {
+		entry.Hash, err = hashed.Sum()
+	}
+	if err != nil {
+		return err
+	}
+	s.catalog.Set(fileName, entry)
+	return nil
+}
+
+// reopenFile sets up partitions of an unchanged file, members of archives are published along with it
+func (s *Storage) reopenFile(fileName string, entry *catalog.Entry) error {
+	for _, member := range entry.Members {
+		memberEntry, found := s.catalog.Get(member)
+		if !found {
+			return fmt.Errorf("member %s is missing in catalog", member)
+		}
+		partitionList, err := reopenPartitions(memberEntry, false)
+		if err != nil {
+			return err
+		}
+		if !s.addMember(member, fileName) {
+			closeReplaced(partitionList, nil)
+			continue
+		}
+		s.SetFilePartitions(member, partitionList)
+		s.setPostings(member, s.openPostings(memberEntry))
+		s.setStats(member, entryStats(memberEntry))
+	}
+	partitionList, err := reopenPartitions(entry, false)
+	if err != nil {
+		return err
 	}
 	s.SetFilePartitions(fileName, partitionList)
+	s.setPostings(fileName, s.openPostings(entry))
+	s.setStats(fileName, entryStats(entry))
 	return nil
 }
+
+// ingestStream builds partitions of a dataset from records read from r and returns catalog entry
+// listing them, partitions are published one by one unless the dataset is ready already
+//
+// Partitions are indexed by a postings file once they are all built, failure to write it only makes
+// lookups read index files of partitions one by one.
+func (s *Storage) ingestStream(ctx context.Context, name string, r io.Reader, generation int) (*catalog.Entry, error) {
+	state, _ := s.GetFileState(name)
+	incremental := state.Status != StatusReady
+	if incremental {
+		// partitions left by a failed ingestion are dropped, as the new ones are published from scratch
+		s.replacePartitions(name, nil)
+		s.setPostings(name, nil)
+		s.setStatus(name, StatusIngesting, nil)
+	}
+	entry := &catalog.Entry{
+		Generation: generation,
+		Partitions: make([]catalog.PartitionFiles, 0),
+	}
+	fileProcessor, err := s.processorFor(name)
+	if err != nil {
+		return nil, err
+	}
+	partitionList := make([]partition.Partition, 0)
+	prefix := fmt.Sprintf("%s-%d", diskName(name), generation)
+	rejects := newRejectSink(name, false)
+	defer rejects.Close()
+	stats, err := fileProcessor.ProcessRecordsFunc(ctx, r, prefix, rejects.Reject, func(part partition.Partition) {
+		entry.Partitions = append(entry.Partitions, partitionFiles(part))
+		partitionList = append(partitionList, part)
+		if incremental {
+			s.publishPartition(name, part)
+		}
+	}, func(withdrawn []partition.Partition) {
+		// unsorted records are published again once they are sorted
+		entry.Partitions = entry.Partitions[:0]
+		partitionList = partitionList[:0]
+		if incremental {
+			s.dropPartitions(name, withdrawn)
+		}
+		if s.cache != nil {
+			for _, part := range withdrawn {
+				s.cache.Invalidate(part.DataPath())
+			}
+		}
+	})
+	s.setStats(name, stats)
+	entry.Accepted = stats.Accepted
+	entry.Rejected = stats.Rejected
+	entry.Duplicates = stats.Duplicates
+	if err != nil {
+		s.dropPartitions(name, partitionList)
+		s.removePartitionFiles(entry)
+		return nil, fmt.Errorf("error processing records: %v", err)
+	}
+	postings, _, _, err := s.updatePostings(fileProcessor, prefix, entry, partitionList, nil, true)
+	if err != nil {
+		log.Printf("error indexing %s: %v", name, err)
+	}
+	if !incremental {
+		s.SetFilePartitions(name, partitionList)
+	}
+	s.setPostings(name, postings)
+	return entry, nil
+}
+
+// processArchive ingests every data file of an archive as a dataset named <archive>/<member>
+//
+// Failure to process a member only marks this member as failed. Members missing in the new
+// version of the archive are removed once it is processed. Processing stops once ctx is done.
+func (s *Storage) processArchive(ctx context.Context, fileName string, r io.Reader, file *os.File, size int64, format sourceFormat,
+	generation int, prevEntry *catalog.Entry) (*catalog.Entry, error) {
+
+	entry := &catalog.Entry{
+		Generation: generation,
+		Members: make([]string, 0),
+	}
+	var stats processor.LineStats
+	seen := map[string]bool{}
+	err := readArchive(r, file, size, format, func(member string, memberReader io.Reader) error {
+		name := fileName + "/" + member
+		if !s.addMember(name, fileName) {
+			log.Printf("member %s of %s is skipped, dataset %s exists", member, fileName, name)
+			return nil
+		}
+		seen[name] = true
+		memberEntry, err := s.ingestStream(ctx, name, memberReader, generation)
+		if err != nil {
+			log.Printf("error processing file %s: %v", name, err)
+			s.setStatus(name, StatusFailed, err)
+			return ctx.Err()
+		}
+		s.setStatus(name, StatusReady, nil)
+		if prevMember, found := s.catalog.Get(name); found {
+			// members left by an interrupted run of the same generation share file names with the new ones
+			s.removePartitionFiles(staleFiles(prevMember, memberEntry))
+		}
+		s.catalog.Set(name, memberEntry)
+		entry.Members = append(entry.Members, name)
+		stats.Accepted += memberEntry.Accepted
+		stats.Rejected += memberEntry.Rejected
+		stats.Duplicates += memberEntry.Duplicates
+		return nil
+	})
+	s.setStats(fileName, stats)
+	entry.Accepted = stats.Accepted
+	entry.Rejected = stats.Rejected
+	entry.Duplicates = stats.Duplicates
+
+	if err != nil {
+		return nil, err
+	}
+	stale := s.members(fileName)
+	if prevEntry != nil {
+		stale = append(stale, prevEntry.Members...)
+	}
+	for _, name := range stale {
+		if !seen[name] {
+			s.removeFile(name)
+		}
+	}
+	return entry, nil
+}
+
+// followFile follows a file acquired by the caller until ctx is done
+//
+// Sealed partitions are stored in the catalog along with the position in the file,
+// so that following resumes where it stopped after restart.
+func (s *Storage) followFile(ctx context.Context, fileName string) {
+	defer s.release(fileName)
+	s.setStatus(fileName, StatusIngesting, nil)
+
+	var state processor.FollowState
+	var sealed []partition.Partition
+	var postings []postingsFile
+	entry, found := s.catalog.Get(fileName)
+	if found && entry.Followed {
+		partitionList, err := reopenPartitions(entry, false)
+		if err == nil {
+			sealed = partitionList
+			postings = s.openPostings(entry)
+			state = processor.FollowState{
+				Inode: entry.Inode,
+				Offset: entry.Offset,
+				PartitionIndex: len(entry.Partitions),
+				Line: entry.Line,
+				Stats: entryStats(entry),
+			}
+			if len(sealed) > 0 {
+				state.LastTimestamp = sealed[len(sealed) - 1].MaxTimestamp()
+			}
+		} else {
+			log.Printf("error reopening partitions of %s, following it from the start: %v", fileName, err)
+			found = false
+		}
+	}
+	if sealed == nil {
+		var generation int
+		if found {
+			generation = entry.Generation + 1
+			s.removePartitionFiles(entry)
+		}
+		entry = &catalog.Entry{
+			Generation: generation,
+			Followed: true,
+		}
+		s.catalog.Set(fileName, entry)
+	}
+	entry = entry.Copy()
+	s.replacePartitions(fileName, sealed)
+	s.setPostings(fileName, postings)
+	s.setStats(fileName, state.Stats)
+	// lines after the saved offset are read again, so their rejects could repeat in the reject file
+	rejects := newRejectSink(fileName, sealed != nil)
+	defer rejects.Close()
+
+	prefix := fmt.Sprintf("%s-%d", diskName(fileName), entry.Generation)
+	fileProcessor, err := s.processorFor(fileName)
+	if err != nil {
+		log.Printf("error following file %s: %v", fileName, err)
+		s.setStatus(fileName, StatusFailed, err)
+		return
+	}
+	if s.dedupWindow > 0 && len(sealed) > 0 {
+		// lines delivered again after restart are checked against the tail of sealed partitions
+		seed, err := recentRecords(sealed, state.LastTimestamp - int64(s.dedupWindow))
+		if err != nil {
+			log.Printf("error reading sealed partitions of %s: %v", fileName, err)
+		}
+		fileProcessor = fileProcessor.WithDedupSeed(seed)
+	}
+	fileState, _ := s.GetFileState(fileName)
+	err = fileProcessor.Follow(ctx, buildPath(s.dir, fileState.source), prefix, state, s.followInterval, rejects.Reject,
+		func(update processor.FollowUpdate) {
+			for _, part := range update.Sealed {
+				sealed = append(sealed, part)
+				entry.Partitions = append(entry.Partitions, partitionFiles(part))
+			}
+			// limit capacity so that appending the open partition does not touch sealed slice
+			partitions := sealed[:len(sealed):len(sealed)]
+			if update.Open != nil {
+				partitions = append(partitions, update.Open)
+			}
+			s.replacePartitions(fileName, partitions)
+			s.setStats(fileName, update.Stats)
+			if update.CaughtUp {
+				s.setStatus(fileName, StatusReady, nil)
+			}
+			if len(update.Sealed) > 0 {
+				entry.Inode = update.State.Inode
+				entry.Offset = update.State.Offset
+				entry.Line = update.State.Line
+				entry.Accepted = update.State.Stats.Accepted
+				entry.Rejected = update.State.Stats.Rejected
+				entry.Duplicates = update.State.Stats.Duplicates
+				updated, _, obsolete, err := s.updatePostings(fileProcessor, prefix, entry, sealed, postings, false)
+				if err != nil {
+					log.Printf("error indexing %s: %v", fileName, err)
+				}
+				postings = updated
+				s.setPostings(fileName, postings)
+				s.catalog.Set(fileName, entry.Copy())
+				if err := s.catalog.Save(); err != nil {
+					// files which are not listed in the saved catalog are removed on the next start
+					log.Printf("error saving catalog: %v", err)
+				} else {
+					s.removeFiles(obsolete)
+				}
+			}
+		})
+	if err != nil {
+		log.Printf("error following file %s: %v", fileName, err)
+		s.setStatus(fileName, StatusFailed, err)
+	}
+}
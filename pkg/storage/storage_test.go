@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/ssfilatov/ts/pkg/partition"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inTempDir runs a test in a temporary working dir, as partitions are kept in a dir relative to it,
+// and returns the data dir created there
+func inTempDir(t *testing.T) string {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "storage")
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(tmpdir))
+	t.Cleanup(func() {
+		require.NoError(t, os.Chdir(wd))
+		os.RemoveAll(tmpdir)
+	})
+	require.NoError(t, os.Mkdir("data", os.ModePerm))
+	return "data"
+}
+
+// lines returns n sorted records starting with the given second
+func lines(from, n int) string {
+	var b strings.Builder
+	for i := from; i < from + n; i++ {
+		ts := time.Date(2001, 7, 8, 0, 0, i, 0, time.UTC)
+		fmt.Fprintf(&b, "%s user%d@x.com s%d\n", ts.Format(time.RFC3339), i, i)
+	}
+	return b.String()
+}
+
+func readTimestamps(t *testing.T, partitions []partition.Partition) []int64 {
+	timestamps := make([]int64, 0)
+	for _, part := range partitions {
+		records, err := part.SelectRecords(math.MinInt64, math.MaxInt64)
+		require.NoError(t, err)
+		for _, r := range records {
+			timestamps = append(timestamps, r.Timestamp)
+		}
+	}
+	return timestamps
+}
+
+func dataPaths(partitions []partition.Partition) []string {
+	paths := make([]string, 0, len(partitions))
+	for _, part := range partitions {
+		paths = append(paths, part.DataPath())
+	}
+	return paths
+}
+
+func TestReopenUnchangedFiles(t *testing.T) {
+	dir := inTempDir(t)
+	path := buildPath(dir, "a.txt")
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 5)), 0644))
+
+	s, err := NewStorage(context.Background(), Config{PartitionSize: 2, Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	partitions, found := s.GetPartitionsByFilename("a.txt")
+	require.True(t, found)
+	require.Len(t, partitions, 3)
+	ingested := dataPaths(partitions)
+	timestamps := readTimestamps(t, partitions)
+	s.Close()
+
+	// the same contents with another modification time are only hashed
+	modTime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	s, err = NewStorage(context.Background(), Config{PartitionSize: 2, Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, s.Ingest(context.Background()))
+	defer s.Close()
+	state, _ := s.GetFileState("a.txt")
+	require.Equal(t, StatusReady, state.Status)
+	partitions, _ = s.GetPartitionsByFilename("a.txt")
+	require.Equal(t, ingested, dataPaths(partitions))
+	require.Equal(t, timestamps, readTimestamps(t, partitions))
+
+	c, err := catalog.Load(buildPath(partitionDir, catalogFileName))
+	require.NoError(t, err)
+	entry, found := c.Get("a.txt")
+	require.True(t, found)
+	require.Equal(t, modTime.UnixNano(), entry.ModTime)
+}
+
+func TestIngestUnsortedFile(t *testing.T) {
+	dir := inTempDir(t)
+	// partitions of the sorted head are published and withdrawn once the late records are read
+	require.NoError(t, os.WriteFile(buildPath(dir, "a.txt"), []byte(lines(10, 30) + lines(0, 10)), 0644))
+	s, err := NewStorage(context.Background(), Config{
+		PartitionSize: 4,
+		Dir: dir,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Ingest(context.Background()))
+	state, _ := s.GetFileState("a.txt")
+	require.Equal(t, StatusReady, state.Status)
+	require.Len(t, state.Partitions, 10)
+	expected := make([]int64, 0, 40)
+	for i := 0; i < 40; i++ {
+		expected = append(expected, time.Date(2001, 7, 8, 0, 0, i, 0, time.UTC).UnixNano())
+	}
+	require.Equal(t, expected, readTimestamps(t, state.Partitions))
+	entry, _ := s.catalog.Get("a.txt")
+	require.Len(t, entry.Partitions, 10)
+	files, err := filepath.Glob(buildPath(partitionDir, "a.txt-*"))
+	require.NoError(t, err)
+	require.Len(t, files, 20)
+}
+
+func TestServePartitionsWhileIngesting(t *testing.T) {
+	dir := inTempDir(t)
+	s, err := NewStorage(context.Background(), Config{
+		PartitionSize: 2,
+		Dir: dir,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	s.files["live.txt"] = &FileState{Name: "live.txt", Status: StatusPending}
+
+	r, w := io.Pipe()
+	ingested := make(chan error, 1)
+	go func() {
+		_, err := s.ingestStream(context.Background(), "live.txt", r, 0)
+		ingested <- err
+	}()
+	// the rest of the file is not written until partitions written so far are read
+	_, err = io.WriteString(w, lines(0, 4))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		partitions, _ := s.GetPartitionsByFilename("live.txt")
+		return len(partitions) > 0
+	}, 10 * time.Second, time.Millisecond)
+
+	state, _ := s.AcquireFileState("live.txt")
+	require.Equal(t, StatusIngesting, state.Status)
+	timestamps := readTimestamps(t, state.Partitions)
+	require.NotEmpty(t, timestamps)
+	require.Equal(t, time.Date(2001, 7, 8, 0, 0, 0, 0, time.UTC).UnixNano(), timestamps[0])
+	ReleasePartitions(state.Partitions)
+
+	_, err = io.WriteString(w, lines(4, 1))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, <-ingested)
+	partitions, _ := s.GetPartitionsByFilename("live.txt")
+	require.Len(t, readTimestamps(t, partitions), 5)
+}
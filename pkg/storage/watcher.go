@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+type fileStat struct {
+	size int64
+	modTime int64
+}
+
+// Watch polls dir for new, changed and removed files until ctx is done
+//
+// New and changed files are only picked up once their size and modification time stay the same
+// for a whole interval, so that files which are still being copied into dir are not ingested halfway.
+// Polling is used instead of inotify to keep the service free of platform specific dependencies.
+func (s *Storage) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	prevStats := map[string]fileStat{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats, err := s.scan(ctx, prevStats)
+			if err != nil {
+				log.Printf("error scanning dir: %v", err)
+				continue
+			}
+			prevStats = stats
+		}
+	}
+}
+
+// scan compares dir contents with known files and applies the difference,
+// it returns stats of the files found in dir
+//
+// Followed files are never released, so they are neither ingested again nor removed by scan.
+func (s *Storage) scan(ctx context.Context, prevStats map[string]fileStat) (map[string]fileStat, error) {
+	fileInfos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]fileStat, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if !isDataFile(fileInfo) {
+			continue
+		}
+		stats[fileInfo.Name()] = fileStat{
+			size: fileInfo.Size(),
+			modTime: fileInfo.ModTime().UnixNano(),
+		}
+	}
+
+	var changed bool
+	sources := make(map[string]FileState, len(stats))
+	for _, state := range s.FileStates() {
+		// datasets and archive members have no data file of their own
+		if state.appendable || state.parent != "" {
+			continue
+		}
+		sources[state.source] = state
+		if _, found := stats[state.source]; found {
+			continue
+		}
+		// files which are ingested or compacted are removed once they are released
+		if !s.removeFile(state.Name) {
+			continue
+		}
+		log.Printf("file %s is removed", state.source)
+		changed = true
+	}
+
+	for source, stat := range stats {
+		if prevStats[source] != stat {
+			continue
+		}
+		state, found := sources[source]
+		name := state.Name
+		if !found {
+			var added bool
+			// sources which clash with existing names are skipped silently as they are checked on every scan
+			if name, added = s.addSource(source); !added {
+				continue
+			}
+			log.Printf("file %s is added", source)
+			state, _ = s.GetFileState(name)
+		} else {
+			if state.busy || state.Status == StatusPending {
+				continue
+			}
+			if state.size == stat.size && state.modTime == stat.modTime {
+				continue
+			}
+			log.Printf("file %s is changed", source)
+		}
+		if !s.acquire(name) {
+			continue
+		}
+		if s.follow && state.format.plain() {
+			s.background(func() {
+				s.followFile(ctx, name)
+			})
+		} else {
+			s.background(func() {
+				s.ingestAndSave(ctx, name)
+			})
+		}
+	}
+
+	if changed {
+		if err := s.catalog.Save(); err != nil {
+			log.Printf("error saving catalog: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+func (s *Storage) ingestAndSave(ctx context.Context, fileName string) {
+	s.ingestFile(ctx, fileName)
+	if err := s.catalog.Save(); err != nil {
+		log.Printf("error saving catalog: %v", err)
+	}
+}
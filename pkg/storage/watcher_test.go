@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"github.com/ssfilatov/ts/pkg/catalog"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchedStorage returns storage over an empty data dir and a function which makes storage pick up changes
+// of the dir the way Watch does and waits for them to be processed
+func watchedStorage(t *testing.T) (*Storage, string, func()) {
+	dir := inTempDir(t)
+	s, err := NewStorage(context.Background(), Config{PartitionSize: 2, Dir: dir})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	require.NoError(t, s.Ingest(context.Background()))
+
+	prevStats := map[string]fileStat{}
+	scan := func() {
+		// changes are picked up once stats of files stay the same between scans
+		for i := 0; i < 2; i++ {
+			stats, err := s.scan(context.Background(), prevStats)
+			require.NoError(t, err)
+			prevStats = stats
+		}
+		require.Eventually(t, func() bool {
+			for _, state := range s.FileStates() {
+				if state.busy {
+					return false
+				}
+			}
+			return true
+		}, 5 * time.Second, 10 * time.Millisecond)
+		// catalog is saved once files are released, it is saved again so that the test reads it settled
+		require.NoError(t, s.catalog.Save())
+	}
+	return s, dir, scan
+}
+
+// partitionFileNames returns names of partition files of a file left in partition dir
+func partitionFileNames(t *testing.T, filename string) []string {
+	entries, err := os.ReadDir(partitionDir)
+	require.NoError(t, err)
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), filename + "-") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadEntry(t *testing.T, filename string) (*catalog.Entry, bool) {
+	c, err := catalog.Load(buildPath(partitionDir, catalogFileName))
+	require.NoError(t, err)
+	return c.Get(filename)
+}
+
+func TestWatchNewChangedAndRemovedFiles(t *testing.T) {
+	s, dir, scan := watchedStorage(t)
+	path := buildPath(dir, "a.txt")
+
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 3)), 0644))
+	scan()
+	state, found := s.GetFileState("a.txt")
+	require.True(t, found)
+	require.Equal(t, StatusReady, state.Status)
+	require.Len(t, readTimestamps(t, state.Partitions), 3)
+	require.Equal(t, []string{"a.txt-0-data-0", "a.txt-0-data-1", "a.txt-0-meta-0", "a.txt-0-meta-1"},
+		partitionFileNames(t, "a.txt"))
+
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 4)), 0644))
+	scan()
+	state, _ = s.GetFileState("a.txt")
+	require.Equal(t, StatusReady, state.Status)
+	require.Len(t, readTimestamps(t, state.Partitions), 4)
+	// the previous generation is removed once the new one replaces it
+	require.Equal(t, []string{"a.txt-1-data-0", "a.txt-1-data-1", "a.txt-1-meta-0", "a.txt-1-meta-1"},
+		partitionFileNames(t, "a.txt"))
+	entry, found := loadEntry(t, "a.txt")
+	require.True(t, found)
+	require.Equal(t, 1, entry.Generation)
+
+	require.NoError(t, os.Remove(path))
+	scan()
+	_, found = s.GetFileState("a.txt")
+	require.False(t, found)
+	require.Empty(t, partitionFileNames(t, "a.txt"))
+	_, found = loadEntry(t, "a.txt")
+	require.False(t, found)
+}
+
+func TestWatchFailedThenFixedFile(t *testing.T) {
+	s, dir, scan := watchedStorage(t)
+	path := buildPath(dir, "a.txt")
+
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 2)), 0644))
+	scan()
+	state, _ := s.GetFileState("a.txt")
+	require.Equal(t, StatusReady, state.Status)
+
+	// a partition of the next generation which can not be written fails the file,
+	// partitions of the previous generation are kept on disk and keep being served
+	blocker := buildPath(partitionDir, "a.txt-1-data-0")
+	require.NoError(t, os.Mkdir(blocker, os.ModePerm))
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 3)), 0644))
+	scan()
+	state, _ = s.GetFileState("a.txt")
+	require.Equal(t, StatusFailed, state.Status)
+	require.Equal(t, []string{"partitions/a.txt-0-data-0"}, dataPaths(state.Partitions))
+	require.NoError(t, os.RemoveAll(blocker))
+	require.Equal(t, []string{"a.txt-0-data-0", "a.txt-0-meta-0"}, partitionFileNames(t, "a.txt"))
+	entry, found := loadEntry(t, "a.txt")
+	require.True(t, found)
+	require.Equal(t, 1, entry.Generation)
+
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 4)), 0644))
+	scan()
+	state, _ = s.GetFileState("a.txt")
+	require.Equal(t, StatusReady, state.Status)
+	require.Equal(t, []string{"partitions/a.txt-2-data-0", "partitions/a.txt-2-data-1"}, dataPaths(state.Partitions))
+	timestamps := readTimestamps(t, state.Partitions)
+	require.Len(t, timestamps, 4)
+	require.IsIncreasing(t, timestamps)
+	require.Equal(t, []string{"a.txt-2-data-0", "a.txt-2-data-1", "a.txt-2-meta-0", "a.txt-2-meta-1"},
+		partitionFileNames(t, "a.txt"))
+	entry, _ = loadEntry(t, "a.txt")
+	require.Equal(t, 2, entry.Generation)
+}
+
+func TestWatchRemovedFileWhileCompacting(t *testing.T) {
+	s, dir, scan := watchedStorage(t)
+	path := buildPath(dir, "a.txt")
+	require.NoError(t, os.WriteFile(path, []byte(lines(0, 3)), 0644))
+	scan()
+
+	// compaction holds the file the way ingestion does, the file is removed once it is released
+	require.True(t, s.acquire("a.txt"))
+	require.NoError(t, os.Remove(path))
+	require.False(t, s.removeFile("a.txt"))
+	_, found := s.GetFileState("a.txt")
+	require.True(t, found)
+	_, found = s.catalog.Get("a.txt")
+	require.True(t, found)
+
+	s.release("a.txt")
+	scan()
+	_, found = s.GetFileState("a.txt")
+	require.False(t, found)
+	_, found = loadEntry(t, "a.txt")
+	require.False(t, found)
+	require.Empty(t, partitionFileNames(t, "a.txt"))
+	merged, written, err := s.compactFile(context.Background(), "a.txt", map[string]bool{})
+	require.NoError(t, err)
+	require.Zero(t, merged + written)
+}